@@ -6,14 +6,24 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/spf13/afero"
 
 	"obsidianfs/internal/api"
+	"obsidianfs/internal/blocks"
+	"obsidianfs/internal/collab"
+	"obsidianfs/internal/database"
 	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/history"
+	"obsidianfs/internal/ignore"
 	"obsidianfs/internal/plugins"
+	"obsidianfs/internal/safepath"
+	"obsidianfs/internal/services"
 	"obsidianfs/internal/tags"
 	"obsidianfs/internal/ws"
 )
@@ -29,25 +39,155 @@ func main() {
 		log.Fatalf("failed to ensure data root: %v", err)
 	}
 	docPath := filepath.Join(root, "data")
+	if err := os.MkdirAll(docPath, 0o755); err != nil {
+		log.Fatalf("failed to ensure vault dir: %v", err)
+	}
+
+	// Every vault path goes through one resolver that rejects traversal and,
+	// per OBSIDIAN_SYMLINKS (inside, deny or follow; default inside),
+	// symlinks leading out of the vault
+	symlinkPolicy, err := safepath.ParsePolicy(os.Getenv("OBSIDIAN_SYMLINKS"))
+	if err != nil {
+		log.Fatalf("invalid OBSIDIAN_SYMLINKS: %v", err)
+	}
+	resolver, err := safepath.New(docPath, symlinkPolicy)
+	if err != nil {
+		log.Fatalf("failed to resolve vault dir: %v", err)
+	}
+	// From here on the vault dir is absolute, as the ignore rules, the
+	// watcher and its listeners compare it with absolute paths
+	docPath = resolver.Root()
+
+	// Clean up temp files of writes interrupted by a crash, before anything
+	// else reads or writes the vault
+	if n, err := filesystem.RemoveTempFiles(afero.NewOsFs(), docPath); err != nil {
+		log.Printf("temp file cleanup failed: %v", err)
+	} else if n > 0 {
+		log.Printf("removed %d orphaned temp file(s)", n)
+	}
+
+	// Ignore rules (.obsidianignore plus defaults) shared by the tree API,
+	// the indexers and the watcher
+	ignoreMatcher, err := ignore.New(docPath)
+	if err != nil {
+		log.Printf("failed to read %s: %v", ignore.FileName, err)
+	}
+
+	// Version history of vault files, kept per file by count and age
+	// (OBSIDIAN_HISTORY_MAX_VERSIONS, OBSIDIAN_HISTORY_MAX_AGE; 0 = no limit)
+	maxVersions := 50
+	if env := os.Getenv("OBSIDIAN_HISTORY_MAX_VERSIONS"); env != "" {
+		if maxVersions, err = strconv.Atoi(env); err != nil {
+			log.Fatalf("invalid OBSIDIAN_HISTORY_MAX_VERSIONS %q: %v", env, err)
+		}
+	}
+	maxVersionAge := 90 * 24 * time.Hour
+	if env := os.Getenv("OBSIDIAN_HISTORY_MAX_AGE"); env != "" {
+		if maxVersionAge, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("invalid OBSIDIAN_HISTORY_MAX_AGE %q: %v", env, err)
+		}
+	}
+	historyStore, err := history.NewStore(filepath.Join(root, "history"), docPath, maxVersions, maxVersionAge)
+	if err != nil {
+		log.Fatalf("failed to init history store: %v", err)
+	}
+	stopHistory := make(chan struct{})
+	defer close(stopHistory)
+	go historyStore.RunRetention(time.Hour, stopHistory)
 
 	// Init services
-	fsService, err := filesystem.NewService(docPath)
+	fsService, err := filesystem.NewService(resolver, ignoreMatcher, historyStore)
 	if err != nil {
 		log.Fatalf("failed to init filesystem service: %v", err)
 	}
 
-	// Initialize tag indexer and build initial index
-	indexer := tags.NewIndexer(root)
+	// Purge trashed items after OBSIDIAN_TRASH_RETENTION (default 30 days,
+	// "0" keeps them forever)
+	trashRetention := 30 * 24 * time.Hour
+	if env := os.Getenv("OBSIDIAN_TRASH_RETENTION"); env != "" {
+		if trashRetention, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("invalid OBSIDIAN_TRASH_RETENTION %q: %v", env, err)
+		}
+	}
+	if trashRetention > 0 {
+		stopRetention := make(chan struct{})
+		defer close(stopRetention)
+		go fsService.RunTrashRetention(trashRetention, time.Hour, stopRetention)
+	}
+
+	// Open the block database (siyuan.db) and keep notebooks in sync with top-level folders
+	db, err := database.InitDatabase(filepath.Join(root, "database"))
+	if err != nil {
+		log.Fatalf("failed to init database: %v", err)
+	}
+	defer db.Close()
+	// Attachments go to OBSIDIAN_ATTACHMENTS_DIR (default /attachments),
+	// which is not a notebook even when it sits at the top level
+	attachmentsDir := os.Getenv("OBSIDIAN_ATTACHMENTS_DIR")
+	if attachmentsDir == "" {
+		attachmentsDir = "/attachments"
+	}
+	notebookService := services.NewNotebookService(db, fsService, docPath, attachmentsDir)
+	if err := notebookService.SyncFolders(); err != nil {
+		log.Printf("notebook folder sync failed: %v", err)
+	}
+
+	// Per-user permissions on notebooks and folder prefixes
+	accessService := services.NewAccessService(db, notebookService, docPath)
+
+	// Tag index, kept in the database; at startup only files changed since
+	// the last run are reindexed. Indexers and the watcher share the
+	// filesystem service root so paths line up.
+	indexer := tags.NewIndexer(db, resolver, ignoreMatcher)
 	if err := indexer.ReindexAll(); err != nil {
 		log.Printf("tag indexer initial build failed: %v", err)
 	}
 
+	// Parse markdown files into the blocks table
+	blockIndexer := blocks.NewIndexer(db, resolver, notebookService, ignoreMatcher)
+	if err := blockIndexer.ReindexAll(); err != nil {
+		log.Printf("block indexer initial build failed: %v", err)
+	}
+
+	// Rebuild the indexes when the ignore rules change
+	ignoreMatcher.OnChange(func() {
+		if err := indexer.ReindexAll(); err != nil {
+			log.Printf("tag reindex failed: %v", err)
+		}
+		if err := blockIndexer.ReindexAll(); err != nil {
+			log.Printf("block reindex failed: %v", err)
+		}
+	})
+
+	// WebSocket clients may subscribe to path prefixes, tags and notebooks
 	hub := ws.NewHub()
+	hub.SetTopicLookups(indexer.TagsForFile, func(id string) (string, error) {
+		return accessService.ScopePath(id, "")
+	})
+	// Keep the last OBSIDIAN_WS_HISTORY events (default 1000) for clients
+	// reconnecting with ?since=N, also on disk unless OBSIDIAN_WS_PERSIST=off
+	historySize := ws.DefaultHistorySize
+	if env := os.Getenv("OBSIDIAN_WS_HISTORY"); env != "" {
+		if historySize, err = strconv.Atoi(env); err != nil {
+			log.Fatalf("invalid OBSIDIAN_WS_HISTORY %q: %v", env, err)
+		}
+	}
+	journalPath := filepath.Join(root, "ws-events.jsonl")
+	if os.Getenv("OBSIDIAN_WS_PERSIST") == "off" {
+		journalPath = ""
+	}
+	if err := hub.KeepHistory(historySize, journalPath); err != nil {
+		log.Printf("ws event journal disabled: %v", err)
+		_ = hub.KeepHistory(historySize, "")
+	}
 	go hub.Run()
 
 	// Initialize plugin system
 	pluginsDir := filepath.Join(root, ".plugins")
 	pluginDbPath := filepath.Join(root, ".plugins.db")
+	if _, err := filesystem.RemoveTempFiles(afero.NewOsFs(), pluginsDir); err != nil && !os.IsNotExist(err) {
+		log.Printf("plugin temp file cleanup failed: %v", err)
+	}
 	pluginService, err := plugins.NewService(pluginDbPath, pluginsDir)
 	if err != nil {
 		log.Printf("plugin system disabled: %v", err)
@@ -58,8 +198,29 @@ func main() {
 		}
 	}()
 
-	// Start watcher for external changes
-	watcher, err := filesystem.NewWatcher(root, hub, indexer)
+	// Collaborative editing sessions, written back every
+	// OBSIDIAN_COLLAB_SAVE_INTERVAL (default 2s); edits made on disk are
+	// merged into open sessions through the watcher
+	collabSaveInterval := collab.DefaultSaveInterval
+	if env := os.Getenv("OBSIDIAN_COLLAB_SAVE_INTERVAL"); env != "" {
+		if collabSaveInterval, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("invalid OBSIDIAN_COLLAB_SAVE_INTERVAL %q: %v", env, err)
+		}
+	}
+	collabSessions := collab.NewManager(hub, fsService, docPath)
+	stopCollab := make(chan struct{})
+	defer close(stopCollab)
+	go collabSessions.Run(collabSaveInterval, stopCollab)
+
+	// Start watcher for external changes. OBSIDIAN_FS_DEBOUNCE accepts a
+	// duration such as "300ms".
+	var debounce time.Duration
+	if env := os.Getenv("OBSIDIAN_FS_DEBOUNCE"); env != "" {
+		if debounce, err = time.ParseDuration(env); err != nil {
+			log.Printf("invalid OBSIDIAN_FS_DEBOUNCE %q, using %s", env, filesystem.DefaultDebounce)
+		}
+	}
+	watcher, err := filesystem.NewWatcher(docPath, hub, debounce, ignoreMatcher, indexer, blockIndexer, historyStore, accessService, notebookService, collabSessions)
 	if err != nil {
 		log.Printf("fs watcher disabled: %v", err)
 	} else {
@@ -67,32 +228,113 @@ func main() {
 		defer watcher.Close()
 	}
 
+	// Accounts: sessions and API tokens stored in the database. The first
+	// start creates an admin from OBSIDIAN_ADMIN_USER/OBSIDIAN_ADMIN_PASSWORD
+	// (a generated password is logged once). OBSIDIAN_AUTH=off disables
+	// authentication for local development.
+	authEnabled := os.Getenv("OBSIDIAN_AUTH") != "off"
+	sessionTTL := 30 * 24 * time.Hour
+	if env := os.Getenv("OBSIDIAN_SESSION_TTL"); env != "" {
+		if sessionTTL, err = time.ParseDuration(env); err != nil {
+			log.Fatalf("invalid OBSIDIAN_SESSION_TTL %q: %v", env, err)
+		}
+	}
+	authService := services.NewAuthService(db, sessionTTL)
+	if authEnabled {
+		created, generated, err := authService.Bootstrap(os.Getenv("OBSIDIAN_ADMIN_USER"), os.Getenv("OBSIDIAN_ADMIN_PASSWORD"))
+		if err != nil {
+			log.Fatalf("failed to create admin user: %v", err)
+		}
+		if created && generated != "" {
+			log.Printf("created admin user with password %s; change it after signing in", generated)
+		}
+		if err := authService.PurgeSessions(); err != nil {
+			log.Printf("session cleanup failed: %v", err)
+		}
+	} else {
+		log.Printf("authentication disabled (OBSIDIAN_AUTH=off)")
+	}
+
 	r := gin.Default()
 
-	r.Use(cors.New(cors.Config{
-		AllowAllOrigins:  true,
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	// Cross-origin access only for the comma separated origins in
+	// OBSIDIAN_CORS_ORIGINS; the same list applies to the WebSocket
+	var corsOrigins []string
+	for _, o := range strings.Split(os.Getenv("OBSIDIAN_CORS_ORIGINS"), ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			corsOrigins = append(corsOrigins, o)
+		}
+	}
+	ws.SetAllowedOrigins(corsOrigins)
+	if len(corsOrigins) > 0 {
+		cfg := cors.Config{
+			AllowOrigins:     corsOrigins,
+			AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "If-Match", "If-None-Match", "Range"},
+			ExposeHeaders:    []string{"Content-Length", "ETag"},
+			AllowCredentials: true,
+			MaxAge:           12 * time.Hour,
+		}
+		if len(corsOrigins) == 1 && corsOrigins[0] == "*" {
+			cfg.AllowOrigins, cfg.AllowAllOrigins, cfg.AllowCredentials = nil, true, false
+		}
+		r.Use(cors.New(cfg))
+	}
 
 	// Health
 	r.GET("/api/health", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"ok": true}) })
 
+	// Everything else under /api, and /ws, requires a signed in user whose
+	// grants per notebook and folder (see /api/access/grants) filter what
+	// they see
+	apiGroup := r.Group("/api")
+	var requireAuth []gin.HandlerFunc
+	if authEnabled {
+		requireAuth = append(requireAuth, api.RequireAuth(authService), api.WithAccess(accessService))
+		apiGroup.Use(requireAuth...)
+		api.RegisterAuthRoutes(r.Group("/api"), apiGroup, authService)
+		api.RegisterAccessRoutes(apiGroup, accessService)
+	}
+
 	// API routes
-	api.RegisterRoutes(r.Group("/api"), fsService, hub, indexer, root)
+	api.RegisterRoutes(apiGroup, fsService, hub, indexer, blockIndexer, docPath)
+
+	// Attachments: uploads go to attachmentsDir
+	api.RegisterAttachmentRoutes(apiGroup, fsService, hub, attachmentsDir)
+
+	// File version history
+	api.RegisterHistoryRoutes(apiGroup, historyStore, fsService, hub, docPath, indexer, blockIndexer)
+
+	// Full-text search
+	api.RegisterSearchRoutes(apiGroup, services.NewSearchService(db, indexer))
+
+	// Collaborative editing over /ws
+	api.RegisterCollabCommands(hub, collabSessions)
+
+	// Backlinks and outlinks
+	api.RegisterLinkRoutes(apiGroup, blockIndexer)
+
+	// Frontmatter properties for filters
+	api.RegisterPropertyRoutes(apiGroup, blockIndexer)
+
+	// Notebook API routes
+	api.NewNotebookAPI(notebookService, hub).RegisterRoutes(apiGroup.Group("/notebook"))
 
 	// Plugin API routes
 	if pluginService != nil {
-		plugins.RegisterPluginRoutes(r.Group("/api"), pluginService)
+		plugins.RegisterPluginRoutes(apiGroup, pluginService)
+		api.RegisterPluginCommands(hub, pluginService)
 	}
 
-	// WebSocket endpoint
-	r.GET("/ws", func(c *gin.Context) {
-		ws.ServeWS(hub, c.Writer, c.Request)
-	})
+	// WebSocket counters: connected clients, dropped events, evictions
+	apiGroup.GET("/ws/stats", func(c *gin.Context) { c.JSON(http.StatusOK, hub.Stats()) })
+
+	// WebSocket endpoint: events, subscriptions and commands (readFile,
+	// writeFile, runCommand, collab.*) answered by callback. Reconnect with ?since=N
+	// to get the events after N.
+	r.GET("/ws", append(requireAuth, func(c *gin.Context) {
+		ws.ServeWS(hub, c.Writer, c.Request, api.EventFilter(c, accessService), api.WSSession(c, accessService))
+	})...)
 
 	addr := ":8787"
 	if env := os.Getenv("PORT"); env != "" {
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"net/http"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/services"
+	"obsidianfs/internal/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+const accessKey = "access"
+
+// WithAccess loads the permissions of the signed in user for the handlers;
+// it runs after RequireAuth.
+func WithAccess(access *services.AccessService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a, err := access.For(CurrentUser(c))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(accessKey, a)
+		c.Next()
+	}
+}
+
+// accessFrom returns the permissions of the request; nil allows everything.
+func accessFrom(c *gin.Context) *services.Access {
+	if v, ok := c.Get(accessKey); ok {
+		return v.(*services.Access)
+	}
+	return nil
+}
+
+// allow reports whether the request may act on p at level, answering 403
+// otherwise.
+func allow(c *gin.Context, p string, level services.Level) bool {
+	if accessFrom(c).Can(p, level) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "permission denied", "path": p})
+	return false
+}
+
+// filterTree drops the children of node the request may not see.
+func filterTree(a *services.Access, node *filesystem.Node) {
+	if a.IsAdmin() {
+		return
+	}
+	kept := node.Children[:0]
+	for _, child := range node.Children {
+		if !a.Visible(child.Path) {
+			continue
+		}
+		filterTree(a, &child)
+		kept = append(kept, child)
+	}
+	node.Children = kept
+	// Entry counts of folders that are only visible for something deeper
+	// would reveal hidden entries
+	if !a.Can(node.Path, services.LevelRead) {
+		node.ChildCount = nil
+	} else if node.ChildCount != nil && node.NextCursor == "" && len(kept) > 0 {
+		n := len(kept)
+		node.ChildCount = &n
+	}
+}
+
+// EventFilter returns the WebSocket event filter of the signed in user,
+// or nil when authentication is disabled. Permissions are looked up per
+// event so grant changes apply to open connections.
+func EventFilter(c *gin.Context, access *services.AccessService) ws.Filter {
+	user := CurrentUser(c)
+	if user == nil {
+		return nil
+	}
+	return func(p string) bool {
+		a, err := access.For(user)
+		return err == nil && a.Visible(p)
+	}
+}
+
+// RegisterAccessRoutes registers the permission management endpoints.
+// Global admins manage every grant; users with admin level on a notebook or
+// folder manage the grants inside it.
+func RegisterAccessRoutes(r *gin.RouterGroup, access *services.AccessService) {
+	// GET /access/grants[?user=<id>]
+	r.GET("/access/grants", func(c *gin.Context) {
+		grants, err := access.ListGrants(c.Query("user"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		a := accessFrom(c)
+		if !a.IsAdmin() {
+			kept := grants[:0]
+			for _, g := range grants {
+				if p, err := access.ScopePath(g.Notebook, g.Path); err == nil && a.Can(p, services.LevelAdmin) {
+					kept = append(kept, g)
+				}
+			}
+			grants = kept
+		}
+		c.JSON(http.StatusOK, grants)
+	})
+
+	// POST /access/grants {userID, notebook | path, level} sets a grant
+	r.POST("/access/grants", func(c *gin.Context) {
+		var req struct {
+			UserID   string `json:"userID"`
+			Notebook string `json:"notebook"`
+			Path     string `json:"path"`
+			Level    string `json:"level"` // none | read | write | admin
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		scope, err := access.ScopePath(req.Notebook, req.Path)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !allow(c, scope, services.LevelAdmin) {
+			return
+		}
+		g, err := access.Grant(req.UserID, req.Notebook, req.Path, req.Level)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, g)
+	})
+
+	r.DELETE("/access/grants/:id", func(c *gin.Context) {
+		g, err := access.GetGrant(c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if scope, err := access.ScopePath(g.Notebook, g.Path); err == nil {
+			if !allow(c, scope, services.LevelAdmin) {
+				return
+			}
+		} else if !accessFrom(c).IsAdmin() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "permission denied"})
+			return
+		}
+		if err := access.Revoke(g.ID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/services"
+	"obsidianfs/internal/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inlineType reports whether files of the media type ct may be shown in the
+// browser. Anything else, notably HTML and SVG, could run scripts with the
+// user's session and is only offered for download.
+func inlineType(ct string) bool {
+	mediaType, _, _ := mime.ParseMediaType(ct)
+	switch {
+	case mediaType == "image/svg+xml":
+		return false
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return true
+	}
+	return mediaType == "application/pdf"
+}
+
+// RegisterAttachmentRoutes registers multipart upload into attachmentsDir
+// and raw file download.
+func RegisterAttachmentRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub, attachmentsDir string) {
+	// POST /attachments (multipart, one or more "file" fields, optional
+	// "folder" to override the attachments folder)
+	r.POST("/attachments", func(c *gin.Context) {
+		form, err := c.MultipartForm()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		files := form.File["file"]
+		if len(files) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no file"})
+			return
+		}
+		dir := attachmentsDir
+		if folder := c.PostForm("folder"); folder != "" {
+			dir = folder
+		}
+		if !allow(c, dir, services.LevelWrite) {
+			return
+		}
+
+		type saved struct {
+			Name    string `json:"name"`
+			Path    string `json:"path"`
+			Existed bool   `json:"existed"` // same content was already stored
+		}
+		var out []saved
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "files": out})
+				return
+			}
+			p, existed, err := fsSvc.SaveAttachment(dir, fh.Filename, f)
+			f.Close()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "files": out})
+				return
+			}
+			if !existed {
+				hub.Broadcast(ws.Event{Type: "fs", Action: "created", Path: p})
+			}
+			out = append(out, saved{Name: path.Base(p), Path: p, Existed: existed})
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "files": out})
+	})
+
+	// GET /raw?path=/attachments/a.png[&download=true] streams a file with
+	// its Content-Type and supports Range requests. Only images, audio,
+	// video and PDFs are shown inline, and never with scripts.
+	r.GET("/raw", func(c *gin.Context) {
+		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
+		f, info, err := fsSvc.OpenFile(p)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, fs.ErrNotExist) {
+				status = http.StatusNotFound
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		defer f.Close()
+		ct := mime.TypeByExtension(path.Ext(info.Name()))
+		if ct == "" {
+			var head [512]byte
+			n, _ := io.ReadFull(f, head[:])
+			ct = http.DetectContentType(head[:n])
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		c.Header("Content-Type", ct)
+		c.Header("X-Content-Type-Options", "nosniff")
+		c.Header("Content-Security-Policy", "sandbox")
+		if c.Query("download") == "true" || !inlineType(ct) {
+			c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Name()}))
+		}
+		http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+	})
+}
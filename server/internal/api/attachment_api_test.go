@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/safepath"
+	"obsidianfs/internal/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRawHeaders(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"page.html": "<script>alert(1)</script>",
+		"pic.svg":   `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`,
+		"pic.png":   "\x89PNG\r\n\x1a\n0000",
+		"doc.pdf":   "%PDF-1.4",
+		"noext":     "<html><script>alert(1)</script>",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resolver, err := safepath.New(root, safepath.SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsSvc, err := filesystem.NewService(resolver, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterAttachmentRoutes(r.Group("/api"), fsSvc, ws.NewHub(), "/attachments")
+
+	tests := []struct {
+		name       string
+		query      string
+		typ        string
+		attachment bool
+	}{
+		{"html", "path=/page.html", "text/html; charset=utf-8", true},
+		{"svg", "path=/pic.svg", "image/svg+xml", true},
+		{"png", "path=/pic.png", "image/png", false},
+		{"pdf", "path=/doc.pdf", "application/pdf", false},
+		{"png download", "path=/pic.png&download=true", "image/png", true},
+		{"sniffed html", "path=/noext", "text/html; charset=utf-8", true},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/raw?"+tt.query, nil))
+		h := w.Header()
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", tt.name, w.Code)
+			continue
+		}
+		if got := h.Get("Content-Type"); got != tt.typ {
+			t.Errorf("%s: Content-Type %q, want %q", tt.name, got, tt.typ)
+		}
+		if h.Get("X-Content-Type-Options") != "nosniff" || h.Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("%s: missing nosniff or sandbox: %v", tt.name, h)
+		}
+		if got := h.Get("Content-Disposition") != ""; got != tt.attachment {
+			t.Errorf("%s: Content-Disposition %q", tt.name, h.Get("Content-Disposition"))
+		}
+	}
+	// The sniffed type must not cost the start of the body
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/raw?path=/noext", nil))
+	if w.Body.String() != files["noext"] {
+		t.Errorf("body %q", w.Body.String())
+	}
+}
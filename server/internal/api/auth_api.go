@@ -0,0 +1,236 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCookie is the name of the cookie holding the session token.
+const SessionCookie = "obsidianfs_session"
+
+const userKey = "user"
+
+// requestToken returns the credential of a request: a bearer token, the
+// session cookie or, for WebSocket upgrades that cannot set headers, the
+// access_token query parameter.
+func requestToken(c *gin.Context) string {
+	if h := c.GetHeader("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	if cookie, err := c.Cookie(SessionCookie); err == nil && cookie != "" {
+		return cookie
+	}
+	return c.Query("access_token")
+}
+
+// RequireAuth rejects requests without a valid session or API token and
+// stores the user in the context for CurrentUser.
+func RequireAuth(auth *services.AuthService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		user, err := auth.UserForToken(requestToken(c))
+		if err != nil {
+			status := http.StatusUnauthorized
+			if !errors.Is(err, services.ErrInvalidCredentials) {
+				status = http.StatusInternalServerError
+			}
+			c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		c.Set(userKey, user)
+		c.Next()
+	}
+}
+
+// RequireAdmin lets only admins through; it runs after RequireAuth.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if user := CurrentUser(c); user == nil || user.Role != database.RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin only"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// CurrentUser returns the authenticated user, or nil when authentication
+// is disabled.
+func CurrentUser(c *gin.Context) *database.User {
+	if v, ok := c.Get(userKey); ok {
+		return v.(*database.User)
+	}
+	return nil
+}
+
+// RegisterAuthRoutes registers login on public and the account, token and
+// user management endpoints on protected, which must use RequireAuth.
+func RegisterAuthRoutes(public, protected *gin.RouterGroup, auth *services.AuthService) {
+	// POST /auth/login {username, password} sets the session cookie and
+	// returns the token for clients that send it as a bearer token
+	public.POST("/auth/login", func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := auth.Authenticate(req.Username, req.Password)
+		if errors.Is(err, services.ErrInvalidCredentials) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		token, expires, err := auth.CreateSession(user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.SetSameSite(http.SameSiteLaxMode)
+		c.SetCookie(SessionCookie, token, int(auth.SessionTTL().Seconds()), "/", "", c.Request.TLS != nil, true)
+		c.JSON(http.StatusOK, gin.H{"token": token, "expires": expires, "user": user})
+	})
+
+	// POST /auth/logout ends the current session
+	protected.POST("/auth/logout", func(c *gin.Context) {
+		if err := auth.DeleteSession(requestToken(c)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.SetCookie(SessionCookie, "", -1, "/", "", c.Request.TLS != nil, true)
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	protected.GET("/auth/me", func(c *gin.Context) {
+		c.JSON(http.StatusOK, CurrentUser(c))
+	})
+
+	// PUT /auth/password {current, password} changes the own password and
+	// signs out all sessions
+	protected.PUT("/auth/password", func(c *gin.Context) {
+		var req struct {
+			Current  string `json:"current"`
+			Password string `json:"password"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user := CurrentUser(c)
+		if _, err := auth.Authenticate(user.Username, req.Current); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if err := auth.SetPassword(user.ID, req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// API tokens of the current user
+	protected.GET("/auth/tokens", func(c *gin.Context) {
+		tokens, err := auth.ListAPITokens(CurrentUser(c).ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, tokens)
+	})
+
+	// POST /auth/tokens {name} returns the token once
+	protected.POST("/auth/tokens", func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		token, t, err := auth.CreateAPIToken(CurrentUser(c).ID, req.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"token": token, "info": t})
+	})
+
+	protected.DELETE("/auth/tokens/:id", func(c *gin.Context) {
+		if err := auth.DeleteAPIToken(CurrentUser(c).ID, c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	// User management, admins only
+	admin := protected.Group("/auth/users", RequireAdmin())
+	admin.GET("", func(c *gin.Context) {
+		users, err := auth.ListUsers()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, users)
+	})
+
+	// POST /auth/users {username, password, role}
+	admin.POST("", func(c *gin.Context) {
+		var req struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Role     string `json:"role"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := auth.CreateUser(req.Username, req.Password, req.Role)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, user)
+	})
+
+	// PUT /auth/users/:id/password {password} resets a password
+	admin.PUT("/:id/password", func(c *gin.Context) {
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := auth.SetPassword(c.Param("id"), req.Password); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+
+	admin.DELETE("/:id", func(c *gin.Context) {
+		if c.Param("id") == CurrentUser(c).ID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete yourself"})
+			return
+		}
+		if err := auth.DeleteUser(c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
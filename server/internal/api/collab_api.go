@@ -0,0 +1,91 @@
+package api
+
+import (
+	"obsidianfs/internal/collab"
+	"obsidianfs/internal/services"
+	"obsidianfs/internal/ws"
+)
+
+// wsUserName returns the name collaborators see for the connection of req.
+func wsUserName(req *ws.Request) string {
+	if s, ok := req.Session.(*wsSession); ok && s.user != nil {
+		return s.user.Username
+	}
+	return ""
+}
+
+// RegisterCollabCommands registers the WebSocket commands of collaborative
+// editing. Operations use the ot.js format and UTF-16 positions; after
+// joining, the client gets {type: "collab", action, path, ...} messages:
+// ack and op carry revisions, joined, left and selection the other
+// collaborators, and closed ends the session.
+func RegisterCollabCommands(hub *ws.Hub, sessions *collab.Manager) {
+	type selectionBody struct {
+		Path      string            `json:"path"`
+		Revision  int               `json:"revision"`
+		Selection *collab.Selection `json:"selection"`
+	}
+
+	// collab.join {path} -> {path, revision, content, client, peers}
+	hub.Handle("collab.join", func(req *ws.Request) (any, error) {
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		if err := wsAllow(req, body.Path, services.LevelRead); err != nil {
+			return nil, err
+		}
+		err := sessions.Join(req.Client, wsUserName(req), body.Path, func(snap *collab.Snapshot) {
+			req.Reply(snap)
+		})
+		return nil, err
+	})
+
+	// collab.op {path, revision, op, selection?}; the ack arrives as a
+	// collab message so it is ordered with the operations of the others
+	hub.Handle("collab.op", func(req *ws.Request) (any, error) {
+		var body struct {
+			selectionBody
+			Op *collab.Operation `json:"op"`
+		}
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		if body.Op == nil {
+			return nil, collab.ErrLength
+		}
+		if err := wsAllow(req, body.Path, services.LevelWrite); err != nil {
+			return nil, err
+		}
+		return nil, sessions.Edit(req.Client, body.Path, body.Revision, body.Op, body.Selection)
+	})
+
+	// collab.select {path, revision, selection}
+	hub.Handle("collab.select", func(req *ws.Request) (any, error) {
+		var body selectionBody
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		if body.Selection == nil {
+			body.Selection = &collab.Selection{}
+		}
+		if err := wsAllow(req, body.Path, services.LevelRead); err != nil {
+			return nil, err
+		}
+		return nil, sessions.Select(req.Client, body.Path, body.Revision, body.Selection)
+	})
+
+	// collab.leave {path}
+	hub.Handle("collab.leave", func(req *ws.Request) (any, error) {
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		sessions.Leave(req.Client, body.Path)
+		return nil, nil
+	})
+}
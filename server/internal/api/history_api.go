@@ -0,0 +1,121 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/history"
+	"obsidianfs/internal/services"
+	"obsidianfs/internal/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterHistoryRoutes registers the file version history endpoints.
+// Restores are reported to listeners like other writes made through the API.
+func RegisterHistoryRoutes(r *gin.RouterGroup, store *history.Store, fsSvc *filesystem.Service, hub *ws.Hub, root string, listeners ...filesystem.Listener) {
+	notify := notifier(root, listeners...)
+
+	// GET /history?path=/note.md lists versions, newest first
+	r.GET("/history", func(c *gin.Context) {
+		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
+		versions, err := store.List(p)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"path": p, "versions": versions})
+	})
+
+	// GET /history/version?path=/note.md&id=...
+	r.GET("/history/version", func(c *gin.Context) {
+		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
+		v, content, err := store.Get(p, c.Query("id"))
+		if err != nil {
+			c.JSON(historyStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"path": p, "version": v, "content": string(content)})
+	})
+
+	// GET /history/diff?path=/note.md&from=<id>[&to=<id>]
+	// Without to, the version is compared with the current file.
+	r.GET("/history/diff", func(c *gin.Context) {
+		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
+		fromID, toID := c.Query("from"), c.Query("to")
+		_, from, err := store.Get(p, fromID)
+		if err != nil {
+			c.JSON(historyStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		var to string
+		toName := p + "@current"
+		if toID == "" {
+			if to, err = fsSvc.ReadFile(p); err != nil {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+				return
+			}
+		} else {
+			_, b, err := store.Get(p, toID)
+			if err != nil {
+				c.JSON(historyStatus(err), gin.H{"error": err.Error()})
+				return
+			}
+			to, toName = string(b), p+"@"+toID
+		}
+		diff := history.UnifiedDiff(p+"@"+fromID, toName, string(from), to)
+		c.JSON(http.StatusOK, gin.H{"path": p, "from": fromID, "to": toID, "diff": diff})
+	})
+
+	// POST /history/restore {path, id} writes the version back to the file
+	r.POST("/history/restore", func(c *gin.Context) {
+		var req struct {
+			Path string `json:"path"`
+			ID   string `json:"id"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !allow(c, req.Path, services.LevelWrite) {
+			return
+		}
+		_, content, err := store.Get(req.Path, req.ID)
+		if err != nil {
+			c.JSON(historyStatus(err), gin.H{"error": err.Error()})
+			return
+		}
+		if _, err := fsSvc.Stat(req.Path); err != nil {
+			err = fsSvc.CreateFile(req.Path, string(content))
+			if err == nil {
+				notify("created", req.Path)
+				hub.Broadcast(ws.Event{Type: "fs", Action: "created", Path: req.Path})
+			}
+		} else if err = fsSvc.WriteFile(req.Path, string(content)); err == nil {
+			notify("modified", req.Path)
+			hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: req.Path})
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true})
+	})
+}
+
+func historyStatus(err error) int {
+	if errors.Is(err, history.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
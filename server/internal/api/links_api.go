@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"obsidianfs/internal/blocks"
+	"obsidianfs/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMentionLimit = 100
+
+// RegisterLinkRoutes registers the backlink and outlink endpoints.
+func RegisterLinkRoutes(r *gin.RouterGroup, blockIndexer *blocks.Indexer) {
+	// GET /backlinks?path=/note.md[&mentions=false][&limit=100]
+	// Returns the refs pointing into the note and, unless mentions=false,
+	// blocks that mention its title without linking to it.
+	r.GET("/backlinks", func(c *gin.Context) {
+		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
+		keep := readable(c)
+		backlinks, err := blockIndexer.Backlinks(p)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if keep != nil {
+			kept := backlinks[:0]
+			for _, b := range backlinks {
+				if keep(b.Path) {
+					kept = append(kept, b)
+				}
+			}
+			backlinks = kept
+		}
+		resp := gin.H{"path": p, "backlinks": backlinks}
+		if c.Query("mentions") != "false" {
+			limit, err := strconv.Atoi(c.Query("limit"))
+			if err != nil || limit <= 0 {
+				limit = defaultMentionLimit
+			}
+			mentions, err := blockIndexer.UnlinkedMentions(p, limit)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if keep != nil {
+				kept := mentions[:0]
+				for _, m := range mentions {
+					if keep(m.Path) {
+						kept = append(kept, m)
+					}
+				}
+				mentions = kept
+			}
+			resp["mentions"] = mentions
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// GET /outlinks?path=/note.md
+	r.GET("/outlinks", func(c *gin.Context) {
+		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
+		outlinks, err := blockIndexer.Outlinks(p)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if keep := readable(c); keep != nil {
+			kept := outlinks[:0]
+			for _, ref := range outlinks {
+				if keep(ref.DefBlockPath) {
+					kept = append(kept, ref)
+				}
+			}
+			outlinks = kept
+		}
+		c.JSON(http.StatusOK, gin.H{"path": p, "outlinks": outlinks})
+	})
+}
@@ -5,20 +5,59 @@ import (
 
 	"obsidianfs/internal/database"
 	"obsidianfs/internal/services"
+	"obsidianfs/internal/ws"
 
 	"github.com/gin-gonic/gin"
 )
 
 type NotebookAPI struct {
 	notebookService *services.NotebookService
+	hub             *ws.Hub
 }
 
-func NewNotebookAPI(notebookService *services.NotebookService) *NotebookAPI {
+func NewNotebookAPI(notebookService *services.NotebookService, hub *ws.Hub) *NotebookAPI {
 	return &NotebookAPI{
 		notebookService: notebookService,
+		hub:             hub,
 	}
 }
 
+// allowNotebook 检查当前用户在笔记本上是否至少有 level 权限（读权限只要求笔记本可见），
+// 否则返回错误响应
+func (api *NotebookAPI) allowNotebook(c *gin.Context, id string, level services.Level) bool {
+	notebook, err := api.notebookService.GetNotebook(id)
+	if err != nil {
+		c.JSON(http.StatusOK, database.APIResponse{
+			Code: -1,
+			Msg:  err.Error(),
+		})
+		return false
+	}
+	access := accessFrom(c)
+	path := services.FolderPath(notebook.Name)
+	if (level == services.LevelRead && access.Visible(path)) || access.Can(path, level) {
+		return true
+	}
+	c.JSON(http.StatusOK, database.APIResponse{
+		Code: -1,
+		Msg:  "权限不足",
+	})
+	return false
+}
+
+// RegisterRoutes 注册笔记本相关路由（/api/notebook/*）
+func (api *NotebookAPI) RegisterRoutes(r *gin.RouterGroup) {
+	r.POST("/lsNotebooks", api.ListNotebooks)
+	r.POST("/createNotebook", api.CreateNotebook)
+	r.POST("/renameNotebook", api.RenameNotebook)
+	r.POST("/setNotebookIcon", api.SetNotebookIcon)
+	r.POST("/openNotebook", api.OpenNotebook)
+	r.POST("/closeNotebook", api.CloseNotebook)
+	r.POST("/removeNotebook", api.RemoveNotebook)
+	r.POST("/changeSortNotebook", api.ChangeSortNotebook)
+	r.POST("/getNotebookInfo", api.GetNotebookInfo)
+}
+
 // ListNotebooks 获取所有笔记本
 // POST /api/notebook/lsNotebooks
 func (api *NotebookAPI) ListNotebooks(c *gin.Context) {
@@ -31,6 +70,16 @@ func (api *NotebookAPI) ListNotebooks(c *gin.Context) {
 		return
 	}
 
+	// 只返回当前用户能看到的笔记本
+	access := accessFrom(c)
+	visible := notebooks[:0]
+	for _, notebook := range notebooks {
+		if access.Visible(services.FolderPath(notebook.Name)) {
+			visible = append(visible, notebook)
+		}
+	}
+	notebooks = visible
+
 	c.JSON(http.StatusOK, database.APIResponse{
 		Code: 0,
 		Msg:  "success",
@@ -56,6 +105,15 @@ func (api *NotebookAPI) CreateNotebook(c *gin.Context) {
 		return
 	}
 
+	// 只有管理员可以创建笔记本
+	if !accessFrom(c).IsAdmin() {
+		c.JSON(http.StatusOK, database.APIResponse{
+			Code: -1,
+			Msg:  "权限不足",
+		})
+		return
+	}
+
 	// 设置默认图标
 	if req.Icon == "" {
 		req.Icon = "📔"
@@ -69,6 +127,7 @@ func (api *NotebookAPI) CreateNotebook(c *gin.Context) {
 		})
 		return
 	}
+	api.hub.Broadcast(ws.Event{Type: "fs", Action: "created", Path: services.FolderPath(notebook.Name)})
 
 	c.JSON(http.StatusOK, database.APIResponse{
 		Code: 0,
@@ -95,6 +154,19 @@ func (api *NotebookAPI) RenameNotebook(c *gin.Context) {
 		return
 	}
 
+	if !api.allowNotebook(c, req.Notebook, services.LevelAdmin) {
+		return
+	}
+
+	current, err := api.notebookService.GetNotebook(req.Notebook)
+	if err != nil {
+		c.JSON(http.StatusOK, database.APIResponse{
+			Code: -1,
+			Msg:  err.Error(),
+		})
+		return
+	}
+
 	notebook, err := api.notebookService.RenameNotebook(req.Notebook, req.Name)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
@@ -103,6 +175,10 @@ func (api *NotebookAPI) RenameNotebook(c *gin.Context) {
 		})
 		return
 	}
+	if current.Name != notebook.Name {
+		from, to := services.FolderPath(current.Name), services.FolderPath(notebook.Name)
+		api.hub.Broadcast(ws.Event{Type: "fs", Action: "renamed", Path: to, From: from, To: to})
+	}
 
 	c.JSON(http.StatusOK, database.APIResponse{
 		Code: 0,
@@ -129,6 +205,10 @@ func (api *NotebookAPI) SetNotebookIcon(c *gin.Context) {
 		return
 	}
 
+	if !api.allowNotebook(c, req.Notebook, services.LevelAdmin) {
+		return
+	}
+
 	notebook, err := api.notebookService.SetNotebookIcon(req.Notebook, req.Icon)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
@@ -162,6 +242,10 @@ func (api *NotebookAPI) OpenNotebook(c *gin.Context) {
 		return
 	}
 
+	if !api.allowNotebook(c, req.Notebook, services.LevelWrite) {
+		return
+	}
+
 	err := api.notebookService.OpenNotebook(req.Notebook)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
@@ -192,6 +276,10 @@ func (api *NotebookAPI) CloseNotebook(c *gin.Context) {
 		return
 	}
 
+	if !api.allowNotebook(c, req.Notebook, services.LevelWrite) {
+		return
+	}
+
 	err := api.notebookService.CloseNotebook(req.Notebook)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
@@ -222,7 +310,11 @@ func (api *NotebookAPI) RemoveNotebook(c *gin.Context) {
 		return
 	}
 
-	err := api.notebookService.DeleteNotebook(req.Notebook)
+	if !api.allowNotebook(c, req.Notebook, services.LevelAdmin) {
+		return
+	}
+
+	notebook, err := api.notebookService.GetNotebook(req.Notebook)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
 			Code: -1,
@@ -231,9 +323,22 @@ func (api *NotebookAPI) RemoveNotebook(c *gin.Context) {
 		return
 	}
 
+	item, err := api.notebookService.DeleteNotebook(req.Notebook)
+	if err != nil {
+		c.JSON(http.StatusOK, database.APIResponse{
+			Code: -1,
+			Msg:  err.Error(),
+		})
+		return
+	}
+	api.hub.Broadcast(ws.Event{Type: "fs", Action: "deleted", Path: services.FolderPath(notebook.Name)})
+
 	c.JSON(http.StatusOK, database.APIResponse{
 		Code: 0,
 		Msg:  "success",
+		Data: map[string]interface{}{
+			"trash": item,
+		},
 	})
 }
 
@@ -253,6 +358,10 @@ func (api *NotebookAPI) ChangeSortNotebook(c *gin.Context) {
 		return
 	}
 
+	if !api.allowNotebook(c, req.Notebook, services.LevelWrite) {
+		return
+	}
+
 	err := api.notebookService.ChangeSortNotebook(req.Notebook, req.Sort)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
@@ -283,6 +392,10 @@ func (api *NotebookAPI) GetNotebookInfo(c *gin.Context) {
 		return
 	}
 
+	if !api.allowNotebook(c, req.Notebook, services.LevelRead) {
+		return
+	}
+
 	notebook, err := api.notebookService.GetNotebook(req.Notebook)
 	if err != nil {
 		c.JSON(http.StatusOK, database.APIResponse{
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"obsidianfs/internal/blocks"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterPropertyRoutes registers the frontmatter property endpoint.
+func RegisterPropertyRoutes(r *gin.RouterGroup, blockIndexer *blocks.Indexer) {
+	// GET /properties lists the property keys with their type (text,
+	// number, checkbox, date, datetime, link, list or object) and the
+	// number of files using them.
+	// GET /properties?key=status lists the values of a key, list items one
+	// by one, with the number of files having them.
+	// GET /properties?key=due[&value=][&min=][&max=] lists the files whose
+	// value, or any list item, equals value and lies within min and max;
+	// numbers compare as numbers, dates and text as strings.
+	r.GET("/properties", func(c *gin.Context) {
+		keep := readable(c)
+		key := c.Query("key")
+		value, hasValue := c.GetQuery("value")
+		q := blocks.PropertyQuery{Name: key, Value: value, Min: c.Query("min"), Max: c.Query("max")}
+		var out any
+		var err error
+		switch {
+		case key == "":
+			out, err = blockIndexer.PropertyKeys(keep)
+		case !hasValue && q.Min == "" && q.Max == "":
+			out, err = blockIndexer.PropertyValues(key, keep)
+		default:
+			out, err = blockIndexer.FilesWithProperty(q, keep)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, out)
+	})
+}
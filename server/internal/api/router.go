@@ -1,11 +1,18 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"io/fs"
 	"net/http"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
+	"obsidianfs/internal/blocks"
 	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/services"
 	"obsidianfs/internal/tags"
 	"obsidianfs/internal/ws"
 
@@ -17,30 +24,185 @@ type filePayload struct {
 	Content string `json:"content"`
 }
 
+// countTags fills in the tag counts of node and its children, counting the
+// files keep accepts.
+func countTags(idx *tags.Indexer, node *filesystem.Node, keep func(string) bool) {
+	fillTagCounts(node, idx.TagCounts(node.Path, keep))
+}
+
+func fillTagCounts(node *filesystem.Node, counts map[string]int) {
+	node.TagCount = counts[node.Path]
+	for i := range node.Children {
+		fillTagCounts(&node.Children[i], counts)
+	}
+}
+
+// readable returns a filter for the files the request may read, or nil
+// when it may read everything.
+func readable(c *gin.Context) func(string) bool {
+	a := accessFrom(c)
+	if a.IsAdmin() {
+		return nil
+	}
+	return func(p string) bool { return a.Can(p, services.LevelRead) }
+}
+
+// notifier returns a function that passes a change to a vault path, made
+// through the API, to the listeners.
+func notifier(root string, listeners ...filesystem.Listener) func(action, relPath string) {
+	return func(action, relPath string) {
+		abs, _ := filepath.Abs(filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(relPath), "/")))
+		for _, l := range listeners {
+			l.OnFsEvent(action, abs)
+		}
+	}
+}
+
+// movePayload is the body of POST /move. An existing To is only replaced
+// (and moved to the trash) with Overwrite or an IfMatchTo matching its ETag;
+// the If-Match header guards From.
 type movePayload struct {
-	From string `json:"from"`
-	To   string `json:"to"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Overwrite bool   `json:"overwrite"`
+	IfMatchTo string `json:"ifMatchTo"`
 }
 
-func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub, tagIndexer *tags.Indexer, root string) {
+func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub, tagIndexer *tags.Indexer, blockIndexer *blocks.Indexer, root string, listeners ...filesystem.Listener) {
+	others := listeners
+	if tagIndexer != nil {
+		others = append([]filesystem.Listener{tagIndexer}, listeners...)
+	}
+	// notifyOthers reports a change to the tag indexer and the extra listeners.
+	notifyOthers := notifier(root, others...)
+	// notify reports a change made through the API to the indexes, the same
+	// way the watcher reports external edits.
+	notify := notifyOthers
+	if blockIndexer != nil {
+		notify = notifier(root, append([]filesystem.Listener{blockIndexer}, others...)...)
+	}
+
+	// WebSocket commands working on files
+	registerFileCommands(hub, fsSvc, notify)
+
+	// GET /tree?path=&depth=&sort=name|mtime|size|custom&order=asc|desc&limit=&cursor=
+	// depth counts the levels expanded below the direct children (default
+	// 8, 0 for lazy loading one folder at a time). With a limit the response
+	// carries a nextCursor to fetch the following children of path.
 	r.GET("/tree", func(c *gin.Context) {
-		p := c.Query("path")
-		node, err := fsSvc.ListTree(p, 8)
+		opts := filesystem.TreeOptions{
+			Depth:  8,
+			Sort:   c.Query("sort"),
+			Desc:   c.Query("order") == "desc",
+			Cursor: c.Query("cursor"),
+		}
+		for name, dst := range map[string]*int{"depth": &opts.Depth, "limit": &opts.Limit} {
+			if v := c.Query(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+					return
+				}
+				*dst = n
+			}
+		}
+		if !accessFrom(c).Visible(c.Query("path")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "permission denied", "path": c.Query("path")})
+			return
+		}
+		node, err := fsSvc.ListTreeWith(c.Query("path"), opts)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		filterTree(accessFrom(c), &node)
+		if tagIndexer != nil {
+			countTags(tagIndexer, &node, readable(c))
+		}
+		body, err := json.Marshal(node)
 		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		etag := filesystem.ContentETag(body)
+		c.Header("ETag", etag)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+	})
+
+	// PUT /tree/order {path, order: [names]} sets the custom order of a
+	// folder used by sort=custom; an empty order removes it.
+	r.PUT("/tree/order", func(c *gin.Context) {
+		var req struct {
+			Path  string   `json:"path"`
+			Order []string `json:"order"`
+		}
+		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, node)
+		if !allow(c, req.Path, services.LevelWrite) {
+			return
+		}
+		if err := fsSvc.SetOrder(req.Path, req.Order); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: req.Path})
+		c.JSON(http.StatusOK, gin.H{"ok": true})
 	})
 
+	// conflict answers a write whose If-Match no longer matches with the
+	// current state of the path so the client can merge.
+	conflict := func(c *gin.Context, p string) {
+		resp := gin.H{"error": filesystem.ErrETagMismatch.Error(), "path": p}
+		if etag, err := fsSvc.ETag(p); err == nil {
+			resp["etag"] = etag
+			c.Header("ETag", etag)
+		} else {
+			resp["deleted"] = true
+		}
+		if content, err := fsSvc.ReadFile(p); err == nil {
+			resp["content"] = content
+		}
+		c.JSON(http.StatusConflict, resp)
+	}
+
+	// allowTrash checks write access to where a trashed item came from.
+	allowTrash := func(c *gin.Context, id string) bool {
+		items, err := fsSvc.ListTrash()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+		for _, item := range items {
+			if item.ID == id {
+				return allow(c, item.Path, services.LevelWrite)
+			}
+		}
+		return true // unknown IDs fail in the handler
+	}
+
 	r.GET("/file", func(c *gin.Context) {
 		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
 		content, err := fsSvc.ReadFile(p)
 		if err != nil {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 			return
 		}
-		c.JSON(http.StatusOK, gin.H{"path": p, "content": content})
+		etag := filesystem.ContentETag([]byte(content))
+		c.Header("ETag", etag)
+		if c.GetHeader("If-None-Match") == etag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"path": p, "content": content, "etag": etag})
 	})
 
 	r.POST("/file", func(c *gin.Context) {
@@ -49,15 +211,15 @@ func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub,
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if !allow(c, req.Path, services.LevelWrite) {
+			return
+		}
 		if err := fsSvc.CreateFile(req.Path, req.Content); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		// Update tags indexer
-		if tagIndexer != nil {
-			abs, _ := filepath.Abs(filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(req.Path), "/")))
-			tagIndexer.OnFsEvent("created", abs)
-		}
+		// Update indexes
+		notify("created", req.Path)
 		hub.Broadcast(ws.Event{Type: "fs", Action: "created", Path: req.Path})
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	})
@@ -68,16 +230,25 @@ func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub,
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if err := fsSvc.WriteFile(req.Path, req.Content); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if !allow(c, req.Path, services.LevelWrite) {
 			return
 		}
-		if tagIndexer != nil {
-			abs, _ := filepath.Abs(filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(req.Path), "/")))
-			tagIndexer.OnFsEvent("modified", abs)
+		err := fsSvc.IfMatch(req.Path, c.GetHeader("If-Match"), func() error {
+			return fsSvc.WriteFile(req.Path, req.Content)
+		})
+		if errors.Is(err, filesystem.ErrETagMismatch) {
+			conflict(c, req.Path)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
+		notify("modified", req.Path)
 		hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: req.Path})
-		c.JSON(http.StatusOK, gin.H{"ok": true})
+		etag := filesystem.ContentETag([]byte(req.Content))
+		c.Header("ETag", etag)
+		c.JSON(http.StatusOK, gin.H{"ok": true, "etag": etag})
 	})
 
 	r.POST("/folder", func(c *gin.Context) {
@@ -88,6 +259,9 @@ func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub,
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if !allow(c, req.Path, services.LevelWrite) {
+			return
+		}
 		if err := fsSvc.CreateFolder(req.Path); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
@@ -96,39 +270,176 @@ func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub,
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	})
 
+	// Deletes go to the trash unless permanent=true
 	r.DELETE("/path", func(c *gin.Context) {
 		p := c.Query("path")
-		if err := fsSvc.DeletePath(p); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		if !allow(c, p, services.LevelWrite) {
 			return
 		}
-		if tagIndexer != nil {
-			abs, _ := filepath.Abs(filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(p), "/")))
-			tagIndexer.OnFsEvent("deleted", abs)
+		var item *filesystem.TrashItem
+		err := fsSvc.IfMatch(p, c.GetHeader("If-Match"), func() (err error) {
+			if c.Query("permanent") == "true" {
+				return fsSvc.DeletePath(p)
+			}
+			item, err = fsSvc.TrashPath(p)
+			return err
+		})
+		if errors.Is(err, filesystem.ErrETagMismatch) {
+			conflict(c, p)
+			return
 		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		notify("deleted", p)
 		hub.Broadcast(ws.Event{Type: "fs", Action: "deleted", Path: p})
+		c.JSON(http.StatusOK, gin.H{"ok": true, "trash": item})
+	})
+
+	// Trash endpoints
+	r.GET("/trash", func(c *gin.Context) {
+		items, err := fsSvc.ListTrash()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		a := accessFrom(c)
+		kept := items[:0]
+		for _, item := range items {
+			if a.Can(item.Path, services.LevelRead) {
+				kept = append(kept, item)
+			}
+		}
+		c.JSON(http.StatusOK, kept)
+	})
+
+	r.POST("/trash/restore", func(c *gin.Context) {
+		var req struct {
+			ID       string `json:"id"`
+			Conflict string `json:"conflict"` // fail (default) | rename | overwrite
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !allowTrash(c, req.ID) {
+			return
+		}
+		p, err := fsSvc.RestoreTrash(req.ID, req.Conflict)
+		if errors.Is(err, filesystem.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "path": p})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		notify("created", p)
+		hub.Broadcast(ws.Event{Type: "fs", Action: "created", Path: p})
+		c.JSON(http.StatusOK, gin.H{"ok": true, "path": p})
+	})
+
+	r.DELETE("/trash/:id", func(c *gin.Context) {
+		if !allowTrash(c, c.Param("id")) {
+			return
+		}
+		if err := fsSvc.PurgeTrash(c.Param("id")); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{"ok": true})
 	})
 
+	r.DELETE("/trash", func(c *gin.Context) {
+		if !accessFrom(c).IsAdmin() {
+			c.JSON(http.StatusForbidden, gin.H{"error": "permission denied"})
+			return
+		}
+		n, err := fsSvc.EmptyTrash(0)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "purged": n})
+	})
+
 	r.POST("/move", func(c *gin.Context) {
 		var req movePayload
 		if err := c.BindJSON(&req); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if err := fsSvc.RenamePath(req.From, req.To); err != nil {
+		if !allow(c, req.From, services.LevelWrite) || !allow(c, req.To, services.LevelWrite) {
+			return
+		}
+		// Work out the link rewrites while the index still has the old paths
+		var plan *blocks.MovePlan
+		if blockIndexer != nil {
+			var err error
+			if plan, err = blockIndexer.PlanMove(req.From, req.To); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			// Links are only rewritten in notes the user may edit
+			for src := range plan.Files {
+				if dst, _ := plan.MapPath(src); !accessFrom(c).Can(dst, services.LevelWrite) {
+					delete(plan.Files, src)
+				}
+			}
+		}
+		replaced, err := fsSvc.MovePath(req.From, req.To, c.GetHeader("If-Match"), req.IfMatchTo, req.Overwrite)
+		var target *fs.PathError
+		if errors.As(err, &target) && errors.Is(err, filesystem.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "path": req.To})
+			return
+		}
+		if errors.Is(err, filesystem.ErrETagMismatch) {
+			if errors.As(err, &target) {
+				conflict(c, req.To)
+			} else {
+				conflict(c, req.From)
+			}
+			return
+		}
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		if tagIndexer != nil {
-			absFrom, _ := filepath.Abs(filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(req.From), "/")))
-			absTo, _ := filepath.Abs(filepath.Join(root, strings.TrimPrefix(filepath.FromSlash(req.To), "/")))
-			// Treat as delete+create to preserve counts under new path
-			tagIndexer.OnFsEvent("deleted", absFrom)
-			tagIndexer.OnFsEvent("created", absTo)
+		// Treat as delete+create to preserve counts under new path; the block
+		// index moves its documents so block IDs stay stable.
+		if replaced != nil {
+			notify("deleted", req.To)
+			hub.Broadcast(ws.Event{Type: "fs", Action: "deleted", Path: req.To})
+		}
+		notifyOthers("deleted", req.From)
+		notifyOthers("created", req.To)
+		if blockIndexer != nil {
+			_ = blockIndexer.Rename(req.From, req.To)
 		}
 		hub.Broadcast(ws.Event{Type: "fs", Action: "renamed", Path: req.To, From: req.From, To: req.To})
-		c.JSON(http.StatusOK, gin.H{"ok": true})
+
+		rewritten := []string{}
+		if plan != nil {
+			var err error
+			rewritten, err = plan.Apply(fsSvc.ReadFile, func(p, content string) error {
+				if err := fsSvc.WriteFile(p, content); err != nil {
+					return err
+				}
+				notify("modified", p)
+				hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: p})
+				return nil
+			})
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "rewritten": rewritten})
+				return
+			}
+		}
+		resp := gin.H{"ok": true, "rewritten": rewritten}
+		if replaced != nil {
+			resp["replaced"] = replaced
+		}
+		c.JSON(http.StatusOK, resp)
 	})
 
 	// Tags endpoints
@@ -137,16 +448,101 @@ func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub,
 			c.JSON(http.StatusOK, []any{})
 			return
 		}
-		c.JSON(http.StatusOK, tagIndexer.ListTags())
+		c.JSON(http.StatusOK, tagIndexer.ListTagsWhere(readable(c)))
 	})
 
-	r.GET("/tags/:name", func(c *gin.Context) {
+	// GET /tags/tree returns the tags nested by "/" with their own count and
+	// the total including nested tags. Gin cannot route it next to the
+	// /tags/*name catch-all, which dispatches to it.
+	tagTree := func(c *gin.Context) {
 		if tagIndexer == nil {
 			c.JSON(http.StatusOK, []any{})
 			return
 		}
-		name := c.Param("name")
-		c.JSON(http.StatusOK, tagIndexer.FilesForTag(name))
+		c.JSON(http.StatusOK, tagIndexer.TagTree(readable(c)))
+	}
+
+	// POST /tags/rename {from, to, dryRun} renames a tag, and the tags nested
+	// below it, in the inline tags and frontmatter of every file using it.
+	// Renaming to an existing tag merges the two. Files the user may not
+	// edit are left alone and, when they may read them, listed as skipped.
+	r.POST("/tags/rename", func(c *gin.Context) {
+		var req struct {
+			From   string `json:"from"`
+			To     string `json:"to"`
+			DryRun bool   `json:"dryRun"`
+		}
+		if err := c.BindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if tagIndexer == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "tag index disabled"})
+			return
+		}
+		plan, err := tagIndexer.PlanRename(req.From, req.To, fsSvc.ReadFile)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		// Files the user cannot even read are left out of the response
+		skipped := []string{}
+		keep := readable(c)
+		for p := range plan.Files {
+			if !accessFrom(c).Can(p, services.LevelWrite) {
+				delete(plan.Files, p)
+				if keep == nil || keep(p) {
+					skipped = append(skipped, p)
+				}
+			}
+		}
+		sort.Strings(skipped)
+		resp := gin.H{"from": plan.From, "to": plan.To, "dryRun": req.DryRun, "files": plan.Files, "skipped": skipped}
+		if req.DryRun {
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		rewritten, err := plan.Apply(fsSvc.ReadFile, func(p, content string) error {
+			if err := fsSvc.WriteFile(p, content); err != nil {
+				return err
+			}
+			notify("modified", p)
+			hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: p})
+			return nil
+		})
+		resp["rewritten"] = rewritten
+		if err != nil {
+			resp["error"] = err.Error()
+			c.JSON(http.StatusInternalServerError, resp)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	// GET /tags/*name[?includeChildren=true] lists the files using a tag,
+	// with includeChildren also those using tags nested below it. The name
+	// may contain "/", as nested tags do.
+	r.GET("/tags/*name", func(c *gin.Context) {
+		if c.Param("name") == "/tree" {
+			tagTree(c)
+			return
+		}
+		if tagIndexer == nil {
+			c.JSON(http.StatusOK, []any{})
+			return
+		}
+		name := strings.TrimPrefix(c.Param("name"), "/")
+		refs := tagIndexer.FilesForTag(name, c.Query("includeChildren") == "true")
+		if keep := readable(c); keep != nil {
+			kept := refs[:0]
+			for _, ref := range refs {
+				if keep(ref.Path) {
+					kept = append(kept, ref)
+				}
+			}
+			refs = kept
+		}
+		c.JSON(http.StatusOK, refs)
 	})
 
 	r.GET("/file/tags", func(c *gin.Context) {
@@ -155,6 +551,9 @@ func RegisterRoutes(r *gin.RouterGroup, fsSvc *filesystem.Service, hub *ws.Hub,
 			return
 		}
 		p := c.Query("path")
+		if !allow(c, p, services.LevelRead) {
+			return
+		}
 		c.JSON(http.StatusOK, tagIndexer.TagsForFile(p))
 	})
 }
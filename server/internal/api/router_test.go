@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/safepath"
+	"obsidianfs/internal/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTreeETag(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.md"), []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := safepath.New(root, safepath.SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsSvc, err := filesystem.NewService(resolver, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	RegisterRoutes(r.Group("/api"), fsSvc, ws.NewHub(), nil, nil, root)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/tree?path=/&depth=0", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q", first.Code, etag)
+	}
+	if again := get(""); again.Header().Get("ETag") != etag {
+		t.Errorf("ETag changed without a change: %q, %q", etag, again.Header().Get("ETag"))
+	}
+	if w := get(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match: status %d, body %q", w.Code, w.Body.String())
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "b.md"), []byte("b"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w := get(etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after adding a file: status %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"obsidianfs/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RegisterSearchRoutes registers GET /search.
+//
+// Query parameters: q (supports "phrases" and prefix*), path, notebook, tag,
+// page (1-based) and pageSize (at most 200).
+func RegisterSearchRoutes(r *gin.RouterGroup, searchService *services.SearchService) {
+	r.GET("/search", func(c *gin.Context) {
+		page, _ := strconv.Atoi(c.Query("page"))
+		pageSize, _ := strconv.Atoi(c.Query("pageSize"))
+		result, err := searchService.Search(services.SearchOptions{
+			Query:    c.Query("q"),
+			Path:     c.Query("path"),
+			Notebook: c.Query("notebook"),
+			Tag:      c.Query("tag"),
+			Allow:    readable(c),
+			Page:     page,
+			PageSize: pageSize,
+		})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, result)
+	})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"errors"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/plugins"
+	"obsidianfs/internal/services"
+	"obsidianfs/internal/ws"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errPermissionDenied answers commands on paths the user may not use.
+var errPermissionDenied = errors.New("permission denied")
+
+// wsSession is the WebSocket session of a signed in user; the command
+// handlers look the permissions up per command so grant changes apply to
+// open connections.
+type wsSession struct {
+	user   *database.User
+	access *services.AccessService
+}
+
+// WSSession returns the session ServeWS hands to the command handlers of
+// the connection.
+func WSSession(c *gin.Context, access *services.AccessService) any {
+	return &wsSession{user: CurrentUser(c), access: access}
+}
+
+// wsAllow checks that the connection of req may act on p at level.
+func wsAllow(req *ws.Request, p string, level services.Level) error {
+	s, ok := req.Session.(*wsSession)
+	if !ok || s.access == nil {
+		return nil
+	}
+	a, err := s.access.For(s.user)
+	if err != nil {
+		return err
+	}
+	if !a.Can(p, level) {
+		return errPermissionDenied
+	}
+	return nil
+}
+
+// registerFileCommands registers the readFile and writeFile WebSocket
+// commands. notify reports writes to the indexes like the REST handlers do.
+func registerFileCommands(hub *ws.Hub, fsSvc *filesystem.Service, notify func(action, relPath string)) {
+	// readFile {path} -> {path, content, etag}
+	hub.Handle("readFile", func(req *ws.Request) (any, error) {
+		var body struct {
+			Path string `json:"path"`
+		}
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		if err := wsAllow(req, body.Path, services.LevelRead); err != nil {
+			return nil, err
+		}
+		content, err := fsSvc.ReadFile(body.Path)
+		if err != nil {
+			return nil, err
+		}
+		etag := filesystem.ContentETag([]byte(content))
+		return map[string]any{"path": body.Path, "content": content, "etag": etag}, nil
+	})
+
+	// writeFile {path, content, etag?} -> {path, etag}. With an etag the
+	// write only happens if the file did not change; a conflict replies with
+	// the current etag and content.
+	hub.Handle("writeFile", func(req *ws.Request) (any, error) {
+		var body struct {
+			Path    string `json:"path"`
+			Content string `json:"content"`
+			ETag    string `json:"etag"`
+		}
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		if err := wsAllow(req, body.Path, services.LevelWrite); err != nil {
+			return nil, err
+		}
+		err := fsSvc.IfMatch(body.Path, body.ETag, func() error {
+			return fsSvc.WriteFile(body.Path, body.Content)
+		})
+		if errors.Is(err, filesystem.ErrETagMismatch) {
+			current := map[string]any{"path": body.Path}
+			if etag, err := fsSvc.ETag(body.Path); err == nil {
+				current["etag"] = etag
+			} else {
+				current["deleted"] = true
+			}
+			if content, err := fsSvc.ReadFile(body.Path); err == nil {
+				current["content"] = content
+			}
+			return nil, &ws.ReplyError{Err: err, Data: current}
+		}
+		if err != nil {
+			return nil, err
+		}
+		notify("modified", body.Path)
+		hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: body.Path})
+		return map[string]any{"path": body.Path, "etag": filesystem.ContentETag([]byte(body.Content))}, nil
+	})
+}
+
+// RegisterPluginCommands registers the runCommand WebSocket command, which
+// runs plugin code and so needs admin rights on the whole vault:
+// runCommand {id, args} -> {result}
+func RegisterPluginCommands(hub *ws.Hub, service *plugins.Service) {
+	hub.Handle("runCommand", func(req *ws.Request) (any, error) {
+		if err := wsAllow(req, "/", services.LevelAdmin); err != nil {
+			return nil, err
+		}
+		var body struct {
+			ID   string   `json:"id"`
+			Args []string `json:"args"`
+		}
+		if err := req.Bind(&body); err != nil {
+			return nil, err
+		}
+		result, err := service.GetRuntime().ExecuteCommand(body.ID, body.Args)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": result}, nil
+	})
+}
@@ -0,0 +1,459 @@
+package blocks
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/ignore"
+	"obsidianfs/internal/safepath"
+	"obsidianfs/internal/utils"
+)
+
+// BoxResolver maps a file path (relative to the vault root) to the ID of the
+// notebook that contains it.
+type BoxResolver interface {
+	BoxForPath(relPath string) string
+}
+
+// Indexer keeps the blocks table in sync with the markdown files under root.
+// Like tags.Indexer it supports a full ReindexAll at startup and incremental
+// updates through OnFsEvent.
+type Indexer struct {
+	db       *database.DB
+	root     string
+	resolver *safepath.Resolver
+	boxes    BoxResolver
+	ignore   *ignore.Matcher
+	mu       sync.Mutex
+}
+
+func NewIndexer(db *database.DB, resolver *safepath.Resolver, boxes BoxResolver, ignore *ignore.Matcher) *Indexer {
+	return &Indexer{db: db, root: resolver.Root(), resolver: resolver, boxes: boxes, ignore: ignore}
+}
+
+// ReindexAll walks the root, (re)indexes files whose modification time or
+// notebook changed since they were last indexed, and drops documents whose
+// files no longer exist. Links are resolved once all documents are indexed.
+func (x *Indexer) ReindexAll() error {
+	seen := make(map[string]bool)
+	relink := make(map[string]bool)
+	err := filepath.WalkDir(x.root, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if p != x.root && x.ignore.MatchAbs(p, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isMarkdown(p) {
+			return nil
+		}
+		rel := x.rel(p)
+		seen[rel] = true
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if x.upToDate(rel, info) {
+			return nil
+		}
+		affected, err := x.indexFile(p)
+		if err != nil {
+			return fmt.Errorf("index %s: %w", rel, err)
+		}
+		for _, id := range affected {
+			relink[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rows, err := x.db.Query("SELECT path FROM blocks WHERE type = ?", database.NodeDocument)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err == nil && !seen[p] {
+			stale = append(stale, p)
+		}
+	}
+	rows.Close()
+	for _, p := range stale {
+		if err := x.removePath(p); err != nil {
+			return err
+		}
+	}
+	for id := range relink {
+		if err := x.relink(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update indexes one file and re-resolves the links affected by it.
+func (x *Indexer) update(absPath string) error {
+	affected, err := x.indexFile(absPath)
+	if err != nil {
+		return err
+	}
+	for _, id := range affected {
+		if err := x.relink(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OnFsEvent handles fs events to keep the blocks table up-to-date.
+// action one of: created | modified | deleted | renamed. For renamed, absPath
+// is the old location; the new location arrives as a separate created event.
+// Directory events are applied to every markdown file below the directory.
+func (x *Indexer) OnFsEvent(action string, absPath string) {
+	switch action {
+	case "created", "modified":
+		info, err := os.Stat(absPath)
+		if err != nil {
+			return
+		}
+		if info.IsDir() {
+			_ = filepath.WalkDir(absPath, func(p string, d os.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if x.ignore.MatchAbs(p, d.IsDir()) {
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if !d.IsDir() && isMarkdown(p) {
+					_ = x.update(p)
+				}
+				return nil
+			})
+			return
+		}
+		if isMarkdown(absPath) && !x.ignore.MatchAbs(absPath, false) {
+			_ = x.update(absPath)
+		}
+	case "deleted", "renamed":
+		if isMarkdown(absPath) {
+			_ = x.removePath(x.rel(absPath))
+			return
+		}
+		_ = x.removePrefix(x.rel(absPath))
+	}
+}
+
+// OnFsRename moves the documents at or below fromAbs so their block IDs
+// survive a rename made outside the API.
+func (x *Indexer) OnFsRename(fromAbs, toAbs string) {
+	if err := x.Rename(x.rel(fromAbs), x.rel(toAbs)); err != nil {
+		log.Printf("block index rename %s: %v", fromAbs, err)
+	}
+}
+
+func isMarkdown(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".md" || ext == ".markdown"
+}
+
+func (x *Indexer) rel(abs string) string {
+	rel, err := filepath.Rel(x.root, abs)
+	if err != nil {
+		return abs
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// hpath returns the human readable path of a document: its path without
+// the markdown extension.
+func hpath(rel string) string {
+	return strings.TrimSuffix(rel, filepath.Ext(rel))
+}
+
+func (x *Indexer) box(rel string) string {
+	if x.boxes == nil {
+		return ""
+	}
+	return x.boxes.BoxForPath(rel)
+}
+
+// upToDate reports whether the indexed document for rel matches the file's
+// modification time and notebook. Documents indexed before properties were
+// stored have an empty IAL and are reindexed.
+func (x *Indexer) upToDate(rel string, info fs.FileInfo) bool {
+	var updated, box, ial string
+	err := x.db.QueryRow("SELECT updated, box, ial FROM blocks WHERE path = ? AND type = ?", rel, database.NodeDocument).Scan(&updated, &box, &ial)
+	if err != nil {
+		return false
+	}
+	return updated == info.ModTime().UTC().Format(time.RFC3339Nano) && box == x.box(rel) && ial != "{}"
+}
+
+// indexFile parses a markdown file and replaces its block tree and the
+// properties of its document. The document block keeps its ID across
+// reindexes, and child blocks whose markdown did not change keep theirs, so
+// block references stay valid.
+//
+// It returns the IDs of the documents whose links need to be resolved again:
+// the file itself, documents that referenced its old blocks, and, for a new
+// file, documents whose links may name it.
+func (x *Indexer) indexFile(absPath string) ([]string, error) {
+	info, err := os.Stat(absPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, x.removePath(x.rel(absPath))
+		}
+		return nil, err
+	}
+	// Never read through a symlink that leaves the vault
+	if err := x.resolver.Check(absPath); err != nil {
+		return nil, x.removePath(x.rel(absPath))
+	}
+	b, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+	nodes := Parse(string(b))
+
+	rel := x.rel(absPath)
+	box := x.box(rel)
+	now := time.Now().UTC().Format(time.RFC3339)
+	updated := info.ModTime().UTC().Format(time.RFC3339Nano)
+	title := strings.TrimSuffix(filepath.Base(rel), filepath.Ext(rel))
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	tx, err := x.db.BeginTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var rootID, created string
+	var affected []string
+	err = tx.QueryRow("SELECT id, created FROM blocks WHERE path = ? AND type = ?", rel, database.NodeDocument).Scan(&rootID, &created)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		rootID = utils.GenerateBlockID()
+		created = now
+		_, err = tx.Exec(`INSERT INTO blocks (id, parent_id, root_id, type, subtype, content, markdown, path, hpath, box, created, updated)
+			VALUES (?, '', ?, ?, '', ?, '', ?, ?, ?, ?, ?)`,
+			rootID, rootID, database.NodeDocument, title, rel, hpath(rel), box, created, updated)
+		if err != nil {
+			return nil, err
+		}
+		// Unresolved links are not stored, so look for notes that may name
+		// the new document.
+		err = collectIDs(tx, &affected, `SELECT DISTINCT root_id FROM blocks
+			WHERE type IN (?, ?, ?) AND markdown LIKE '%[[%' AND markdown LIKE ? ESCAPE '\'`,
+			refSourceTypes[0], refSourceTypes[1], refSourceTypes[2], "%"+escapeLike(title)+"%")
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		_, err = tx.Exec("UPDATE blocks SET content = ?, hpath = ?, box = ?, updated = ? WHERE id = ?",
+			title, hpath(rel), box, updated, rootID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	affected = append(affected, rootID)
+
+	// Frontmatter properties go to the attributes table
+	if err := storeProperties(tx, rootID, title, string(b), now); err != nil {
+		return nil, err
+	}
+
+	// Refs into the old child blocks are dropped with them (ON DELETE
+	// CASCADE); the referring documents must be relinked afterwards.
+	err = collectIDs(tx, &affected, `SELECT DISTINCT r.root_id FROM refs r JOIN blocks b ON b.id = r.def_block_id
+		WHERE b.root_id = ? AND r.root_id != ?`, rootID, rootID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember the IDs of existing blocks by markdown so unchanged blocks
+	// keep their IDs.
+	reuse := make(map[string][]string)
+	rows, err := tx.Query("SELECT id, markdown FROM blocks WHERE root_id = ? AND id != ? ORDER BY sort", rootID, rootID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, md string
+		if err := rows.Scan(&id, &md); err == nil {
+			reuse[md] = append(reuse[md], id)
+		}
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("DELETE FROM blocks WHERE root_id = ? AND id != ?", rootID, rootID); err != nil {
+		return nil, err
+	}
+
+	w := &blockWriter{tx: tx, rootID: rootID, rel: rel, box: box, now: now, updated: updated, reuse: reuse}
+	if err := w.insert(rootID, nodes); err != nil {
+		return nil, err
+	}
+	return affected, tx.Commit()
+}
+
+// collectIDs appends the single-column results of query to ids.
+func collectIDs(tx *sql.Tx, ids *[]string, query string, args ...interface{}) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		*ids = append(*ids, id)
+	}
+	return rows.Err()
+}
+
+type blockWriter struct {
+	tx      *sql.Tx
+	rootID  string
+	rel     string
+	box     string
+	now     string
+	updated string
+	reuse   map[string][]string
+}
+
+func (w *blockWriter) id(n *Node) string {
+	if n.IALID != "" && utils.ValidateID(n.IALID) {
+		var exists int
+		if err := w.tx.QueryRow("SELECT COUNT(*) FROM blocks WHERE id = ?", n.IALID).Scan(&exists); err == nil && exists == 0 {
+			return n.IALID
+		}
+	}
+	if ids := w.reuse[n.Markdown]; len(ids) > 0 {
+		w.reuse[n.Markdown] = ids[1:]
+		return ids[0]
+	}
+	return utils.GenerateBlockID()
+}
+
+func (w *blockWriter) insert(parentID string, nodes []*Node) error {
+	for i, n := range nodes {
+		id := w.id(n)
+		_, err := w.tx.Exec(`INSERT INTO blocks (id, parent_id, root_id, type, subtype, content, markdown, path, hpath, name, sort, box, created, updated)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, parentID, w.rootID, n.Type, n.SubType, n.Content, n.Markdown, w.rel, hpath(w.rel), n.Anchor, i, w.box, w.now, w.updated)
+		if err != nil {
+			return err
+		}
+		if err := w.insert(id, n.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePath deletes a document and, through the root_id foreign key, all
+// of its blocks.
+func (x *Indexer) removePath(rel string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, err := x.db.Exec("DELETE FROM blocks WHERE path = ? AND type = ?", rel, database.NodeDocument)
+	return err
+}
+
+// Rename moves the indexed documents at or below from to to, keeping their
+// block IDs so block references survive the move, then reindexes the files
+// at their new location.
+func (x *Indexer) Rename(from, to string) error {
+	from, to = "/"+strings.Trim(from, "/"), "/"+strings.Trim(to, "/")
+	if x.ignore.Match(to, !isMarkdown(to)) {
+		// Moved out of sight
+		if isMarkdown(from) {
+			return x.removePath(from)
+		}
+		return x.removePrefix(from)
+	}
+	prefix := from + "/"
+	rows, err := x.db.Query("SELECT path FROM blocks WHERE type = ? AND (path = ? OR substr(path, 1, ?) = ?)",
+		database.NodeDocument, from, utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return err
+	}
+	moved := make(map[string]string)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err == nil {
+			moved[p] = to + strings.TrimPrefix(p, from)
+		}
+	}
+	rows.Close()
+	// Resolve notebooks before the transaction; the database has a single
+	// connection.
+	boxes := make(map[string]string, len(moved))
+	for _, newPath := range moved {
+		boxes[newPath] = x.box(newPath)
+	}
+
+	x.mu.Lock()
+	err = func() error {
+		tx, err := x.db.BeginTx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for oldPath, newPath := range moved {
+			if _, err := tx.Exec("UPDATE blocks SET path = ?, hpath = ?, box = ? WHERE path = ?",
+				newPath, hpath(newPath), boxes[newPath], oldPath); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE refs SET path = ?, box = ? WHERE path = ?", newPath, boxes[newPath], oldPath); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("UPDATE refs SET def_block_path = ? WHERE def_block_path = ?", newPath, oldPath); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	x.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	x.OnFsEvent("created", filepath.Join(x.root, filepath.FromSlash(to)))
+	return nil
+}
+
+// removePrefix deletes every document below a directory.
+func (x *Indexer) removePrefix(relDir string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	prefix := strings.TrimSuffix(relDir, "/") + "/"
+	_, err := x.db.Exec("DELETE FROM blocks WHERE type = ? AND substr(path, 1, ?) = ?", database.NodeDocument, utf8.RuneCountInString(prefix), prefix)
+	return err
+}
@@ -0,0 +1,121 @@
+package blocks
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/safepath"
+)
+
+// testIndexer returns an indexer over an empty vault in a temporary
+// directory, with its own database.
+func testIndexer(t *testing.T) *Indexer {
+	t.Helper()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := database.InitDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	resolver, err := safepath.New(root, safepath.SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIndexer(db, resolver, nil, nil)
+}
+
+// writeNote writes a note below the vault root and indexes it as the
+// watcher would.
+func writeNote(t *testing.T, x *Indexer, rel, content string) {
+	t.Helper()
+	abs := filepath.Join(x.root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(abs, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	x.OnFsEvent("modified", abs)
+}
+
+type indexedBlock struct {
+	id, markdown string
+}
+
+// indexedBlocks lists the blocks of the document at rel below the
+// document block, in document order.
+func indexedBlocks(t *testing.T, x *Indexer, rel string) (string, []indexedBlock) {
+	t.Helper()
+	var rootID string
+	if err := x.db.QueryRow("SELECT id FROM blocks WHERE path = ? AND type = ?", rel, database.NodeDocument).Scan(&rootID); err != nil {
+		t.Fatalf("document %s: %v", rel, err)
+	}
+	rows, err := x.db.Query("SELECT id, markdown FROM blocks WHERE root_id = ? AND id != ? ORDER BY rowid", rootID, rootID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var blocks []indexedBlock
+	for rows.Next() {
+		var b indexedBlock
+		if err := rows.Scan(&b.id, &b.markdown); err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, b)
+	}
+	return rootID, blocks
+}
+
+func TestBlockIDReuse(t *testing.T) {
+	x := testIndexer(t)
+	writeNote(t, x, "/note.md", "# Title\n\nSame\n\nChanged\n\nSame\n\nFixed\n{: id=\"20240101120000-abcdefg\"}")
+	rootID, before := indexedBlocks(t, x, "/note.md")
+	if len(before) != 5 || before[4].id != "20240101120000-abcdefg" {
+		t.Fatalf("first index: %+v", before)
+	}
+
+	// Insert a block, edit one and move the kramdown id to a new text
+	writeNote(t, x, "/note.md", "# Title\n\nNew\n\nSame\n\nChanged!\n\nSame\n\nFixed, edited\n{: id=\"20240101120000-abcdefg\"}")
+	rootAfter, after := indexedBlocks(t, x, "/note.md")
+	if rootAfter != rootID {
+		t.Errorf("document ID changed: %s -> %s", rootID, rootAfter)
+	}
+	if len(after) != 6 {
+		t.Fatalf("reindex: %+v", after)
+	}
+	old := map[string]bool{}
+	for _, b := range before {
+		old[b.id] = true
+	}
+	checks := []struct {
+		i    int
+		want string // the old ID, or "" for a new one
+	}{
+		{0, before[0].id}, // unchanged heading
+		{1, ""},           // inserted paragraph
+		{2, before[1].id}, // first "Same" keeps the first ID
+		{3, ""},           // edited paragraph
+		{4, before[3].id}, // second "Same" keeps the second ID
+		{5, "20240101120000-abcdefg"},
+	}
+	for _, c := range checks {
+		got := after[c.i]
+		if c.want == "" && old[got.id] {
+			t.Errorf("block %d %q reused ID %s", c.i, got.markdown, got.id)
+		}
+		if c.want != "" && got.id != c.want {
+			t.Errorf("block %d %q has ID %s, want %s", c.i, got.markdown, got.id, c.want)
+		}
+	}
+
+	// A kramdown id taken by another document is not reused
+	writeNote(t, x, "/other.md", "Copy\n{: id=\"20240101120000-abcdefg\"}")
+	if _, blocks := indexedBlocks(t, x, "/other.md"); blocks[0].id == "20240101120000-abcdefg" {
+		t.Errorf("duplicate kramdown id was used twice")
+	}
+}
@@ -0,0 +1,309 @@
+package blocks
+
+import (
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"obsidianfs/internal/database"
+)
+
+// Replacement rewrites one link, as written, to a new link.
+type Replacement struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// MovePlan lists the link rewrites needed when a file or folder moves from
+// From to To. Files is keyed by each note's path before the move.
+type MovePlan struct {
+	From  string
+	To    string
+	Files map[string][]Replacement
+}
+
+// MapPath returns where rel ends up after the move, and whether it moves.
+func (p *MovePlan) MapPath(rel string) (string, bool) {
+	if rel == p.From {
+		return p.To, true
+	}
+	if strings.HasPrefix(rel, p.From+"/") {
+		return p.To + strings.TrimPrefix(rel, p.From), true
+	}
+	return rel, false
+}
+
+// PlanMove works out, before from is moved to to, which notes contain links
+// that the move would break and how each link must be rewritten. That covers
+// wikilinks and markdown links pointing at moved notes or attachments, and
+// relative markdown links inside moved notes. It must run while the index
+// still reflects the old layout.
+func (x *Indexer) PlanMove(from, to string) (*MovePlan, error) {
+	plan := &MovePlan{
+		From:  "/" + strings.Trim(from, "/"),
+		To:    "/" + strings.Trim(to, "/"),
+		Files: make(map[string][]Replacement),
+	}
+
+	// Attachments have no blocks; collect the moved ones from disk so links
+	// to them can be matched.
+	var movedFiles []string
+	_ = filepath.WalkDir(filepath.Join(x.root, filepath.FromSlash(plan.From)), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !isMarkdown(p) {
+			movedFiles = append(movedFiles, x.rel(p))
+		}
+		return nil
+	})
+
+	prefix := plan.From + "/"
+	prefixLen := utf8.RuneCountInString(prefix)
+	sources := make(map[string]bool)
+	queries := []struct {
+		query string
+		args  []interface{}
+	}{
+		// Notes that are moved themselves
+		{`SELECT path FROM blocks WHERE type = ? AND (path = ? OR substr(path, 1, ?) = ?)`,
+			[]interface{}{database.NodeDocument, plan.From, prefixLen, prefix}},
+		// Notes with resolved links into the moved notes
+		{`SELECT DISTINCT r.path FROM refs r JOIN blocks d ON d.id = r.def_block_id
+			WHERE d.path = ? OR substr(d.path, 1, ?) = ?`,
+			[]interface{}{plan.From, prefixLen, prefix}},
+		// Notes whose text names the moved file or folder (attachments, paths)
+		{`SELECT DISTINCT path FROM blocks WHERE type IN (?, ?, ?) AND markdown LIKE ? ESCAPE '\'`,
+			[]interface{}{refSourceTypes[0], refSourceTypes[1], refSourceTypes[2],
+				"%" + escapeLike(strings.TrimSuffix(path.Base(plan.From), path.Ext(plan.From))) + "%"}},
+	}
+	for _, q := range queries {
+		rows, err := x.db.Query(q.query, q.args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var p string
+			if err := rows.Scan(&p); err == nil {
+				sources[p] = true
+			}
+		}
+		rows.Close()
+	}
+
+	for src := range sources {
+		reps, err := x.planFile(plan, src, movedFiles)
+		if err != nil {
+			return nil, err
+		}
+		if len(reps) > 0 {
+			plan.Files[src] = reps
+		}
+	}
+	return plan, nil
+}
+
+func (x *Indexer) planFile(plan *MovePlan, src string, movedFiles []string) ([]Replacement, error) {
+	rows, err := x.db.Query(`SELECT markdown FROM blocks WHERE path = ? AND type IN (?, ?, ?)`,
+		src, refSourceTypes[0], refSourceTypes[1], refSourceTypes[2])
+	if err != nil {
+		return nil, err
+	}
+	var markdowns []string
+	for rows.Next() {
+		var md string
+		if err := rows.Scan(&md); err == nil {
+			markdowns = append(markdowns, md)
+		}
+	}
+	rows.Close()
+
+	newSrc, srcMoved := plan.MapPath(src)
+	seen := make(map[string]bool)
+	var reps []Replacement
+	for _, md := range markdowns {
+		for _, link := range ParseLinks(md) {
+			if seen[link.Raw] || link.BlockID != "" {
+				continue
+			}
+			seen[link.Raw] = true
+
+			var newRaw string
+			if link.URL != "" {
+				target, _ := resolveURL(link.URL, src)
+				newTarget, moved := plan.MapPath(target)
+				if !moved && !srcMoved {
+					continue
+				}
+				dest := rewriteURL(link.URL, newSrc, newTarget)
+				newRaw = strings.Replace(link.Raw, "]("+link.URL, "]("+dest, 1)
+			} else {
+				if link.Target == "" {
+					continue
+				}
+				target, ok := x.wikiTarget(link.Target, src, movedFiles)
+				if !ok {
+					continue
+				}
+				newTarget, moved := plan.MapPath(target)
+				if !moved {
+					continue
+				}
+				newRaw = strings.Replace(link.Raw, "[["+link.Target, "[["+rewriteWikiTarget(link.Target, newTarget), 1)
+			}
+			if newRaw != link.Raw {
+				reps = append(reps, Replacement{Old: link.Raw, New: newRaw})
+			}
+		}
+	}
+	// Longer links first so a link is never rewritten inside a longer one.
+	sort.Slice(reps, func(i, j int) bool { return len(reps[i].Old) > len(reps[j].Old) })
+	return reps, nil
+}
+
+// wikiTarget returns the vault path a wikilink target resolves to.
+func (x *Indexer) wikiTarget(target, src string, movedFiles []string) (string, bool) {
+	ext := path.Ext(target)
+	if ext == "" || isMarkdown(target) {
+		id, ok := resolveDocument(x.db, target, src)
+		if !ok {
+			return "", false
+		}
+		var p string
+		if err := x.db.QueryRow("SELECT path FROM blocks WHERE id = ?", id).Scan(&p); err != nil {
+			return "", false
+		}
+		return p, true
+	}
+	// Attachment: match by name, or by path suffix when the target has one.
+	want := strings.ToLower("/" + strings.TrimPrefix(target, "/"))
+	for _, f := range movedFiles {
+		lower := strings.ToLower(f)
+		if lower == want || strings.HasSuffix(lower, want) {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// rewriteWikiTarget keeps the style of the original target: a bare name stays
+// a bare name, a path becomes the new vault path, and an explicit extension
+// is kept.
+func rewriteWikiTarget(old, newPath string) string {
+	p := strings.TrimPrefix(newPath, "/")
+	if isMarkdown(p) && !isMarkdown(old) {
+		p = strings.TrimSuffix(p, path.Ext(p))
+	}
+	if !strings.Contains(old, "/") {
+		p = path.Base(p)
+	}
+	return p
+}
+
+// rewriteURL builds a markdown link destination from the note at src to
+// target, keeping the fragment, encoding and <> style of the original.
+func rewriteURL(old, src, target string) string {
+	angle := strings.HasPrefix(old, "<")
+	raw := strings.TrimSuffix(strings.TrimPrefix(old, "<"), ">")
+	fragment := ""
+	if i := strings.Index(raw, "#"); i >= 0 {
+		raw, fragment = raw[:i], raw[i:]
+	}
+
+	var dest string
+	if strings.HasPrefix(raw, "/") {
+		dest = target
+	} else if rel, err := filepath.Rel(filepath.FromSlash(path.Dir(src)), filepath.FromSlash(target)); err == nil {
+		dest = filepath.ToSlash(rel)
+	} else {
+		dest = target
+	}
+
+	switch {
+	case angle:
+		return "<" + dest + fragment + ">"
+	case strings.Contains(raw, "%") || strings.Contains(dest, " "):
+		segments := strings.Split(dest, "/")
+		for i, seg := range segments {
+			segments[i] = url.PathEscape(seg)
+		}
+		return strings.Join(segments, "/") + fragment
+	default:
+		return dest + fragment
+	}
+}
+
+// Apply rewrites the links listed in the plan. It must run after the move;
+// read and write receive each note's new path. It returns the paths of the
+// notes that changed.
+func (p *MovePlan) Apply(read func(rel string) (string, error), write func(rel, content string) error) ([]string, error) {
+	srcs := make([]string, 0, len(p.Files))
+	for src := range p.Files {
+		srcs = append(srcs, src)
+	}
+	sort.Strings(srcs)
+
+	rewritten := []string{}
+	for _, src := range srcs {
+		rel, _ := p.MapPath(src)
+		content, err := read(rel)
+		if err != nil {
+			return rewritten, err
+		}
+		updated := ReplaceLinks(content, p.Files[src])
+		if updated == content {
+			continue
+		}
+		if err := write(rel, updated); err != nil {
+			return rewritten, err
+		}
+		rewritten = append(rewritten, rel)
+	}
+	return rewritten, nil
+}
+
+// ReplaceLinks applies link replacements to markdown source, leaving fenced
+// code blocks and inline code untouched.
+func ReplaceLinks(content string, reps []Replacement) string {
+	if len(reps) == 0 {
+		return content
+	}
+	pairs := make([]string, 0, len(reps)*2)
+	for _, r := range reps {
+		pairs = append(pairs, r.Old, r.New)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	lines := strings.Split(content, "\n")
+	fence := ""
+	for i, line := range lines {
+		if m := fenceRe.FindStringSubmatch(line); m != nil {
+			switch {
+			case fence == "":
+				fence = m[1]
+				continue
+			case strings.HasPrefix(strings.TrimSpace(line), fence) && strings.TrimSpace(m[2]) == "":
+				fence = ""
+				continue
+			}
+		}
+		if fence != "" {
+			continue
+		}
+		lines[i] = replaceOutsideInlineCode(line, replacer)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func replaceOutsideInlineCode(line string, replacer *strings.Replacer) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range inlineCodeRe.FindAllStringIndex(line, -1) {
+		b.WriteString(replacer.Replace(line[last:loc[0]]))
+		b.WriteString(line[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	b.WriteString(replacer.Replace(line[last:]))
+	return b.String()
+}
@@ -0,0 +1,133 @@
+package blocks
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// move plans a move, renames on disk and in the index and applies the
+// plan, the way the /move handler does. It returns the rewritten notes.
+func move(t *testing.T, x *Indexer, from, to string) []string {
+	t.Helper()
+	plan, err := x.PlanMove(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs := func(rel string) string { return filepath.Join(x.root, filepath.FromSlash(rel)) }
+	if err := os.MkdirAll(filepath.Dir(abs(to)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(abs(from), abs(to)); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.Rename(from, to); err != nil {
+		t.Fatal(err)
+	}
+	rewritten, err := plan.Apply(func(rel string) (string, error) {
+		b, err := os.ReadFile(abs(rel))
+		return string(b), err
+	}, func(rel, content string) error {
+		writeNote(t, x, rel, content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(rewritten)
+	return rewritten
+}
+
+func readNote(t *testing.T, x *Indexer, rel string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(x.root, filepath.FromSlash(rel)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMoveFolder(t *testing.T) {
+	x := testIndexer(t)
+	if err := os.MkdirAll(filepath.Join(x.root, "docs", "img"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(x.root, "docs", "img", "pic.png"), []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	writeNote(t, x, "/docs/A.md", "# H\n\nText ^blk\n\n[up](../Index.md) [[Index]] ![p](img/pic.png)")
+	writeNote(t, x, "/Index.md", "[[A]] [[docs/A]] [[docs/A.md#H]] [[A#^blk]]\n\n"+
+		"![[pic.png]] ![[img/pic.png]] [rel](docs/A.md#^blk) [abs](/docs/A.md)\n\n"+
+		"Code: `[[docs/A]]` and `[x](docs/A.md)`\n\n"+
+		"```\n[[docs/A]] [x](docs/A.md)\n```\n\n"+
+		"[[Elsewhere]] [web](https://example.com/docs/A.md)")
+	writeNote(t, x, "/Elsewhere.md", "Not moved")
+
+	if got, want := move(t, x, "/docs", "/archive/docs"), []string{"/Index.md", "/archive/docs/A.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("rewritten %q, want %q", got, want)
+	}
+
+	wantIndex := "[[A]] [[archive/docs/A]] [[archive/docs/A.md#H]] [[A#^blk]]\n\n" +
+		"![[pic.png]] ![[archive/docs/img/pic.png]] [rel](archive/docs/A.md#^blk) [abs](/archive/docs/A.md)\n\n" +
+		"Code: `[[docs/A]]` and `[x](docs/A.md)`\n\n" +
+		"```\n[[docs/A]] [x](docs/A.md)\n```\n\n" +
+		"[[Elsewhere]] [web](https://example.com/docs/A.md)"
+	if got := readNote(t, x, "/Index.md"); got != wantIndex {
+		t.Errorf("Index.md:\n%s\nwant:\n%s", got, wantIndex)
+	}
+	// Relative links inside the moved note follow it; links between moved
+	// files stay as they are
+	wantA := "# H\n\nText ^blk\n\n[up](../../Index.md) [[Index]] ![p](img/pic.png)"
+	if got := readNote(t, x, "/archive/docs/A.md"); got != wantA {
+		t.Errorf("A.md:\n%s\nwant:\n%s", got, wantA)
+	}
+
+	// The links resolve at the new location
+	back, err := x.Backlinks("/archive/docs/A.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 6 {
+		t.Errorf("%d backlinks after the move, want 6", len(back))
+	}
+}
+
+func TestMoveNote(t *testing.T) {
+	x := testIndexer(t)
+	writeNote(t, x, "/My Note.md", "Para ^id")
+	writeNote(t, x, "/dir/Links.md", "[[My Note]] [[My Note#^id|alias]] ![[My Note.md]]\n\n"+
+		"[enc](../My%20Note.md#^id) [angle](<../My Note.md>) ((not-an-id))")
+
+	if got := move(t, x, "/My Note.md", "/dir/New Note.md"); !reflect.DeepEqual(got, []string{"/dir/Links.md"}) {
+		t.Errorf("rewritten %q", got)
+	}
+	want := "[[New Note]] [[New Note#^id|alias]] ![[New Note.md]]\n\n" +
+		"[enc](New%20Note.md#^id) [angle](<New Note.md>) ((not-an-id))"
+	if got := readNote(t, x, "/dir/Links.md"); got != want {
+		t.Errorf("Links.md:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Moving the linking note rewrites its relative links only
+	if got := move(t, x, "/dir/Links.md", "/Links.md"); !reflect.DeepEqual(got, []string{"/Links.md"}) {
+		t.Errorf("rewritten %q", got)
+	}
+	want = "[[New Note]] [[New Note#^id|alias]] ![[New Note.md]]\n\n" +
+		"[enc](dir/New%20Note.md#^id) [angle](<dir/New Note.md>) ((not-an-id))"
+	if got := readNote(t, x, "/Links.md"); got != want {
+		t.Errorf("Links.md after its own move:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReplaceLinks(t *testing.T) {
+	reps := []Replacement{{Old: "[[A]]", New: "[[B]]"}, {Old: "[[A|x]]", New: "[[B|x]]"}}
+	content := "[[A]] `[[A]]` [[A|x]]\n~~~\n[[A]]\n```\n[[A]]\n~~~\n[[A]]"
+	want := "[[B]] `[[A]]` [[B|x]]\n~~~\n[[A]]\n```\n[[A]]\n~~~\n[[B]]"
+	if got := ReplaceLinks(content, reps); got != want {
+		t.Errorf("ReplaceLinks:\n%s\nwant:\n%s", got, want)
+	}
+	if got := ReplaceLinks(content, nil); got != content {
+		t.Errorf("no replacements changed the content")
+	}
+}
@@ -0,0 +1,526 @@
+package blocks
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"obsidianfs/internal/database"
+)
+
+// Node is a single markdown block produced by Parse. Container blocks
+// (lists, list items, blockquotes) carry their parsed content in Children.
+type Node struct {
+	Type     string
+	SubType  string
+	Content  string // plain text used for display and search
+	Markdown string // raw markdown source of the block
+	Anchor   string // Obsidian "^id" block anchor, if any
+	IALID    string // SiYuan-style {: id="..."} attribute, if any
+	Children []*Node
+}
+
+var (
+	headingRe   = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?[ \t]*$`)
+	closingHash = regexp.MustCompile(`[ \t]+#+$`)
+	fenceRe     = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})(.*)$")
+	hrRe        = regexp.MustCompile(`^ {0,3}((?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	setextRe    = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	listItemRe  = regexp.MustCompile(`^( *)([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	taskRe      = regexp.MustCompile(`^\[[ xX]\][ \t]`)
+	tableDelim  = regexp.MustCompile(`^ *\|? *:?-+:? *(\| *:?-+:? *)*\|? *$`)
+	ialRe       = regexp.MustCompile(`^\{:\s*(.*)\}\s*$`)
+	ialIDRe     = regexp.MustCompile(`\bid="([^"]+)"`)
+	anchorRe    = regexp.MustCompile(`(?:^|[ \t])\^([A-Za-z0-9-]+)[ \t]*$`)
+
+	imageRe     = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	linkRe      = regexp.MustCompile(`\[([^\]]*)\]\([^)]*\)`)
+	aliasLinkRe = regexp.MustCompile(`!?\[\[[^\]|]*\|([^\]]*)\]\]`)
+	wikiLinkRe  = regexp.MustCompile(`!?\[\[([^\]]*)\]\]`)
+	emphasisRe  = regexp.MustCompile(`\*\*|__|~~|==|\*|` + "`")
+)
+
+// Parse splits markdown source into a block tree. A leading YAML
+// frontmatter section is skipped; it is not part of any block.
+func Parse(src string) []*Node {
+	src = strings.ReplaceAll(src, "\r\n", "\n")
+	lines := strings.Split(src, "\n")
+	lines = skipFrontmatter(lines)
+	return parseLines(lines)
+}
+
+func skipFrontmatter(lines []string) []string {
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return lines
+	}
+	for i := 1; i < len(lines); i++ {
+		if t := strings.TrimSpace(lines[i]); t == "---" || t == "..." {
+			return lines[i+1:]
+		}
+	}
+	return lines
+}
+
+func isBlank(line string) bool { return strings.TrimSpace(line) == "" }
+
+func indentOf(line string) int {
+	n := 0
+	for _, r := range line {
+		switch r {
+		case ' ':
+			n++
+		case '\t':
+			n += 4 - n%4
+		default:
+			return n
+		}
+	}
+	return n
+}
+
+func parseLines(lines []string) []*Node {
+	var nodes []*Node
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+
+		case ialRe.MatchString(strings.TrimSpace(line)):
+			// Kramdown IAL after a block: {: id="20240101120000-abcdefg"}
+			if len(nodes) > 0 {
+				if m := ialIDRe.FindStringSubmatch(line); m != nil {
+					nodes[len(nodes)-1].IALID = m[1]
+				}
+			}
+			i++
+
+		case fenceRe.MatchString(line):
+			node, next := parseFence(lines, i)
+			nodes = append(nodes, node)
+			i = next
+
+		case strings.TrimSpace(line) == "$$":
+			node, next := parseMath(lines, i)
+			nodes = append(nodes, node)
+			i = next
+
+		case headingRe.MatchString(line):
+			nodes = append(nodes, headingNode(line))
+			i++
+
+		case hrRe.MatchString(line):
+			nodes = append(nodes, &Node{Type: database.NodeThematicBreak, Markdown: line})
+			i++
+
+		case isQuote(line):
+			node, next := parseQuote(lines, i)
+			nodes = append(nodes, node)
+			i = next
+
+		case listItemRe.MatchString(line):
+			node, next := parseList(lines, i)
+			nodes = append(nodes, node)
+			i = next
+
+		case isTableStart(lines, i):
+			node, next := parseTable(lines, i)
+			nodes = append(nodes, node)
+			i = next
+
+		case indentOf(line) >= 4:
+			node, next := parseIndentedCode(lines, i)
+			nodes = append(nodes, node)
+			i = next
+
+		default:
+			node, next := parseParagraph(lines, i)
+			// A paragraph that is only "^id" anchors the block before it.
+			if m := anchorRe.FindStringSubmatch(node.Markdown); m != nil && strings.TrimSpace(node.Markdown) == "^"+m[1] {
+				if len(nodes) > 0 {
+					nodes[len(nodes)-1].Anchor = m[1]
+				}
+				i = next
+				continue
+			}
+			nodes = append(nodes, node)
+			i = next
+		}
+	}
+	return nodes
+}
+
+func parseFence(lines []string, start int) (*Node, int) {
+	m := fenceRe.FindStringSubmatch(lines[start])
+	fence := m[1]
+	info := strings.TrimSpace(m[2])
+	end := len(lines)
+	for j := start + 1; j < len(lines); j++ {
+		t := strings.TrimSpace(lines[j])
+		if strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+			end = j
+			break
+		}
+	}
+	code := strings.Join(lines[start+1:min(end, len(lines))], "\n")
+	next := end + 1
+	if next > len(lines) {
+		next = len(lines)
+	}
+	lang := strings.Fields(info)
+	subType := ""
+	if len(lang) > 0 {
+		subType = lang[0]
+	}
+	return &Node{
+		Type:     database.NodeCodeBlock,
+		SubType:  subType,
+		Content:  code,
+		Markdown: strings.Join(lines[start:next], "\n"),
+	}, next
+}
+
+func parseMath(lines []string, start int) (*Node, int) {
+	end := len(lines)
+	for j := start + 1; j < len(lines); j++ {
+		if strings.TrimSpace(lines[j]) == "$$" {
+			end = j
+			break
+		}
+	}
+	next := end + 1
+	if next > len(lines) {
+		next = len(lines)
+	}
+	return &Node{
+		Type:     database.NodeMathBlock,
+		Content:  strings.Join(lines[start+1:min(end, len(lines))], "\n"),
+		Markdown: strings.Join(lines[start:next], "\n"),
+	}, next
+}
+
+func headingNode(line string) *Node {
+	m := headingRe.FindStringSubmatch(line)
+	text := closingHash.ReplaceAllString(m[2], "")
+	node := &Node{
+		Type:     database.NodeHeading,
+		SubType:  "h" + strconv.Itoa(len(m[1])),
+		Markdown: line,
+	}
+	node.Content, node.Anchor = splitAnchor(text)
+	node.Content = PlainText(node.Content)
+	return node
+}
+
+func isQuote(line string) bool {
+	return indentOf(line) < 4 && strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+func parseQuote(lines []string, start int) (*Node, int) {
+	var inner []string
+	i := start
+	for ; i < len(lines) && isQuote(lines[i]); i++ {
+		t := strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">")
+		inner = append(inner, strings.TrimPrefix(t, " "))
+	}
+	children := parseLines(inner)
+	node := &Node{
+		Type:     database.NodeBlockquote,
+		Markdown: strings.Join(lines[start:i], "\n"),
+		Children: children,
+	}
+	// Obsidian callouts: > [!note] Title
+	if len(inner) > 0 {
+		if t := strings.TrimSpace(inner[0]); strings.HasPrefix(t, "[!") {
+			if end := strings.Index(t, "]"); end > 2 {
+				node.SubType = strings.ToLower(t[2:end])
+			}
+		}
+	}
+	node.Content = joinContent(children)
+	return node, i
+}
+
+type listMarker struct {
+	indent  int // columns before the marker
+	content int // columns before the item content
+	ordered bool
+}
+
+func matchListItem(line string) (listMarker, bool) {
+	m := listItemRe.FindStringSubmatch(line)
+	if m == nil {
+		return listMarker{}, false
+	}
+	ordered := m[2][0] >= '0' && m[2][0] <= '9'
+	content := len(m[1]) + len(m[2]) + len(m[3])
+	if m[3] == "" || len(m[3]) > 4 {
+		content = len(m[1]) + len(m[2]) + 1
+	}
+	return listMarker{indent: len(m[1]), content: content, ordered: ordered}, true
+}
+
+func parseList(lines []string, start int) (*Node, int) {
+	first, _ := matchListItem(lines[start])
+	list := &Node{Type: database.NodeList, SubType: "u"}
+	if first.ordered {
+		list.SubType = "o"
+	}
+
+	var items [][]string
+	var current []string
+	var marker listMarker
+	i := start
+	for i < len(lines) {
+		line := lines[i]
+		if isBlank(line) {
+			// A blank line continues the list only if the next content line
+			// belongs to it (indented continuation or a sibling item).
+			j := i + 1
+			for j < len(lines) && isBlank(lines[j]) {
+				j++
+			}
+			if j >= len(lines) {
+				break
+			}
+			if m, ok := matchListItem(lines[j]); ok && m.indent < first.indent+2 && m.ordered == first.ordered {
+				current = append(current, lines[i:j]...)
+				i = j
+				continue
+			}
+			if current != nil && indentOf(lines[j]) >= marker.content {
+				current = append(current, lines[i:j]...)
+				i = j
+				continue
+			}
+			break
+		}
+		if m, ok := matchListItem(line); ok && m.indent < first.indent+2 {
+			if m.ordered != first.ordered {
+				break
+			}
+			if current != nil {
+				items = append(items, current)
+			}
+			marker = m
+			current = []string{line}
+			i++
+			continue
+		}
+		if current == nil {
+			break
+		}
+		// Continuation lines: indented content, or a lazy paragraph line.
+		if indentOf(line) < marker.content && startsBlock(line) {
+			break
+		}
+		current = append(current, line)
+		i++
+	}
+	if current != nil {
+		items = append(items, current)
+	}
+
+	end := i
+	for end > start && isBlank(lines[end-1]) {
+		end--
+	}
+	list.Markdown = strings.Join(lines[start:end], "\n")
+
+	for _, itemLines := range items {
+		item := listItemNode(itemLines)
+		if item.SubType == "t" {
+			list.SubType = "t"
+		}
+		list.Children = append(list.Children, item)
+	}
+	for _, item := range list.Children {
+		if list.SubType != "t" {
+			item.SubType = list.SubType
+		}
+	}
+	list.Content = joinContent(list.Children)
+	return list, i
+}
+
+func listItemNode(itemLines []string) *Node {
+	m, _ := matchListItem(itemLines[0])
+	first := itemLines[0]
+	if len(first) > m.content {
+		first = first[m.content:]
+	} else {
+		first = ""
+	}
+	item := &Node{Type: database.NodeListItem}
+	if taskRe.MatchString(first) {
+		item.SubType = "t"
+		first = first[4:]
+	}
+	inner := []string{first}
+	for _, l := range itemLines[1:] {
+		inner = append(inner, dedent(l, m.content))
+	}
+	for len(inner) > 0 && isBlank(inner[len(inner)-1]) {
+		inner = inner[:len(inner)-1]
+	}
+	markdown := itemLines
+	for len(markdown) > 0 && isBlank(markdown[len(markdown)-1]) {
+		markdown = markdown[:len(markdown)-1]
+	}
+	item.Markdown = strings.Join(markdown, "\n")
+	item.Children = parseLines(inner)
+	if len(item.Children) > 0 && item.Children[0].Anchor != "" {
+		item.Anchor = item.Children[0].Anchor
+	}
+	item.Content = joinContent(item.Children)
+	return item
+}
+
+// dedent removes up to n columns of leading whitespace.
+func dedent(line string, n int) string {
+	col := 0
+	for i, r := range line {
+		if col >= n {
+			return line[i:]
+		}
+		switch r {
+		case ' ':
+			col++
+		case '\t':
+			col += 4 - col%4
+		default:
+			return line[i:]
+		}
+	}
+	return ""
+}
+
+// startsBlock reports whether line opens a block that interrupts a paragraph.
+func startsBlock(line string) bool {
+	return fenceRe.MatchString(line) ||
+		headingRe.MatchString(line) ||
+		hrRe.MatchString(line) ||
+		isQuote(line) ||
+		listItemRe.MatchString(line) ||
+		strings.TrimSpace(line) == "$$"
+}
+
+func isTableStart(lines []string, i int) bool {
+	return i+1 < len(lines) &&
+		strings.Contains(lines[i], "|") &&
+		strings.Contains(lines[i+1], "-") &&
+		tableDelim.MatchString(lines[i+1])
+}
+
+func parseTable(lines []string, start int) (*Node, int) {
+	i := start + 2
+	for i < len(lines) && !isBlank(lines[i]) && strings.Contains(lines[i], "|") {
+		i++
+	}
+	var cells []string
+	for j, row := range lines[start:i] {
+		if j == 1 {
+			continue
+		}
+		for _, cell := range strings.Split(strings.Trim(strings.TrimSpace(row), "|"), "|") {
+			if c := strings.TrimSpace(cell); c != "" {
+				cells = append(cells, PlainText(c))
+			}
+		}
+	}
+	return &Node{
+		Type:     database.NodeTable,
+		Content:  strings.Join(cells, " "),
+		Markdown: strings.Join(lines[start:i], "\n"),
+	}, i
+}
+
+func parseIndentedCode(lines []string, start int) (*Node, int) {
+	i := start
+	for i < len(lines) && (indentOf(lines[i]) >= 4 || isBlank(lines[i])) {
+		i++
+	}
+	for i > start && isBlank(lines[i-1]) {
+		i--
+	}
+	var code []string
+	for _, l := range lines[start:i] {
+		code = append(code, dedent(l, 4))
+	}
+	return &Node{
+		Type:     database.NodeCodeBlock,
+		Content:  strings.Join(code, "\n"),
+		Markdown: strings.Join(lines[start:i], "\n"),
+	}, i
+}
+
+func parseParagraph(lines []string, start int) (*Node, int) {
+	i := start + 1
+	for i < len(lines) && !isBlank(lines[i]) {
+		if setextRe.MatchString(lines[i]) {
+			// Setext heading: the paragraph so far becomes the heading text.
+			level := 1
+			if strings.Contains(lines[i], "-") {
+				level = 2
+			}
+			text := strings.Join(trimAll(lines[start:i]), " ")
+			node := &Node{
+				Type:     database.NodeHeading,
+				SubType:  "h" + strconv.Itoa(level),
+				Markdown: strings.Join(lines[start:i+1], "\n"),
+			}
+			node.Content, node.Anchor = splitAnchor(text)
+			node.Content = PlainText(node.Content)
+			return node, i + 1
+		}
+		if startsBlock(lines[i]) || ialRe.MatchString(strings.TrimSpace(lines[i])) {
+			break
+		}
+		i++
+	}
+	markdown := strings.Join(lines[start:i], "\n")
+	text, anchor := splitAnchor(strings.Join(trimAll(lines[start:i]), "\n"))
+	return &Node{
+		Type:     database.NodeParagraph,
+		Content:  PlainText(text),
+		Markdown: markdown,
+		Anchor:   anchor,
+	}, i
+}
+
+func trimAll(lines []string) []string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = strings.TrimSpace(l)
+	}
+	return out
+}
+
+// splitAnchor removes a trailing Obsidian "^id" block anchor from text.
+func splitAnchor(text string) (string, string) {
+	loc := anchorRe.FindStringSubmatchIndex(text)
+	if loc == nil {
+		return text, ""
+	}
+	return strings.TrimRight(text[:loc[0]], " \t"), text[loc[2]:loc[3]]
+}
+
+func joinContent(nodes []*Node) string {
+	parts := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		if n.Content != "" {
+			parts = append(parts, n.Content)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// PlainText strips inline markdown syntax, keeping the visible text.
+func PlainText(md string) string {
+	s := imageRe.ReplaceAllString(md, "$1")
+	s = linkRe.ReplaceAllString(s, "$1")
+	s = aliasLinkRe.ReplaceAllString(s, "$1")
+	s = wikiLinkRe.ReplaceAllString(s, "$1")
+	s = emphasisRe.ReplaceAllString(s, "")
+	return strings.TrimSpace(s)
+}
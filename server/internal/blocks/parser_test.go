@@ -0,0 +1,163 @@
+package blocks
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// outline renders a block tree one block per line: type, subtype, content,
+// then the ^anchor and {: id} when set, children indented below.
+func outline(nodes []*Node) string {
+	var b strings.Builder
+	var walk func(nodes []*Node, depth int)
+	walk = func(nodes []*Node, depth int) {
+		for _, n := range nodes {
+			fmt.Fprintf(&b, "%s%s", strings.Repeat("  ", depth), strings.TrimPrefix(n.Type, "Node"))
+			if n.SubType != "" {
+				fmt.Fprintf(&b, " %s", n.SubType)
+			}
+			fmt.Fprintf(&b, " %q", n.Content)
+			if n.Anchor != "" {
+				fmt.Fprintf(&b, " ^%s", n.Anchor)
+			}
+			if n.IALID != "" {
+				fmt.Fprintf(&b, " id=%s", n.IALID)
+			}
+			b.WriteString("\n")
+			walk(n.Children, depth+1)
+		}
+	}
+	walk(nodes, 0)
+	return b.String()
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"frontmatter is skipped", "---\ntitle: x\n---\nText", `Paragraph "Text"` + "\n"},
+		{"unclosed frontmatter is text", "---\ntitle: x", "ThematicBreak \"\"\nParagraph \"title: x\"\n"},
+		{
+			"headings",
+			"# One\n## Two ##\n###### Six\n####### Seven\n#NoSpace",
+			`Heading h1 "One"
+Heading h2 "Two"
+Heading h6 "Six"
+Paragraph "####### Seven\n#NoSpace"
+`,
+		},
+		{"setext headings", "Title\n=====\n\nSub\n---", "Heading h1 \"Title\"\nHeading h2 \"Sub\"\n"},
+		{"inline markup", "Some **bold** [link](http://x) [[Note|alias]] [[Other]] `code`", `Paragraph "Some bold link alias Other code"` + "\n"},
+		{"crlf", "a\r\nb\r\n\r\nc", "Paragraph \"a\\nb\"\nParagraph \"c\"\n"},
+		{
+			"bullet list",
+			"- one\n- two\n  continued\n\n- three",
+			`List u "one\ntwo\ncontinued\nthree"
+  ListItem u "one"
+    Paragraph "one"
+  ListItem u "two\ncontinued"
+    Paragraph "two\ncontinued"
+  ListItem u "three"
+    Paragraph "three"
+`,
+		},
+		{
+			"nested and ordered lists",
+			"1. first\n   - inner\n2. second\n\n- other list",
+			`List o "first\ninner\nsecond"
+  ListItem o "first\ninner"
+    Paragraph "first"
+    List u "inner"
+      ListItem u "inner"
+        Paragraph "inner"
+  ListItem o "second"
+    Paragraph "second"
+List u "other list"
+  ListItem u "other list"
+    Paragraph "other list"
+`,
+		},
+		{
+			"task list",
+			"- [ ] todo\n- [x] done\n- plain",
+			`List t "todo\ndone\nplain"
+  ListItem t "todo"
+    Paragraph "todo"
+  ListItem t "done"
+    Paragraph "done"
+  ListItem "plain"
+    Paragraph "plain"
+`,
+		},
+		{
+			"code fences",
+			"```go run\n# not a heading\n- not a list\n```\n~~~~\n```\nstill code\n~~~~\nafter",
+			`CodeBlock go "# not a heading\n- not a list"
+CodeBlock "` + "```" + `\nstill code"
+Paragraph "after"
+`,
+		},
+		{"unclosed fence runs to the end", "```\ncode\n\nmore", "CodeBlock \"code\\n\\nmore\"\n"},
+		{"indented code", "    x := 1\n\n    y := 2\n\ntext", "CodeBlock \"x := 1\\n\\ny := 2\"\nParagraph \"text\"\n"},
+		{"math", "$$\na^2\n$$", "MathBlock \"a^2\"\n"},
+		{"table", "| a | b |\n|---|:-:|\n| 1 | **2** |\nafter", "Table \"a b 1 2\"\nParagraph \"after\"\n"},
+		{"thematic break", "a\n\n***\n\nb", "Paragraph \"a\"\nThematicBreak \"\"\nParagraph \"b\"\n"},
+		{
+			"quote and callout",
+			"> [!NOTE] Title\n> body\n\n> # Quoted\n> text",
+			`Blockquote note "[!NOTE] Title\nbody"
+  Paragraph "[!NOTE] Title\nbody"
+Blockquote "Quoted\ntext"
+  Heading h1 "Quoted"
+  Paragraph "text"
+`,
+		},
+		{
+			"block anchors",
+			"Paragraph text ^para-1\n\n## Heading ^h1\n\n- item ^li\n\n| a |\n|---|\n\n^table\n\nnot^anchor",
+			`Paragraph "Paragraph text" ^para-1
+Heading h2 "Heading" ^h1
+List u "item"
+  ListItem u "item" ^li
+    Paragraph "item" ^li
+Table "a" ^table
+Paragraph "not^anchor"
+`,
+		},
+		{
+			"kramdown ids",
+			"Text\n{: id=\"20240101120000-abcdefg\"}\n\n# H\n{: id=\"20240101120000-hijklmn\" style=\"x\"}\n\n{: id=\"not-an-id\"} text",
+			`Paragraph "Text" id=20240101120000-abcdefg
+Heading h1 "H" id=20240101120000-hijklmn
+Paragraph "{: id=\"not-an-id\"} text"
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outline(Parse(tt.src)); got != tt.want {
+				t.Errorf("Parse(%q):\n%s\nwant:\n%s", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkdown(t *testing.T) {
+	src := "# Title\n\n- a\n  - b\n\n\nText\nmore\n"
+	nodes := Parse(src)
+	var got []string
+	for _, n := range nodes {
+		got = append(got, n.Markdown)
+	}
+	want := []string{"# Title", "- a\n  - b", "Text\nmore"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("block markdown %q, want %q", got, want)
+	}
+	if item := nodes[1].Children[0]; item.Markdown != "- a\n  - b" || item.Children[1].Markdown != "- b" {
+		t.Errorf("list item markdown %q / %q", item.Markdown, item.Children[1].Markdown)
+	}
+}
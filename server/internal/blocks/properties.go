@@ -0,0 +1,235 @@
+package blocks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/frontmatter"
+)
+
+// storeProperties replaces the attributes of the document rootID with the
+// frontmatter properties in content and mirrors them in its IAL as
+// custom-<name>, the way SiYuan keeps document attributes.
+func storeProperties(tx *sql.Tx, rootID, title, content, now string) error {
+	var props []frontmatter.Property
+	if fm := frontmatter.Parse(content); fm != nil {
+		props = fm.Properties()
+	}
+	ial := map[string]string{"id": rootID, "title": title}
+	names := make([]any, 0, len(props)+1)
+	names = append(names, rootID)
+	for _, p := range props {
+		ial["custom-"+p.Name] = p.Value
+		names = append(names, p.Name)
+		_, err := tx.Exec(`INSERT INTO attributes (block_id, name, value, type, created, updated) VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(block_id, name) DO UPDATE SET value = excluded.value, type = excluded.type, updated = excluded.updated
+			WHERE value != excluded.value OR type != excluded.type`,
+			rootID, p.Name, p.Value, p.Type, now, now)
+		if err != nil {
+			return err
+		}
+	}
+	query := "DELETE FROM attributes WHERE block_id = ?"
+	if len(props) > 0 {
+		query += " AND name NOT IN (?" + strings.Repeat(", ?", len(props)-1) + ")"
+	}
+	if _, err := tx.Exec(query, names...); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(ial)
+	_, err := tx.Exec("UPDATE blocks SET ial = ? WHERE id = ?", string(b), rootID)
+	return err
+}
+
+// PropertyKey is a frontmatter property used in the vault, with the type
+// most files give it.
+type PropertyKey struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Count int    `json:"count"` // files
+}
+
+// PropertyValue is one value of a property; list items count one by one.
+type PropertyValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"` // files
+}
+
+// PropertyMatch is a file whose property matched a query.
+type PropertyMatch struct {
+	Path  string `json:"path"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// PropertyQuery selects files by a property. Value matches the value, or
+// any item of a list; Min and Max bound it, comparing numbers as numbers
+// and other values as strings. With neither every file that has the
+// property matches.
+type PropertyQuery struct {
+	Name  string
+	Value string
+	Min   string
+	Max   string
+}
+
+// property is an attribute row of a document.
+type property struct {
+	path, name, typ, value string
+}
+
+// properties returns the properties of the documents keep accepts (nil
+// accepts all), only those named name unless it is empty.
+func (x *Indexer) properties(name string, keep func(relPath string) bool) ([]property, error) {
+	query := `SELECT b.path, a.name, a.type, a.value FROM attributes a JOIN blocks b ON b.id = a.block_id
+		WHERE b.type = ?`
+	args := []any{database.NodeDocument}
+	if name != "" {
+		query += " AND a.name = ?"
+		args = append(args, name)
+	}
+	rows, err := x.db.Query(query+" ORDER BY b.path", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []property
+	for rows.Next() {
+		var p property
+		if err := rows.Scan(&p.path, &p.name, &p.typ, &p.value); err != nil {
+			return nil, err
+		}
+		if keep == nil || keep(p.path) {
+			out = append(out, p)
+		}
+	}
+	return out, rows.Err()
+}
+
+// values returns the value of p, or its items for a list.
+func (p property) values() []string {
+	if p.typ != frontmatter.TypeList {
+		return []string{p.value}
+	}
+	var items []string
+	_ = json.Unmarshal([]byte(p.value), &items)
+	return items
+}
+
+// PropertyKeys lists the properties of the documents keep accepts, most
+// used first.
+func (x *Indexer) PropertyKeys(keep func(relPath string) bool) ([]PropertyKey, error) {
+	props, err := x.properties("", keep)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]map[string]int)
+	for _, p := range props {
+		if types[p.name] == nil {
+			types[p.name] = make(map[string]int)
+		}
+		types[p.name][p.typ]++
+	}
+	out := make([]PropertyKey, 0, len(types))
+	for name, counts := range types {
+		k := PropertyKey{Name: name}
+		best := 0
+		for typ, n := range counts {
+			k.Count += n
+			if n > best || (n == best && typ < k.Type) {
+				k.Type, best = typ, n
+			}
+		}
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Count > out[j].Count
+	})
+	return out, nil
+}
+
+// PropertyValues lists the values of a property in the documents keep
+// accepts, most used first.
+func (x *Indexer) PropertyValues(name string, keep func(relPath string) bool) ([]PropertyValue, error) {
+	props, err := x.properties(name, keep)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, p := range props {
+		seen := make(map[string]bool)
+		for _, v := range p.values() {
+			if v != "" && !seen[v] {
+				seen[v] = true
+				counts[v]++
+			}
+		}
+	}
+	out := make([]PropertyValue, 0, len(counts))
+	for v, n := range counts {
+		out = append(out, PropertyValue{Value: v, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count == out[j].Count {
+			return out[i].Value < out[j].Value
+		}
+		return out[i].Count > out[j].Count
+	})
+	return out, nil
+}
+
+// FilesWithProperty returns the documents keep accepts whose property
+// matches q, by path.
+func (x *Indexer) FilesWithProperty(q PropertyQuery, keep func(relPath string) bool) ([]PropertyMatch, error) {
+	props, err := x.properties(q.Name, keep)
+	if err != nil {
+		return nil, err
+	}
+	out := []PropertyMatch{}
+	for _, p := range props {
+		for _, v := range p.values() {
+			if q.matches(v) {
+				out = append(out, PropertyMatch{Path: p.path, Type: p.typ, Value: p.value})
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+func (q PropertyQuery) matches(v string) bool {
+	if q.Value != "" && v != q.Value {
+		return false
+	}
+	if q.Min != "" && compareValues(v, q.Min) < 0 {
+		return false
+	}
+	// A Max date includes the times of that day
+	if q.Max != "" && compareValues(v, q.Max) > 0 && !strings.HasPrefix(v, q.Max) {
+		return false
+	}
+	return true
+}
+
+// compareValues compares two numbers as numbers and anything else, such
+// as dates, as strings.
+func compareValues(a, b string) int {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	switch {
+	case errA != nil || errB != nil:
+		return strings.Compare(a, b)
+	case fa < fb:
+		return -1
+	case fa > fb:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package blocks
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"obsidianfs/internal/database"
+)
+
+// documentIAL returns the IAL of the document block of rel.
+func documentIAL(t *testing.T, x *Indexer, rel string) map[string]string {
+	t.Helper()
+	var raw string
+	if err := x.db.QueryRow("SELECT ial FROM blocks WHERE path = ? AND type = ?", rel, database.NodeDocument).Scan(&raw); err != nil {
+		t.Fatalf("document %s: %v", rel, err)
+	}
+	ial := map[string]string{}
+	if err := json.Unmarshal([]byte(raw), &ial); err != nil {
+		t.Fatal(err)
+	}
+	return ial
+}
+
+func matchedPaths(t *testing.T, x *Indexer, q PropertyQuery) []string {
+	t.Helper()
+	matches, err := x.FilesWithProperty(q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{}
+	for _, m := range matches {
+		paths = append(paths, m.Path)
+	}
+	return paths
+}
+
+func TestProperties(t *testing.T) {
+	x := testIndexer(t)
+	writeNote(t, x, "/a.md", "---\nstatus: done\ntags: [x, y]\ndue: 2024-01-02\nrank: 9\nmeta:\n  owner: me\n---\nA")
+	writeNote(t, x, "/b.md", "---\nstatus: open\ntags:\n  - y\n  - y\ndue: 2024-02-01T10:00:00\nrank: 10\n---\nB")
+	writeNote(t, x, "/c.md", "---\nstatus: [open\n---\nInvalid YAML")
+	writeNote(t, x, "/d.md", "No frontmatter\n\nstatus: open")
+
+	ial := documentIAL(t, x, "/a.md")
+	if ial["custom-status"] != "done" || ial["custom-tags"] != `["x","y"]` || ial["custom-meta"] != `{"owner":"me"}` || ial["title"] != "a" {
+		t.Errorf("IAL of /a.md: %v", ial)
+	}
+	for _, rel := range []string{"/c.md", "/d.md"} {
+		if ial := documentIAL(t, x, rel); len(ial) != 2 {
+			t.Errorf("IAL of %s: %v", rel, ial)
+		}
+	}
+
+	keys, err := x.PropertyKeys(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, k := range keys {
+		got = append(got, k.Name+" "+k.Type+" "+strings.Repeat("*", k.Count))
+	}
+	want := []string{"due date **", "rank number **", "status text **", "tags list **", "meta object *"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("keys %q, want %q", got, want)
+	}
+
+	// List items count once per file
+	values, err := x.PropertyValues("tags", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []PropertyValue{{"y", 2}, {"x", 1}}; !reflect.DeepEqual(values, want) {
+		t.Errorf("tags values %+v, want %+v", values, want)
+	}
+	if values, _ := x.PropertyValues("status", func(p string) bool { return p != "/a.md" }); !reflect.DeepEqual(values, []PropertyValue{{"open", 1}}) {
+		t.Errorf("status values for /b.md only: %+v", values)
+	}
+
+	tests := []struct {
+		q    PropertyQuery
+		want []string
+	}{
+		{PropertyQuery{Name: "status"}, []string{"/a.md", "/b.md"}},
+		{PropertyQuery{Name: "status", Value: "open"}, []string{"/b.md"}},
+		{PropertyQuery{Name: "tags", Value: "x"}, []string{"/a.md"}},
+		{PropertyQuery{Name: "rank", Min: "9.5"}, []string{"/b.md"}}, // 10 > 9.5 as numbers
+		{PropertyQuery{Name: "rank", Max: "9"}, []string{"/a.md"}},
+		{PropertyQuery{Name: "due", Min: "2024-01-15"}, []string{"/b.md"}},
+		{PropertyQuery{Name: "due", Max: "2024-02-01"}, []string{"/a.md", "/b.md"}}, // the whole day
+		{PropertyQuery{Name: "due", Max: "2024-01-31"}, []string{"/a.md"}},
+		{PropertyQuery{Name: "missing"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := matchedPaths(t, x, tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: %q, want %q", tt.q, got, tt.want)
+		}
+	}
+
+	// Reindexing drops removed properties and updates changed ones
+	writeNote(t, x, "/a.md", "---\nstatus: open\n---\nA")
+	ial = documentIAL(t, x, "/a.md")
+	if ial["custom-status"] != "open" || ial["custom-tags"] != "" {
+		t.Errorf("IAL after the edit: %v", ial)
+	}
+	if got := matchedPaths(t, x, PropertyQuery{Name: "tags", Value: "x"}); len(got) != 0 {
+		t.Errorf("removed property still matches %q", got)
+	}
+	writeNote(t, x, "/a.md", "A")
+	if got := matchedPaths(t, x, PropertyQuery{Name: "status"}); !reflect.DeepEqual(got, []string{"/b.md"}) {
+		t.Errorf("status after dropping the frontmatter: %q", got)
+	}
+}
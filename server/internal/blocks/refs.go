@@ -0,0 +1,388 @@
+package blocks
+
+import (
+	"database/sql"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/utils"
+)
+
+// Link is a reference found in markdown: a [[wikilink]], an ![[embed]], a
+// relative markdown link [text](path.md) or a SiYuan ((block-id)) reference.
+type Link struct {
+	Raw     string // the link as written
+	Target  string // note name or path; empty for same-note links like [[#Heading]]
+	Heading string // [[Note#Heading]]
+	Anchor  string // [[Note^id]] or [[Note#^id]]
+	BlockID string // ((20240101120000-abcdefg))
+	URL     string // destination of a markdown link as written, e.g. ../a%20b.md#Heading
+	Alias   string // [[Note|alias]], [text](url) or ((id "alias"))
+	Embed   bool
+}
+
+var (
+	wikiRe       = regexp.MustCompile(`(!?)\[\[([^\[\]]+)\]\]`)
+	mdLinkRe     = regexp.MustCompile(`(!?)\[([^\[\]]*)\]\((<[^<>]+>|[^()\s]+)(?:\s+"[^"]*")?\)`)
+	schemeRe     = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+	blockRefRe   = regexp.MustCompile(`\(\((\d{14}-[a-z0-9]{7})(?:\s+["']([^"']*)["'])?\)\)`)
+	inlineCodeRe = regexp.MustCompile("`+[^`]*`+")
+)
+
+// refSourceTypes are the blocks whose markdown holds inline text; links are
+// attributed to the innermost block containing them.
+var refSourceTypes = []string{database.NodeParagraph, database.NodeHeading, database.NodeTable}
+
+// ParseLinks returns the links in a block's markdown, ignoring inline code.
+func ParseLinks(markdown string) []Link {
+	text := inlineCodeRe.ReplaceAllStringFunc(markdown, func(s string) string {
+		return strings.Repeat(" ", len(s))
+	})
+	var links []Link
+	for _, m := range wikiRe.FindAllStringSubmatch(text, -1) {
+		link := Link{Raw: m[0], Embed: m[1] == "!"}
+		inner := m[2]
+		if i := strings.Index(inner, "|"); i >= 0 {
+			inner, link.Alias = inner[:i], strings.TrimSpace(inner[i+1:])
+		}
+		switch {
+		case strings.Contains(inner, "#^"):
+			i := strings.Index(inner, "#^")
+			inner, link.Anchor = inner[:i], inner[i+2:]
+		case strings.Contains(inner, "#"):
+			i := strings.Index(inner, "#")
+			heading := inner[i+1:]
+			// [[Note#H1#H2]] points at the last heading in the chain
+			if j := strings.LastIndex(heading, "#"); j >= 0 {
+				heading = heading[j+1:]
+			}
+			inner, link.Heading = inner[:i], strings.TrimSpace(heading)
+		case strings.Contains(inner, "^"):
+			i := strings.LastIndex(inner, "^")
+			inner, link.Anchor = inner[:i], inner[i+1:]
+		}
+		link.Target = strings.TrimSpace(inner)
+		links = append(links, link)
+	}
+	for _, m := range mdLinkRe.FindAllStringSubmatch(text, -1) {
+		dest := m[3]
+		if schemeRe.MatchString(dest) || strings.HasPrefix(dest, "#") {
+			continue
+		}
+		links = append(links, Link{Raw: m[0], URL: dest, Alias: m[2], Embed: m[1] == "!"})
+	}
+	for _, m := range blockRefRe.FindAllStringSubmatch(text, -1) {
+		links = append(links, Link{Raw: m[0], BlockID: m[1], Alias: m[2]})
+	}
+	return links
+}
+
+// splitURL decodes a markdown link destination into a path and fragment.
+func splitURL(dest string) (string, string) {
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	fragment := ""
+	if i := strings.Index(dest, "#"); i >= 0 {
+		dest, fragment = dest[:i], dest[i+1:]
+	}
+	if p, err := url.PathUnescape(dest); err == nil {
+		dest = p
+	}
+	if f, err := url.PathUnescape(fragment); err == nil {
+		fragment = f
+	}
+	return dest, fragment
+}
+
+// resolveURL returns the vault path a markdown link destination points to,
+// relative to the note at fromRel unless it starts with "/".
+func resolveURL(dest, fromRel string) (string, string) {
+	p, fragment := splitURL(dest)
+	if p == "" {
+		return fromRel, fragment
+	}
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p), fragment
+	}
+	return path.Join(path.Dir(fromRel), p), fragment
+}
+
+// querier is satisfied by both *database.DB and *sql.Tx.
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// relink rebuilds the refs originating from one document using the
+// markdown stored in the blocks table. Links whose target cannot be
+// resolved are skipped; they are picked up again when the target appears.
+func (x *Indexer) relink(rootID string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	tx, err := x.db.BeginTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var rel, box string
+	err = tx.QueryRow("SELECT path, box FROM blocks WHERE id = ? AND type = ?", rootID, database.NodeDocument).Scan(&rel, &box)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM refs WHERE root_id = ?", rootID); err != nil {
+		return err
+	}
+
+	type source struct{ id, markdown string }
+	var sources []source
+	rows, err := tx.Query(`SELECT id, markdown FROM blocks WHERE root_id = ? AND type IN (?, ?, ?) ORDER BY rowid`,
+		rootID, refSourceTypes[0], refSourceTypes[1], refSourceTypes[2])
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var s source
+		if err := rows.Scan(&s.id, &s.markdown); err == nil {
+			sources = append(sources, s)
+		}
+	}
+	rows.Close()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, s := range sources {
+		for _, link := range ParseLinks(s.markdown) {
+			def, ok := resolveLink(tx, link, rootID, rel)
+			if !ok {
+				continue
+			}
+			refType := database.RefTypeRef
+			if link.Embed {
+				refType = database.RefTypeEmbed
+			}
+			content := link.Alias
+			if content == "" {
+				content = def.content
+			}
+			_, err := tx.Exec(`INSERT INTO refs (id, def_block_id, def_block_path, def_block_content, def_block_subtype,
+				block_id, root_id, box, path, content, markdown, type, created, updated)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				utils.GenerateRefID(), def.id, def.path, def.content, def.subType,
+				s.id, rootID, box, rel, content, link.Raw, refType, now, now)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+type defBlock struct {
+	id, path, content, subType string
+}
+
+// resolveLink finds the block a link points to.
+func resolveLink(tx querier, link Link, fromRoot, fromRel string) (defBlock, bool) {
+	var def defBlock
+	if link.BlockID != "" {
+		err := tx.QueryRow("SELECT id, path, content, subtype FROM blocks WHERE id = ?", link.BlockID).
+			Scan(&def.id, &def.path, &def.content, &def.subType)
+		return def, err == nil
+	}
+
+	docID := fromRoot
+	if link.URL != "" {
+		target, fragment := resolveURL(link.URL, fromRel)
+		if err := tx.QueryRow("SELECT id FROM blocks WHERE path = ? AND type = ?", target, database.NodeDocument).Scan(&docID); err != nil {
+			return def, false
+		}
+		if strings.HasPrefix(fragment, "^") {
+			link.Anchor = fragment[1:]
+		} else {
+			link.Heading = fragment
+		}
+	} else if link.Target != "" {
+		var ok bool
+		if docID, ok = resolveDocument(tx, link.Target, fromRel); !ok {
+			return def, false
+		}
+	}
+
+	var err error
+	switch {
+	case link.Anchor != "":
+		err = tx.QueryRow("SELECT id, path, content, subtype FROM blocks WHERE root_id = ? AND name = ? LIMIT 1", docID, link.Anchor).
+			Scan(&def.id, &def.path, &def.content, &def.subType)
+	case link.Heading != "":
+		err = tx.QueryRow("SELECT id, path, content, subtype FROM blocks WHERE root_id = ? AND type = ? AND content = ? COLLATE NOCASE ORDER BY rowid LIMIT 1",
+			docID, database.NodeHeading, link.Heading).
+			Scan(&def.id, &def.path, &def.content, &def.subType)
+	default:
+		err = tx.QueryRow("SELECT id, path, content, subtype FROM blocks WHERE id = ?", docID).
+			Scan(&def.id, &def.path, &def.content, &def.subType)
+	}
+	return def, err == nil
+}
+
+// resolveDocument resolves a wikilink target the way Obsidian does: by note
+// name anywhere in the vault, or by a (partial) path when the target contains
+// a slash. Among several candidates the one closest to the linking note wins.
+func resolveDocument(tx querier, target, fromRel string) (string, bool) {
+	target = strings.TrimPrefix(strings.TrimSpace(target), "/")
+	if isMarkdown(target) {
+		target = strings.TrimSuffix(target, path.Ext(target))
+	}
+	name := path.Base(target)
+
+	rows, err := tx.Query("SELECT id, hpath FROM blocks WHERE type = ? AND content = ? COLLATE NOCASE", database.NodeDocument, name)
+	if err != nil {
+		return "", false
+	}
+	defer rows.Close()
+
+	best, bestPath, bestScore := "", "", -1
+	fromDir := path.Dir(fromRel)
+	for rows.Next() {
+		var id, hp string
+		if err := rows.Scan(&id, &hp); err != nil {
+			continue
+		}
+		lower, want := strings.ToLower(hp), strings.ToLower("/"+target)
+		if strings.Contains(target, "/") && lower != want && !strings.HasSuffix(lower, want) {
+			continue
+		}
+		score := 0
+		switch {
+		case lower == want:
+			score = 3
+		case path.Dir(hp) == fromDir:
+			score = 2
+		default:
+			score = 1
+		}
+		if score > bestScore || (score == bestScore && len(hp) < len(bestPath)) {
+			best, bestPath, bestScore = id, hp, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+// Backlink is a reference into a document together with the text of the
+// block that contains it.
+type Backlink struct {
+	*database.Ref
+	BlockContent string `json:"blockContent"`
+}
+
+// Mention is a block that mentions a document's title without linking to it.
+type Mention struct {
+	BlockID string `json:"blockID"`
+	RootID  string `json:"rootID"`
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+// Backlinks returns the references pointing into the document at rel
+// (to the document itself or any of its blocks).
+func (x *Indexer) Backlinks(rel string) ([]*Backlink, error) {
+	rows, err := x.db.Query(`SELECT r.id, r.def_block_id, r.def_block_path, COALESCE(r.def_block_content, ''), COALESCE(r.def_block_subtype, ''),
+		r.block_id, r.root_id, r.box, r.path, r.content, r.markdown, r.type, r.created, r.updated, COALESCE(s.content, '')
+		FROM refs r
+		JOIN blocks d ON d.id = r.def_block_id
+		LEFT JOIN blocks s ON s.id = r.block_id
+		WHERE d.path = ?
+		ORDER BY r.path, s.rowid`, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*Backlink{}
+	for rows.Next() {
+		b := &Backlink{Ref: &database.Ref{}}
+		if err := scanRef(rows, b.Ref, &b.BlockContent); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// Outlinks returns the resolved references made by the document at rel.
+func (x *Indexer) Outlinks(rel string) ([]*database.Ref, error) {
+	rows, err := x.db.Query(`SELECT r.id, r.def_block_id, r.def_block_path, COALESCE(r.def_block_content, ''), COALESCE(r.def_block_subtype, ''),
+		r.block_id, r.root_id, r.box, r.path, r.content, r.markdown, r.type, r.created, r.updated
+		FROM refs r JOIN blocks s ON s.id = r.block_id
+		WHERE r.path = ?
+		ORDER BY s.rowid`, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*database.Ref{}
+	for rows.Next() {
+		ref := &database.Ref{}
+		if err := scanRef(rows, ref); err != nil {
+			return nil, err
+		}
+		out = append(out, ref)
+	}
+	return out, nil
+}
+
+// UnlinkedMentions returns blocks in other documents whose text contains the
+// title of the document at rel but that do not link to it.
+func (x *Indexer) UnlinkedMentions(rel string, limit int) ([]*Mention, error) {
+	var rootID, title string
+	err := x.db.QueryRow("SELECT id, content FROM blocks WHERE path = ? AND type = ?", rel, database.NodeDocument).Scan(&rootID, &title)
+	if err == sql.ErrNoRows {
+		return []*Mention{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := x.db.Query(`SELECT b.id, b.root_id, b.path, b.content FROM blocks b
+		WHERE b.type IN (?, ?, ?) AND b.root_id != ? AND b.content LIKE ? ESCAPE '\'
+		AND NOT EXISTS (SELECT 1 FROM refs r JOIN blocks d ON d.id = r.def_block_id WHERE r.block_id = b.id AND d.root_id = ?)
+		ORDER BY b.path, b.rowid
+		LIMIT ?`,
+		refSourceTypes[0], refSourceTypes[1], refSourceTypes[2], rootID, "%"+escapeLike(title)+"%", rootID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*Mention{}
+	for rows.Next() {
+		m := &Mention{}
+		if err := rows.Scan(&m.BlockID, &m.RootID, &m.Path, &m.Content); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+func scanRef(rows *sql.Rows, ref *database.Ref, extra ...interface{}) error {
+	var created, updated string
+	dest := []interface{}{
+		&ref.ID, &ref.DefBlockID, &ref.DefBlockPath, &ref.DefBlockContent, &ref.DefBlockSubType,
+		&ref.BlockID, &ref.RootID, &ref.Box, &ref.Path, &ref.Content, &ref.Markdown, &ref.Type, &created, &updated,
+	}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	ref.Created, _ = time.Parse(time.RFC3339, created)
+	ref.Updated, _ = time.Parse(time.RFC3339, updated)
+	return nil
+}
+
+func escapeLike(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(s)
+}
@@ -0,0 +1,161 @@
+package blocks
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"obsidianfs/internal/database"
+)
+
+func TestParseLinks(t *testing.T) {
+	tests := []struct {
+		markdown string
+		want     []Link
+	}{
+		{"no links", nil},
+		{"[[Note]]", []Link{{Raw: "[[Note]]", Target: "Note"}}},
+		{"![[Note|Alias]]", []Link{{Raw: "![[Note|Alias]]", Target: "Note", Alias: "Alias", Embed: true}}},
+		{"[[dir/Note.md#H1#H2]]", []Link{{Raw: "[[dir/Note.md#H1#H2]]", Target: "dir/Note.md", Heading: "H2"}}},
+		{"[[Note#^abc]] [[Note^def]]", []Link{
+			{Raw: "[[Note#^abc]]", Target: "Note", Anchor: "abc"},
+			{Raw: "[[Note^def]]", Target: "Note", Anchor: "def"},
+		}},
+		{"[[#Heading]]", []Link{{Raw: "[[#Heading]]", Heading: "Heading"}}},
+		{`[a](../x%20y.md#H "title") ![img](<pic one.png>)`, []Link{
+			{Raw: `[a](../x%20y.md#H "title")`, URL: "../x%20y.md#H", Alias: "a"},
+			{Raw: "![img](<pic one.png>)", URL: "<pic one.png>", Alias: "img", Embed: true},
+		}},
+		{"[web](https://example.com) [mail](mailto:a@b) [top](#H)", nil},
+		{`((20240101120000-abcdefg "label")) ((20240101120000-hijklmn))`, []Link{
+			{Raw: `((20240101120000-abcdefg "label"))`, BlockID: "20240101120000-abcdefg", Alias: "label"},
+			{Raw: "((20240101120000-hijklmn))", BlockID: "20240101120000-hijklmn"},
+		}},
+		{"`[[Code]]` and ``[x](y.md)`` but [[Real]]", []Link{{Raw: "[[Real]]", Target: "Real"}}},
+	}
+	for _, tt := range tests {
+		if got := ParseLinks(tt.markdown); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseLinks(%q) = %+v, want %+v", tt.markdown, got, tt.want)
+		}
+	}
+}
+
+// anchorID returns the ID of the block named ^name in the document at rel.
+func anchorID(t *testing.T, x *Indexer, rel, name string) string {
+	t.Helper()
+	var id string
+	if err := x.db.QueryRow("SELECT id FROM blocks WHERE path = ? AND name = ?", rel, name).Scan(&id); err != nil {
+		t.Fatalf("block ^%s in %s: %v", name, rel, err)
+	}
+	return id
+}
+
+func TestResolveLinks(t *testing.T) {
+	x := testIndexer(t)
+	writeNote(t, x, "/a/Target.md", "# Title\n\nPara ^blk\n\n## Sub")
+	writeNote(t, x, "/b/Target.md", "Other target")
+	writeNote(t, x, "/b/Deep/Target.md", "Deep target")
+	blk := anchorID(t, x, "/a/Target.md", "blk")
+
+	links := []string{
+		"[[Target]]",            // same folder wins
+		"[[b/Target]]",          // partial path
+		"[[Deep/Target.md]]",    // partial path with extension
+		"[[target|Alias]]",      // case-insensitive, alias as content
+		"[[Target#sub]]",        // heading, case-insensitive
+		"[[Target#^blk]]",       // block anchor
+		"![[Target^blk]]",       // embedded block
+		"[md](Target.md#Sub)",   // relative markdown link with heading
+		"[up](../b/Target.md)",  // relative markdown link up a folder
+		"[abs](/b/Target.md)",   // vault-absolute markdown link
+		"[anchor](#^here)",      // same-note fragment: ignored
+		"((" + blk + "))",       // block reference
+		"[[Missing]]",           // unresolved
+		"[[Target#No heading]]", // unresolved heading
+		"`[[Target]]` in code",  // not a link
+		"Self ^here",
+		"[[#^here]]", // same-note anchor
+	}
+	writeNote(t, x, "/a/Source.md", strings.Join(links, "\n\n"))
+
+	out, err := x.Outlinks("/a/Source.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ref := range out {
+		got = append(got, fmt.Sprintf("%s %s %s %q", ref.Markdown, ref.Type, ref.DefBlockPath, ref.Content))
+	}
+	ref, embed := database.RefTypeRef, database.RefTypeEmbed
+	want := []string{
+		fmt.Sprintf("[[Target]] %s /a/Target.md %q", ref, "Target"),
+		fmt.Sprintf("[[b/Target]] %s /b/Target.md %q", ref, "Target"),
+		fmt.Sprintf("[[Deep/Target.md]] %s /b/Deep/Target.md %q", ref, "Target"),
+		fmt.Sprintf("[[target|Alias]] %s /a/Target.md %q", ref, "Alias"),
+		fmt.Sprintf("[[Target#sub]] %s /a/Target.md %q", ref, "Sub"),
+		fmt.Sprintf("[[Target#^blk]] %s /a/Target.md %q", ref, "Para"),
+		fmt.Sprintf("![[Target^blk]] %s /a/Target.md %q", embed, "Para"),
+		fmt.Sprintf("[md](Target.md#Sub) %s /a/Target.md %q", ref, "md"),
+		fmt.Sprintf("[up](../b/Target.md) %s /b/Target.md %q", ref, "up"),
+		fmt.Sprintf("[abs](/b/Target.md) %s /b/Target.md %q", ref, "abs"),
+		fmt.Sprintf("((%s)) %s /a/Target.md %q", blk, ref, "Para"),
+		fmt.Sprintf("[[#^here]] %s /a/Source.md %q", ref, "Self"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outlinks:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	back, err := x.Backlinks("/a/Target.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(back) != 7 {
+		t.Errorf("%d backlinks into /a/Target.md, want 7", len(back))
+	}
+	for _, b := range back {
+		if b.Path != "/a/Source.md" || b.BlockContent == "" {
+			t.Errorf("backlink %+v from %q", b.Ref, b.BlockContent)
+		}
+	}
+
+	// A note created later resolves the links waiting for it
+	writeNote(t, x, "/c/Missing.md", "Now here")
+	if back, _ := x.Backlinks("/c/Missing.md"); len(back) != 1 {
+		t.Errorf("%d backlinks into the new note, want 1", len(back))
+	}
+
+	// Editing the target keeps block references to unchanged blocks
+	writeNote(t, x, "/a/Target.md", "# Title\n\nNew paragraph\n\nPara ^blk\n\n## Sub")
+	if back, _ := x.Backlinks("/a/Target.md"); len(back) != 7 {
+		t.Errorf("%d backlinks after editing the target, want 7", len(back))
+	}
+}
+
+func TestUnlinkedMentions(t *testing.T) {
+	x := testIndexer(t)
+	writeNote(t, x, "/Topic.md", "Topic mentions itself")
+	writeNote(t, x, "/linked.md", "See [[Topic]] for the Topic")
+	writeNote(t, x, "/plain.md", "# About the topic\n\nNothing here\n\nMore on Topic_s")
+	writeNote(t, x, "/other.md", "Topical")
+
+	mentions, err := x.UnlinkedMentions("/Topic.md", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range mentions {
+		got = append(got, m.Path+": "+m.Content)
+	}
+	want := []string{"/other.md: Topical", "/plain.md: About the topic", "/plain.md: More on Topic_s"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions %q, want %q", got, want)
+	}
+
+	if mentions, _ := x.UnlinkedMentions("/Topic.md", 1); len(mentions) != 1 {
+		t.Errorf("limit 1: %d mentions", len(mentions))
+	}
+	if mentions, err := x.UnlinkedMentions("/missing.md", 10); err != nil || len(mentions) != 0 {
+		t.Errorf("missing document: %v, %v", mentions, err)
+	}
+}
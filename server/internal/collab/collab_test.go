@@ -0,0 +1,395 @@
+package collab
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/history"
+	"obsidianfs/internal/safepath"
+	"obsidianfs/internal/ws"
+)
+
+func u16(s string) []uint16 { return utf16.Encode([]rune(s)) }
+
+func str(doc []uint16) string { return string(utf16.Decode(doc)) }
+
+// parse decodes an operation in the ot.js format.
+func parse(t *testing.T, s string) *Operation {
+	t.Helper()
+	var o Operation
+	if err := json.Unmarshal([]byte(s), &o); err != nil {
+		t.Fatalf("parse %s: %v", s, err)
+	}
+	return &o
+}
+
+func apply(t *testing.T, o *Operation, doc []uint16) []uint16 {
+	t.Helper()
+	out, err := o.Apply(doc)
+	if err != nil {
+		t.Fatalf("apply %v to %q: %v", o.ops, str(doc), err)
+	}
+	return out
+}
+
+// randomOp returns an operation on doc made of random retains, deletes and
+// inserts, some of the inserts holding surrogate pairs.
+func randomOp(rng *rand.Rand, doc []uint16) *Operation {
+	o := &Operation{}
+	for i := 0; i < len(doc); {
+		n := 1 + rng.Intn(len(doc)-i)
+		switch rng.Intn(3) {
+		case 0:
+			o.retain(n)
+		case 1:
+			o.delete(n)
+		default:
+			o.insert(u16([]string{"x", "yz", "😀", "\n"}[rng.Intn(4)]))
+			continue
+		}
+		i += n
+	}
+	if rng.Intn(2) == 0 {
+		o.insert(u16("end"))
+	}
+	return o
+}
+
+func TestTransformConverges(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for n := 0; n < 2000; n++ {
+		doc := make([]uint16, rng.Intn(20))
+		for i := range doc {
+			doc[i] = uint16('a' + rng.Intn(26))
+		}
+		a, b := randomOp(rng, doc), randomOp(rng, doc)
+		a1, b1, err := Transform(a, b)
+		if err != nil {
+			t.Fatalf("transform %v and %v on %q: %v", a.ops, b.ops, str(doc), err)
+		}
+		ab := apply(t, b1, apply(t, a, doc))
+		ba := apply(t, a1, apply(t, b, doc))
+		if str(ab) != str(ba) {
+			t.Fatalf("%q with %v and %v gives %q one way and %q the other", str(doc), a.ops, b.ops, str(ab), str(ba))
+		}
+	}
+}
+
+func TestTransformConcurrentInserts(t *testing.T) {
+	doc := u16("ab")
+	a, b := parse(t, `[1, "x", 1]`), parse(t, `[1, "y", 1]`)
+	a1, b1, err := Transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []string{str(apply(t, b1, apply(t, a, doc))), str(apply(t, a1, apply(t, b, doc)))} {
+		if got != "axyb" {
+			t.Errorf("got %q, want %q", got, "axyb")
+		}
+	}
+}
+
+func TestTransformOverlappingDeletes(t *testing.T) {
+	doc := u16("abcdef")
+	a := parse(t, `[1, -3, 2]`) // deletes bcd
+	b := parse(t, `[2, -3, 1]`) // deletes cde
+	a1, b1, err := Transform(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := str(apply(t, b1, apply(t, a, doc))); got != "af" {
+		t.Errorf("a then b' gives %q, want %q", got, "af")
+	}
+	if got := str(apply(t, a1, apply(t, b, doc))); got != "af" {
+		t.Errorf("b then a' gives %q, want %q", got, "af")
+	}
+	if got, _ := json.Marshal(a1); string(got) != "[1,-1,1]" {
+		t.Errorf("a' = %s, want [1,-1,1]", got)
+	}
+}
+
+func TestTransformLength(t *testing.T) {
+	if _, _, err := Transform(parse(t, `[2]`), parse(t, `[3]`)); !errors.Is(err, ErrLength) {
+		t.Errorf("got %v, want %v", err, ErrLength)
+	}
+}
+
+func TestSurrogatePairs(t *testing.T) {
+	doc := u16("a😀b")
+	if len(doc) != 4 {
+		t.Fatalf("doc has %d code units, want 4", len(doc))
+	}
+	// Deleting the emoji takes both of its code units
+	if got := str(apply(t, parse(t, `[1, -2, 1]`), doc)); got != "ab" {
+		t.Errorf("delete gives %q, want %q", got, "ab")
+	}
+	ins := parse(t, `[2, "🎉", 2]`)
+	if ins.BaseLen != 4 || ins.TargetLen != 6 {
+		t.Errorf("insert lengths %d, %d, want 4, 6", ins.BaseLen, ins.TargetLen)
+	}
+	if b, _ := json.Marshal(ins); string(b) != `[2,"🎉",2]` {
+		t.Errorf("marshal gives %s", b)
+	}
+	// A cursor after the emoji moves by two code units
+	if got := parse(t, `["😀", 4]`).TransformIndex(3); got != 5 {
+		t.Errorf("TransformIndex(3) = %d, want 5", got)
+	}
+	// Lines diffed with emoji keep their code units together
+	from, to := u16("😀 one\ntwo\n"), u16("😀 one\n🎉 two\n")
+	if got := str(apply(t, diff(from, to), from)); got != str(to) {
+		t.Errorf("diff gives %q, want %q", got, str(to))
+	}
+}
+
+func TestTransformIndex(t *testing.T) {
+	tests := []struct {
+		op          string
+		index, want int
+	}{
+		{`["ab", 3]`, 0, 2},
+		{`[1, "ab", 2]`, 1, 3}, // text inserted at the cursor goes before it
+		{`[1, "ab", 2]`, 0, 0},
+		{`[1, -2]`, 2, 1},
+		{`[1, -2]`, 3, 1},
+		{`[-2, 1]`, 3, 1},
+		{`[3]`, 2, 2},
+	}
+	for _, tt := range tests {
+		if got := parse(t, tt.op).TransformIndex(tt.index); got != tt.want {
+			t.Errorf("%s: TransformIndex(%d) = %d, want %d", tt.op, tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestDiffKeepsLines(t *testing.T) {
+	from, to := u16("one\ntwo\nthree\nfour"), u16("one\n2\nthree\nfour!")
+	o := diff(from, to)
+	if got := str(apply(t, o, from)); got != str(to) {
+		t.Fatalf("diff gives %q, want %q", got, str(to))
+	}
+	// Only the changed lines are replaced, whole
+	if b, _ := json.Marshal(o); string(b) != `[4,"2\n",-4,6,"four!",-4]` {
+		t.Errorf("diff = %s", b)
+	}
+}
+
+func TestHistoryTrim(t *testing.T) {
+	s := &session{path: "/note.md", doc: u16(""), peers: map[*ws.Client]*Peer{}}
+	for i := 0; i < maxHistory+10; i++ {
+		o := &Operation{}
+		o.retain(len(s.doc))
+		o.insert(u16("x"))
+		if _, err := s.apply(o, s.revision, nil); err != nil {
+			t.Fatalf("apply %d: %v", i, err)
+		}
+	}
+	if len(s.history) != maxHistory {
+		t.Errorf("history has %d operations, want %d", len(s.history), maxHistory)
+	}
+	if _, err := s.since(9); !errors.Is(err, ErrRevision) {
+		t.Errorf("since(9) = %v, want %v", err, ErrRevision)
+	}
+	if ops, err := s.since(10); err != nil || len(ops) != maxHistory {
+		t.Errorf("since(10) = %d operations, %v", len(ops), err)
+	}
+	// An operation based on the oldest kept revision is moved past the rest
+	late := parse(t, `["y", 10]`)
+	applied, err := s.apply(late, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied.BaseLen != maxHistory+10 || s.doc[0] != 'y' {
+		t.Errorf("late operation applied as %v", applied.ops)
+	}
+	if _, err := s.apply(parse(t, `["z", 9]`), 9, nil); !errors.Is(err, ErrRevision) {
+		t.Errorf("operation based on a trimmed revision: %v, want %v", err, ErrRevision)
+	}
+}
+
+// testManager returns a manager for a vault in a temporary directory,
+// with the session of /note.md open on content.
+func testManager(t *testing.T, content string) (*Manager, *session) {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testManagerWithHistory(t, dir, content, nil)
+}
+
+// testManagerWithHistory is testManager for the vault in dir, keeping
+// versions in hist.
+func testManagerWithHistory(t *testing.T, dir, content string, hist filesystem.History) (*Manager, *session) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, "note.md"), []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := safepath.New(dir, safepath.SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsSvc, err := filesystem.NewService(resolver, nil, hist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager(ws.NewHub(), fsSvc, dir)
+	doc := u16(content)
+	s := &session{path: "/note.md", doc: doc, saved: doc, versionAt: time.Now(), peers: make(map[*ws.Client]*Peer)}
+	m.sessions[s.path] = s
+	return m, s
+}
+
+// onDisk returns the content of /note.md on disk.
+func onDisk(t *testing.T, m *Manager) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(m.root, "note.md"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestMerge(t *testing.T) {
+	m, s := testManager(t, "one\ntwo\n")
+	// Unsaved edit in the session, on the second line
+	if _, err := s.apply(parse(t, `[4, "2", -3, 1]`), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent edit on disk, on the first line
+	if err := os.WriteFile(filepath.Join(m.root, "note.md"), []byte("ONE\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.merge(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := str(s.doc); got != "ONE\n2\n" {
+		t.Errorf("session has %q, want %q", got, "ONE\n2\n")
+	}
+	if got := onDisk(t, m); got != "ONE\n2\n" {
+		t.Errorf("disk has %q, want %q", got, "ONE\n2\n")
+	}
+	if s.savedRev != s.revision {
+		t.Errorf("saved revision %d, want %d", s.savedRev, s.revision)
+	}
+}
+
+// TestMergeTooFarBehind checks that a disk edit based on a revision out of
+// the history replaces the session document.
+func TestMergeTooFarBehind(t *testing.T) {
+	m, s := testManager(t, "one\n")
+	for i := 0; i < maxHistory+1; i++ {
+		o := &Operation{}
+		o.retain(len(s.doc))
+		o.insert(u16("x"))
+		if _, err := s.apply(o, s.revision, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(m.root, "note.md"), []byte("zero\none\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.merge(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := str(s.doc); got != "zero\none\n" {
+		t.Errorf("session has %q, want the disk content", got)
+	}
+	if s.revision != maxHistory+2 || s.savedRev != s.revision {
+		t.Errorf("revision %d, saved %d, want %d for both", s.revision, s.savedRev, maxHistory+2)
+	}
+	if got := onDisk(t, m); got != "zero\none\n" {
+		t.Errorf("disk has %q", got)
+	}
+}
+
+// TestRunVersions checks that the periodic saves of an edited session write
+// the file but leave the history alone until the session ends.
+func TestRunVersions(t *testing.T) {
+	vault, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := history.NewStore(t.TempDir(), vault, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, s := testManagerWithHistory(t, vault, "start\n", store)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		m.Run(2*time.Millisecond, stop)
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		m.mu.Lock()
+		o := &Operation{}
+		o.retain(len(s.doc))
+		o.insert(u16("x"))
+		if _, err := s.apply(o, s.revision, nil); err != nil {
+			t.Fatal(err)
+		}
+		m.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := onDisk(t, m); len(got) < len("start\n")+50 {
+		t.Errorf("disk has %q, want the saved edits", got)
+	}
+	versions, err := store.List("/note.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Source != history.SourceInitial {
+		t.Fatalf("history while editing: %+v, want the initial version only", versions)
+	}
+
+	close(stop)
+	<-done
+	if versions, _ = store.List("/note.md"); len(versions) != 2 || versions[0].Source != history.SourceAPI {
+		t.Fatalf("history after the session: %+v, want the initial and the final version", versions)
+	}
+	if got := onDisk(t, m); got != "start\n"+strings.Repeat("x", 100) {
+		t.Errorf("disk has %q", got)
+	}
+	// The watcher event of a save records no version either
+	store.OnFsEvent("modified", filepath.Join(vault, "note.md"))
+	if versions, _ = store.List("/note.md"); len(versions) != 2 {
+		t.Errorf("watcher event added a version: %+v", versions)
+	}
+}
+
+// TestSaveVersionInterval checks that a save records a version once
+// VersionInterval has passed since the last one.
+func TestSaveVersionInterval(t *testing.T) {
+	vault, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := history.NewStore(t.TempDir(), vault, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, s := testManagerWithHistory(t, vault, "a", store)
+	for i, want := range []int{1, 2} {
+		o := &Operation{}
+		o.retain(len(s.doc))
+		o.insert(u16("b"))
+		if _, err := s.apply(o, s.revision, nil); err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			s.versionAt = time.Now().Add(-VersionInterval)
+		}
+		m.SaveAll()
+		if versions, _ := store.List("/note.md"); len(versions) != want {
+			t.Errorf("save %d: %d versions, want %d", i, len(versions), want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package collab
+
+import (
+	"slices"
+
+	"obsidianfs/internal/myers"
+)
+
+// diff returns an operation turning from into to, replacing only the lines
+// that differ so concurrent edits elsewhere in the file are kept.
+func diff(from, to []uint16) *Operation {
+	a, b := splitLines(from), splitLines(to)
+	o := &Operation{}
+	eq := func(i, j int) bool { return slices.Equal(a[i], b[j]) }
+	for _, e := range myers.Diff(len(a), len(b), eq) {
+		switch e.Kind {
+		case myers.Equal:
+			o.retain(len(a[e.A]))
+		case myers.Delete:
+			o.delete(len(a[e.A]))
+		case myers.Insert:
+			o.insert(b[e.B])
+		}
+	}
+	return o
+}
+
+// splitLines splits s after each newline, keeping the newlines.
+func splitLines(s []uint16) [][]uint16 {
+	var out [][]uint16
+	start := 0
+	for i, c := range s {
+		if c == '\n' {
+			out = append(out, s[start:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		out = append(out, s[start:])
+	}
+	return out
+}
@@ -0,0 +1,417 @@
+package collab
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/ws"
+)
+
+// maxHistory is the number of operations a session keeps to transform
+// late operations; clients further behind must join again.
+const maxHistory = 1000
+
+// DefaultSaveInterval is how often edited sessions are written to disk.
+const DefaultSaveInterval = 2 * time.Second
+
+// VersionInterval is how often at most an edited session records a version
+// in the file history; saves in between record none, so the history is not
+// filled with one version per save. A version is also recorded when the
+// last client leaves.
+const VersionInterval = 5 * time.Minute
+
+var (
+	// ErrNotJoined is returned for edits by a client outside the session.
+	ErrNotJoined = errors.New("not joined to this file")
+	// ErrRevision is returned for operations based on a revision the
+	// session no longer knows.
+	ErrRevision = errors.New("unknown revision, join again")
+)
+
+// Selection is a cursor (Anchor == Head) or selected range of a client.
+type Selection struct {
+	Ranges []Range `json:"ranges"`
+}
+
+// Range is one selected range in UTF-16 positions.
+type Range struct {
+	Anchor int `json:"anchor"`
+	Head   int `json:"head"`
+}
+
+func (s *Selection) transform(o *Operation) {
+	if s == nil {
+		return
+	}
+	for i := range s.Ranges {
+		s.Ranges[i].Anchor = o.TransformIndex(s.Ranges[i].Anchor)
+		s.Ranges[i].Head = o.TransformIndex(s.Ranges[i].Head)
+	}
+}
+
+// Peer is a client in a session as the others see it.
+type Peer struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name,omitempty"`
+	Selection *Selection `json:"selection,omitempty"`
+}
+
+// Message is pushed to the clients of a session. Action is one of
+// joined | left | op | ack | selection | closed.
+type Message struct {
+	Type      string     `json:"type"` // always "collab"
+	Action    string     `json:"action"`
+	Path      string     `json:"path"`
+	Revision  int        `json:"revision,omitempty"`
+	Op        *Operation `json:"op,omitempty"`
+	Client    string     `json:"client,omitempty"` // empty for edits made on disk
+	Name      string     `json:"name,omitempty"`
+	Selection *Selection `json:"selection,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// Snapshot is what a client gets on joining.
+type Snapshot struct {
+	Path     string  `json:"path"`
+	Revision int     `json:"revision"`
+	Content  string  `json:"content"`
+	Client   string  `json:"client"`
+	Peers    []*Peer `json:"peers"`
+}
+
+// session is the live document of one file.
+type session struct {
+	path     string
+	doc      []uint16
+	revision int
+	history  []*Operation // the operations leading to revision, newest last
+	peers    map[*ws.Client]*Peer
+
+	saved    []uint16 // content on disk as of savedRev
+	savedRev int
+	closed   bool
+
+	versionRev int       // revision last recorded in the file history
+	versionAt  time.Time // when it was recorded, or the session opened
+}
+
+// since returns the operations after rev.
+func (s *session) since(rev int) ([]*Operation, error) {
+	first := s.revision - len(s.history)
+	if rev < first || rev > s.revision {
+		return nil, ErrRevision
+	}
+	return s.history[rev-first:], nil
+}
+
+// apply transforms op, based on rev, over the operations since and applies
+// it, returning the operation as applied. sel, a selection in the document
+// after op, is moved over the same operations.
+func (s *session) apply(op *Operation, rev int, sel *Selection) (*Operation, error) {
+	concurrent, err := s.since(rev)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range concurrent {
+		var c1 *Operation
+		if op, c1, err = Transform(op, c); err != nil {
+			return nil, err
+		}
+		sel.transform(c1)
+	}
+	doc, err := op.Apply(s.doc)
+	if err != nil {
+		return nil, err
+	}
+	s.doc = doc
+	s.revision++
+	s.history = append(s.history, op)
+	if len(s.history) > maxHistory {
+		s.history = s.history[len(s.history)-maxHistory:]
+	}
+	for _, p := range s.peers {
+		p.Selection.transform(op)
+	}
+	return op, nil
+}
+
+// Manager keeps one session per file being edited together and writes
+// them back through the filesystem service.
+type Manager struct {
+	hub          *ws.Hub
+	fs           *filesystem.Service
+	root         string
+	versionEvery time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*session // by vault path
+}
+
+// NewManager creates the session manager. root is the vault directory the
+// watcher reports absolute paths in.
+func NewManager(hub *ws.Hub, fsSvc *filesystem.Service, root string) *Manager {
+	m := &Manager{hub: hub, fs: fsSvc, root: root, versionEvery: VersionInterval, sessions: make(map[string]*session)}
+	hub.OnDisconnect(m.LeaveAll)
+	return m
+}
+
+func normalizePath(p string) string {
+	return "/" + strings.Trim(filepath.ToSlash(p), "/")
+}
+
+// broadcast sends msg to the clients of s except skip. Callers hold m.mu,
+// which keeps messages in revision order.
+func (m *Manager) broadcast(s *session, msg Message, skip *ws.Client) {
+	msg.Type, msg.Path = "collab", s.path
+	for c := range s.peers {
+		if c != skip {
+			m.hub.Send(c, msg)
+		}
+	}
+}
+
+// Join adds c, shown to the others as name, to the session of path,
+// opening it if needed. reply is called with the snapshot before any
+// later operation is sent to c.
+func (m *Manager) Join(c *ws.Client, name, path string, reply func(*Snapshot)) error {
+	path = normalizePath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sessions[path]
+	if s == nil {
+		content, err := m.fs.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		doc := utf16.Encode([]rune(content))
+		s = &session{path: path, doc: doc, saved: doc, versionAt: time.Now(), peers: make(map[*ws.Client]*Peer)}
+		m.sessions[path] = s
+	}
+	peer := s.peers[c]
+	if peer == nil {
+		peer = &Peer{ID: c.ID(), Name: name}
+		s.peers[c] = peer
+		m.broadcast(s, Message{Action: "joined", Client: peer.ID, Name: name}, c)
+	}
+	snap := &Snapshot{Path: path, Revision: s.revision, Content: string(utf16.Decode(s.doc)), Client: c.ID(), Peers: []*Peer{}}
+	for other, p := range s.peers {
+		if other != c {
+			snap.Peers = append(snap.Peers, p)
+		}
+	}
+	reply(snap)
+	return nil
+}
+
+// Edit applies op, which c based on revision rev, to the session of path.
+// c gets an ack with the new revision and the others the transformed
+// operation, all before Edit returns.
+func (m *Manager) Edit(c *ws.Client, path string, rev int, op *Operation, sel *Selection) error {
+	path = normalizePath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sessions[path]
+	if s == nil || s.peers[c] == nil {
+		return ErrNotJoined
+	}
+	applied, err := s.apply(op, rev, sel)
+	if err != nil {
+		return err
+	}
+	if sel != nil {
+		s.peers[c].Selection = sel
+	}
+	m.hub.Send(c, Message{Type: "collab", Action: "ack", Path: path, Revision: s.revision})
+	m.broadcast(s, Message{Action: "op", Revision: s.revision, Op: applied, Client: c.ID(), Selection: sel}, c)
+	return nil
+}
+
+// Select updates the selection of c, based on revision rev, and shows it
+// to the others.
+func (m *Manager) Select(c *ws.Client, path string, rev int, sel *Selection) error {
+	path = normalizePath(path)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.sessions[path]
+	if s == nil || s.peers[c] == nil {
+		return ErrNotJoined
+	}
+	concurrent, err := s.since(rev)
+	if err != nil {
+		return err
+	}
+	for _, op := range concurrent {
+		sel.transform(op)
+	}
+	s.peers[c].Selection = sel
+	m.broadcast(s, Message{Action: "selection", Revision: s.revision, Client: c.ID(), Selection: sel}, c)
+	return nil
+}
+
+// Leave removes c from the session of path. The last one to leave closes
+// the session after saving it.
+func (m *Manager) Leave(c *ws.Client, path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.sessions[normalizePath(path)]; s != nil {
+		m.leave(s, c)
+	}
+}
+
+// LeaveAll removes c from every session, e.g. when it disconnects.
+func (m *Manager) LeaveAll(c *ws.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		m.leave(s, c)
+	}
+}
+
+func (m *Manager) leave(s *session, c *ws.Client) {
+	peer := s.peers[c]
+	if peer == nil {
+		return
+	}
+	delete(s.peers, c)
+	m.broadcast(s, Message{Action: "left", Client: peer.ID}, nil)
+	if len(s.peers) == 0 {
+		if err := m.save(s, true); err != nil {
+			log.Printf("collab save %s: %v", s.path, err)
+		}
+		delete(m.sessions, s.path)
+	}
+}
+
+// save writes s to disk if it changed since the last save. With version
+// it also records the document in the file history unless it is there.
+func (m *Manager) save(s *session, version bool) error {
+	if s.closed {
+		return nil
+	}
+	content := string(utf16.Decode(s.doc))
+	if s.savedRev != s.revision {
+		if err := m.fs.WriteFileUnversioned(s.path, content); err != nil {
+			return err
+		}
+		s.saved, s.savedRev = s.doc, s.revision
+		m.hub.Broadcast(ws.Event{Type: "fs", Action: "modified", Path: s.path})
+	}
+	if version && s.versionRev != s.revision {
+		if err := m.fs.RecordVersion(s.path, content); err != nil {
+			return err
+		}
+		s.versionRev, s.versionAt = s.revision, time.Now()
+	}
+	return nil
+}
+
+// SaveAll writes every edited session to disk, recording versions of those
+// last recorded over VersionInterval ago.
+func (m *Manager) SaveAll() {
+	m.saveAll(false)
+}
+
+// saveAll saves every session, recording versions of all of them with
+// force.
+func (m *Manager) saveAll(force bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.sessions {
+		if err := m.save(s, force || time.Since(s.versionAt) >= m.versionEvery); err != nil {
+			log.Printf("collab save %s: %v", s.path, err)
+		}
+	}
+}
+
+// Run saves edited sessions every interval until stop is closed, then
+// saves once more, recording a version of each.
+func (m *Manager) Run(interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		interval = DefaultSaveInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.SaveAll()
+		case <-stop:
+			m.saveAll(true)
+			return
+		}
+	}
+}
+
+// OnFsEvent merges edits made on disk into the live session of the file
+// and closes sessions of deleted files.
+func (m *Manager) OnFsEvent(action string, absPath string) {
+	rel, err := filepath.Rel(m.root, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	path := normalizePath(rel)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch action {
+	case "created", "modified":
+		if s := m.sessions[path]; s != nil {
+			if err := m.merge(s); err != nil {
+				log.Printf("collab merge %s: %v", path, err)
+			}
+		}
+	case "deleted", "renamed":
+		for p, s := range m.sessions {
+			if p == path || strings.HasPrefix(p, path+"/") {
+				m.close(s, action)
+			}
+		}
+	}
+}
+
+// OnFsRename closes the sessions below a renamed path; clients join the
+// new path again.
+func (m *Manager) OnFsRename(fromAbs, toAbs string) {
+	m.OnFsEvent("renamed", fromAbs)
+}
+
+// merge applies the difference between the last save and the file on disk
+// as an operation based on the saved revision.
+func (m *Manager) merge(s *session) error {
+	content, err := m.fs.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	disk := utf16.Encode([]rune(content))
+	op := diff(s.saved, disk)
+	if op.IsNoop() {
+		return nil // our own save
+	}
+	applied, err := s.apply(op, s.savedRev, nil)
+	if errors.Is(err, ErrRevision) {
+		// Too far behind to merge: the file on disk wins
+		applied, err = s.apply(diff(s.doc, disk), s.revision, nil)
+	}
+	if err != nil {
+		return err
+	}
+	m.broadcast(s, Message{Action: "op", Revision: s.revision, Op: applied}, nil)
+	// Write the merged document back unless the disk already has it
+	if string(utf16.Decode(s.doc)) != content {
+		return m.save(s, false)
+	}
+	s.saved, s.savedRev = s.doc, s.revision
+	return nil
+}
+
+// close ends s, telling its clients why.
+func (m *Manager) close(s *session, reason string) {
+	s.closed = true
+	m.broadcast(s, Message{Action: "closed", Reason: reason}, nil)
+	delete(m.sessions, s.path)
+}
@@ -3,17 +3,23 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
-	conn *sql.DB
+	conn   *sql.DB
+	hasFTS bool
 }
 
+// FTSBlockTypes 参与全文搜索的块类型（列表、引述等容器块的内容已包含在子块中）
+var FTSBlockTypes = []string{NodeDocument, NodeHeading, NodeParagraph, NodeCodeBlock, NodeMathBlock, NodeTable}
+
 var instance *DB
 
 // InitDatabase 初始化数据库
@@ -49,6 +55,13 @@ func InitDatabase(dataDir string) (*DB, error) {
 		return nil, fmt.Errorf("初始化数据库结构失败: %w", err)
 	}
 
+	// 全文索引依赖 FTS5，go-sqlite3 需使用 -tags sqlite_fts5 构建（见 Makefile），不可用时仅禁用搜索
+	if err := db.initFTS(); err != nil {
+		log.Printf("全文索引不可用，已禁用搜索: %v", err)
+	} else {
+		db.hasFTS = true
+	}
+
 	return db, nil
 }
 
@@ -59,6 +72,9 @@ func GetInstance() *DB {
 
 // Close 关闭数据库连接
 func (db *DB) Close() error {
+	if instance == db {
+		instance = nil
+	}
 	if db.conn != nil {
 		return db.conn.Close()
 	}
@@ -79,6 +95,48 @@ func (db *DB) initSchema() error {
 			updated TEXT NOT NULL
 		)`,
 
+		// users 表：本地账号，密码以 bcrypt 哈希保存
+		`CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'user',
+			created TEXT NOT NULL,
+			updated TEXT NOT NULL
+		)`,
+
+		// sessions 表：登录会话，只保存令牌的 SHA-256
+		`CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			expires TEXT NOT NULL,
+			created TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// api_tokens 表：供脚本使用的长期令牌
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL UNIQUE,
+			created TEXT NOT NULL,
+			last_used TEXT DEFAULT '',
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+
+		// permissions 表：用户在笔记本或路径前缀上的权限（notebook 与 path 二选一）
+		`CREATE TABLE IF NOT EXISTS permissions (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			notebook TEXT NOT NULL DEFAULT '',
+			path TEXT NOT NULL DEFAULT '',
+			level TEXT NOT NULL,
+			created TEXT NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE(user_id, notebook, path)
+		)`,
+
 		// blocks 表
 		`CREATE TABLE IF NOT EXISTS blocks (
 			id TEXT PRIMARY KEY,
@@ -151,6 +209,24 @@ func (db *DB) initSchema() error {
 			FOREIGN KEY (block_id) REFERENCES blocks(id) ON DELETE CASCADE
 		)`,
 
+		// tag_files 表：标签索引已处理的文件，mtime、size 与内容哈希用于启动时跳过未变化的文件
+		`CREATE TABLE IF NOT EXISTS tag_files (
+			path TEXT PRIMARY KEY,
+			mtime TEXT NOT NULL,
+			size INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			version INTEGER NOT NULL DEFAULT 0
+		)`,
+
+		// file_tags 表：每个文件中各标签出现的次数
+		`CREATE TABLE IF NOT EXISTS file_tags (
+			path TEXT NOT NULL,
+			tag TEXT NOT NULL,
+			count INTEGER NOT NULL,
+			PRIMARY KEY (path, tag),
+			FOREIGN KEY (path) REFERENCES tag_files(path) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+
 		// file_annotation_refs 表
 		`CREATE TABLE IF NOT EXISTS file_annotation_refs (
 			id TEXT PRIMARY KEY,
@@ -198,6 +274,14 @@ func (db *DB) initSchema() error {
 		`CREATE INDEX IF NOT EXISTS idx_spans_box ON spans(box)`,
 		`CREATE INDEX IF NOT EXISTS idx_spans_content ON spans(content)`,
 
+		// sessions / api_tokens 表索引
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_permissions_user_id ON permissions(user_id)`,
+
+		// file_tags 表索引
+		`CREATE INDEX IF NOT EXISTS idx_file_tags_tag ON file_tags(tag)`,
+
 		// attributes 表索引
 		`CREATE INDEX IF NOT EXISTS idx_attributes_block_id ON attributes(block_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_attributes_name ON attributes(name)`,
@@ -212,6 +296,78 @@ func (db *DB) initSchema() error {
 	return nil
 }
 
+// ftsTokenizer 是 blocks_fts 使用的分词器
+const ftsTokenizer = "trigram remove_diacritics 1"
+
+// initFTS 创建 blocks_fts 全文索引表，并通过触发器与 blocks 表保持同步
+func (db *DB) initFTS() error {
+	types := "'" + strings.Join(FTSBlockTypes, "','") + "'"
+	insert := `INSERT INTO blocks_fts(rowid, id, root_id, box, path, type, content)
+		SELECT new.rowid, new.id, new.root_id, new.box, new.path, new.type, new.content
+		WHERE new.type IN (` + types + `);`
+	// trigram 分词按三个字符的子串建索引，中日韩文本没有空格也能搜到其中的词；
+	// unicode61 会把一整段中文当作一个词。旧的索引表分词器不同时删除后重建
+	var existing string
+	err := db.conn.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'blocks_fts'").Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if existing != "" && !strings.Contains(existing, "'"+ftsTokenizer+"'") {
+		if _, err := db.conn.Exec("DROP TABLE blocks_fts"); err != nil {
+			return fmt.Errorf("删除旧全文索引失败: %w", err)
+		}
+	}
+
+	statements := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS blocks_fts USING fts5(
+			id UNINDEXED,
+			root_id UNINDEXED,
+			box UNINDEXED,
+			path UNINDEXED,
+			type UNINDEXED,
+			content,
+			tokenize = '` + ftsTokenizer + `'
+		)`,
+		`CREATE TRIGGER IF NOT EXISTS blocks_fts_insert AFTER INSERT ON blocks BEGIN ` + insert + ` END`,
+		`CREATE TRIGGER IF NOT EXISTS blocks_fts_delete AFTER DELETE ON blocks BEGIN
+			DELETE FROM blocks_fts WHERE rowid = old.rowid;
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS blocks_fts_update AFTER UPDATE ON blocks BEGIN
+			DELETE FROM blocks_fts WHERE rowid = old.rowid; ` + insert + `
+		END`,
+	}
+	for _, statement := range statements {
+		if _, err := db.conn.Exec(statement); err != nil {
+			return fmt.Errorf("创建全文索引失败: %w", err)
+		}
+	}
+
+	// 已有数据库首次启用全文索引（或索引与 blocks 表不一致）时重建
+	var indexed, expected int
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM blocks_fts").Scan(&indexed); err != nil {
+		return err
+	}
+	if err := db.conn.QueryRow("SELECT COUNT(*) FROM blocks WHERE type IN (" + types + ")").Scan(&expected); err != nil {
+		return err
+	}
+	if indexed != expected {
+		if _, err := db.conn.Exec("DELETE FROM blocks_fts"); err != nil {
+			return err
+		}
+		_, err := db.conn.Exec(`INSERT INTO blocks_fts(rowid, id, root_id, box, path, type, content)
+			SELECT rowid, id, root_id, box, path, type, content FROM blocks WHERE type IN (` + types + `)`)
+		if err != nil {
+			return fmt.Errorf("重建全文索引失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// HasFTS 全文索引是否可用
+func (db *DB) HasFTS() bool {
+	return db.hasFTS
+}
+
 // BeginTx 开始事务
 func (db *DB) BeginTx() (*sql.Tx, error) {
 	return db.conn.Begin()
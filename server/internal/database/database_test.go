@@ -0,0 +1,56 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFTSTokenizerMigration opens a database whose blocks_fts still uses
+// the old unicode61 tokenizer and checks that it is rebuilt with trigram.
+func TestFTSTokenizerMigration(t *testing.T) {
+	dir := t.TempDir()
+	db, err := InitDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.HasFTS() {
+		db.Close()
+		t.Skip("FTS5 not available; run with -tags sqlite_fts5")
+	}
+	now := time.Now().Format(time.RFC3339)
+	_, err = db.Exec(`INSERT INTO blocks (id, parent_id, root_id, type, content, markdown, path, box, created, updated)
+		VALUES ('a', '', 'a', ?, '这是中文搜索测试', '', '/nb/a.md', 'nb', ?, ?)`, NodeDocument, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`DROP TABLE blocks_fts`,
+		`CREATE VIRTUAL TABLE blocks_fts USING fts5(id UNINDEXED, root_id UNINDEXED, box UNINDEXED,
+			path UNINDEXED, type UNINDEXED, content, tokenize = 'unicode61 remove_diacritics 2')`,
+		`INSERT INTO blocks_fts(rowid, id, root_id, box, path, type, content)
+			SELECT rowid, id, root_id, box, path, type, content FROM blocks`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db, err = InitDatabase(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var schema string
+	if err := db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'blocks_fts'").Scan(&schema); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(schema, "trigram") {
+		t.Errorf("blocks_fts not rebuilt: %s", schema)
+	}
+	var id string
+	if err := db.QueryRow(`SELECT id FROM blocks_fts WHERE blocks_fts MATCH '"搜索测"'`).Scan(&id); err != nil || id != "a" {
+		t.Errorf("search after rebuild: %q, %v", id, err)
+	}
+}
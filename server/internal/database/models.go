@@ -15,6 +15,40 @@ type Notebook struct {
 	Updated time.Time `json:"updated" db:"updated"`
 }
 
+// User 本地用户
+type User struct {
+	ID       string    `json:"id" db:"id"`
+	Username string    `json:"username" db:"username"`
+	Role     string    `json:"role" db:"role"` // admin | user
+	Created  time.Time `json:"created" db:"created"`
+	Updated  time.Time `json:"updated" db:"updated"`
+}
+
+// APIToken 脚本使用的 API 令牌，令牌本身只在创建时返回一次
+type APIToken struct {
+	ID       string    `json:"id" db:"id"`
+	UserID   string    `json:"userID" db:"user_id"`
+	Name     string    `json:"name" db:"name"`
+	Created  time.Time `json:"created" db:"created"`
+	LastUsed time.Time `json:"lastUsed,omitempty" db:"last_used"`
+}
+
+// Permission 用户在笔记本（Notebook）或路径前缀（Path）上的权限
+type Permission struct {
+	ID       string    `json:"id" db:"id"`
+	UserID   string    `json:"userID" db:"user_id"`
+	Notebook string    `json:"notebook,omitempty" db:"notebook"`
+	Path     string    `json:"path,omitempty" db:"path"`
+	Level    string    `json:"level" db:"level"` // none | read | write | admin
+	Created  time.Time `json:"created" db:"created"`
+}
+
+// 用户角色
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
 // Block 块模型 - 核心数据结构
 type Block struct {
 	ID       string    `json:"id" db:"id"`
@@ -0,0 +1,94 @@
+package filesystem
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+
+    "github.com/spf13/afero"
+)
+
+// TempPrefix starts the names of the temporary files used for atomic writes.
+// Files with this prefix that survive a crash are removed by RemoveTempFiles.
+const TempPrefix = ".obsidianfs-tmp-"
+
+// WriteFileAtomic writes data to path so that readers see either the old or
+// the new content, never a partial file. See WriteAtomic.
+func WriteFileAtomic(fsys afero.Fs, path string, data []byte, perm os.FileMode) error {
+    return WriteAtomic(fsys, path, bytes.NewReader(data), perm)
+}
+
+// WriteAtomic copies r into a temporary file in the directory of path,
+// fsyncs it and renames it over path. An existing file keeps its
+// permissions; a new one gets perm.
+func WriteAtomic(fsys afero.Fs, path string, r io.Reader, perm os.FileMode) (err error) {
+    if info, err := fsys.Stat(path); err == nil {
+        if info.IsDir() {
+            return &fs.PathError{Op: "write", Path: path, Err: errors.New("is a directory")}
+        }
+        perm = info.Mode().Perm()
+    }
+    dir := filepath.Dir(path)
+    tmp, err := afero.TempFile(fsys, dir, TempPrefix+"*")
+    if err != nil {
+        return err
+    }
+    defer func() {
+        if err != nil {
+            _ = fsys.Remove(tmp.Name())
+        }
+    }()
+
+    if _, err = io.Copy(tmp, r); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Sync(); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err = tmp.Close(); err != nil {
+        return err
+    }
+    if err = fsys.Chmod(tmp.Name(), perm); err != nil {
+        return err
+    }
+    if err = fsys.Rename(tmp.Name(), path); err != nil {
+        return err
+    }
+    syncDir(fsys, dir)
+    return nil
+}
+
+// syncDir makes a rename in dir durable. Errors are ignored: not every
+// platform can fsync a directory.
+func syncDir(fsys afero.Fs, dir string) {
+    if d, err := fsys.Open(dir); err == nil {
+        _ = d.Sync()
+        d.Close()
+    }
+}
+
+// RemoveTempFiles deletes temporary files left under root by interrupted
+// atomic writes and returns how many were removed. It must run before
+// anything else writes below root, e.g. at startup.
+func RemoveTempFiles(fsys afero.Fs, root string) (int, error) {
+    n := 0
+    err := afero.Walk(fsys, root, func(p string, info os.FileInfo, err error) error {
+        if err != nil {
+            return nil
+        }
+        if info.IsDir() || !strings.HasPrefix(info.Name(), TempPrefix) {
+            return nil
+        }
+        if err := fsys.Remove(p); err == nil {
+            n++
+        }
+        return nil
+    })
+    return n, err
+}
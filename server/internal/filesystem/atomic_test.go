@@ -0,0 +1,89 @@
+package filesystem
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "github.com/spf13/afero"
+)
+
+// tempFiles lists the files below root named like atomic write temporaries.
+func tempFiles(t *testing.T, root string) []string {
+    t.Helper()
+    var found []string
+    err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+        if err == nil && !info.IsDir() && strings.HasPrefix(info.Name(), TempPrefix) {
+            found = append(found, p)
+        }
+        return err
+    })
+    if err != nil { t.Fatal(err) }
+    return found
+}
+
+// failingReader returns some data, then an error.
+type failingReader struct{ done bool }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+    if r.done {
+        return 0, errors.New("read failed")
+    }
+    r.done = true
+    return copy(p, "partial"), nil
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+    dir := t.TempDir()
+    fsys := afero.NewOsFs()
+    p := filepath.Join(dir, "note.md")
+
+    if err := WriteFileAtomic(fsys, p, []byte("first"), 0o600); err != nil { t.Fatal(err) }
+    // An existing file keeps its permissions
+    if err := WriteFileAtomic(fsys, p, []byte("second"), 0o644); err != nil { t.Fatal(err) }
+    info, err := os.Stat(p)
+    if err != nil { t.Fatal(err) }
+    if info.Mode().Perm() != 0o600 { t.Errorf("mode %v, want 0600", info.Mode().Perm()) }
+    if b, _ := os.ReadFile(p); string(b) != "second" { t.Errorf("content %q", b) }
+
+    // A failed write leaves the old content and no temporary file
+    if err := WriteAtomic(fsys, p, &failingReader{}, 0o644); err == nil { t.Error("write from a failing reader succeeded") }
+    if b, _ := os.ReadFile(p); string(b) != "second" { t.Errorf("content after a failed write %q", b) }
+
+    if err := os.Mkdir(filepath.Join(dir, "folder"), 0o755); err != nil { t.Fatal(err) }
+    if err := WriteFileAtomic(fsys, filepath.Join(dir, "folder"), []byte("x"), 0o644); err == nil {
+        t.Error("wrote over a folder")
+    }
+    if err := WriteFileAtomic(fsys, filepath.Join(dir, "missing", "a.md"), []byte("x"), 0o644); err == nil {
+        t.Error("wrote into a missing folder")
+    }
+    if found := tempFiles(t, dir); len(found) != 0 { t.Errorf("temporary files left: %v", found) }
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+    root := t.TempDir()
+    files := []string{
+        TempPrefix + "1", // orphans of interrupted writes
+        filepath.Join("a", "b", TempPrefix+"2"),
+        "note.md", // kept
+        filepath.Join("a", "x"+TempPrefix), // prefix elsewhere in the name
+        filepath.Join(TempPrefix+"dir", "kept.md"),
+    }
+    for _, f := range files {
+        abs := filepath.Join(root, f)
+        if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil { t.Fatal(err) }
+        if err := os.WriteFile(abs, []byte("x"), 0o644); err != nil { t.Fatal(err) }
+    }
+
+    n, err := RemoveTempFiles(afero.NewOsFs(), root)
+    if err != nil || n != 2 { t.Errorf("removed %d, %v, want 2", n, err) }
+    if found := tempFiles(t, root); len(found) != 0 { t.Errorf("temporary files left: %v", found) }
+    for _, f := range files[2:] {
+        if _, err := os.Stat(filepath.Join(root, f)); err != nil { t.Errorf("%s: %v", f, err) }
+    }
+    if n, err := RemoveTempFiles(afero.NewOsFs(), root); err != nil || n != 0 {
+        t.Errorf("second run removed %d, %v", n, err)
+    }
+}
@@ -0,0 +1,136 @@
+package filesystem
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path"
+    "path/filepath"
+    "strings"
+
+    "github.com/spf13/afero"
+)
+
+// SaveAttachment stores the content of r as name inside the folder dir and
+// returns its path. When a file with the same content already exists in
+// dir, nothing is written and that file's path is returned with existed set.
+// A different file with the same name gets a numbered name instead.
+func (s *Service) SaveAttachment(dir, name string, r io.Reader) (relPath string, existed bool, err error) {
+    name = filepath.Base(filepath.Clean("/" + name))
+    if name == "/" || name == "." || strings.HasPrefix(name, ".") {
+        return "", false, errors.New("invalid file name")
+    }
+    dirAbs, err := s.abs(dir)
+    if err != nil {
+        return "", false, err
+    }
+    if err := s.ensureDir(dirAbs); err != nil {
+        return "", false, err
+    }
+
+    // Write to a temporary file while hashing; it is renamed into place or
+    // removed below
+    tmp, err := afero.TempFile(s.fs, dirAbs, TempPrefix+"*")
+    if err != nil {
+        return "", false, err
+    }
+    defer s.fs.Remove(tmp.Name())
+    h := sha256.New()
+    size, err := io.Copy(io.MultiWriter(tmp, h), r)
+    if err == nil {
+        err = tmp.Sync()
+    }
+    if cerr := tmp.Close(); err == nil {
+        err = cerr
+    }
+    if err != nil {
+        return "", false, err
+    }
+    hash := hex.EncodeToString(h.Sum(nil))
+
+    if existing, err := s.findByHash(dirAbs, size, hash); err != nil {
+        return "", false, err
+    } else if existing != "" {
+        return s.rel(existing), true, nil
+    }
+
+    target := s.rel(filepath.Join(dirAbs, name))
+    if _, err := s.Stat(target); err == nil {
+        if target, err = s.freePath(target); err != nil {
+            return "", false, err
+        }
+    }
+    targetAbs, err := s.abs(target)
+    if err != nil {
+        return "", false, err
+    }
+    if err := s.fs.Chmod(tmp.Name(), 0o644); err != nil {
+        return "", false, err
+    }
+    if err := s.fs.Rename(tmp.Name(), targetAbs); err != nil {
+        return "", false, err
+    }
+    syncDir(s.fs, dirAbs)
+    return target, false, nil
+}
+
+// findByHash returns a file directly inside dirAbs with the given size and
+// content hash, or "".
+func (s *Service) findByHash(dirAbs string, size int64, hash string) (string, error) {
+    entries, err := afero.ReadDir(s.fs, dirAbs)
+    if err != nil {
+        return "", err
+    }
+    for _, e := range entries {
+        if e.IsDir() || e.Size() != size || strings.HasPrefix(e.Name(), TempPrefix) {
+            continue
+        }
+        p := filepath.Join(dirAbs, e.Name())
+        sum, err := s.hashFile(p)
+        if err != nil {
+            continue
+        }
+        if sum == hash {
+            return p, nil
+        }
+    }
+    return "", nil
+}
+
+func (s *Service) hashFile(abs string) (string, error) {
+    f, err := s.fs.Open(abs)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+    h := sha256.New()
+    if _, err := io.Copy(h, f); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// OpenFile opens a file for raw reading, e.g. to stream it with
+// http.ServeContent. The caller closes it.
+func (s *Service) OpenFile(relPath string) (afero.File, os.FileInfo, error) {
+    abs, err := s.abs(relPath)
+    if err != nil {
+        return nil, nil, err
+    }
+    info, err := s.fs.Stat(abs)
+    if err != nil {
+        return nil, nil, err
+    }
+    if info.IsDir() {
+        return nil, nil, fmt.Errorf("%s: %w", path.Base(relPath), fs.ErrInvalid)
+    }
+    f, err := s.fs.Open(abs)
+    if err != nil {
+        return nil, nil, err
+    }
+    return f, info, nil
+}
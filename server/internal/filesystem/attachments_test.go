@@ -0,0 +1,56 @@
+package filesystem
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestSaveAttachment(t *testing.T) {
+    s := testService(t, map[string]string{"/other/pic.png": "one"})
+    save := func(dir, name, content string) (string, bool) {
+        t.Helper()
+        p, existed, err := s.SaveAttachment(dir, name, strings.NewReader(content))
+        if err != nil { t.Fatalf("save %s in %s: %v", name, dir, err) }
+        return p, existed
+    }
+
+    tests := []struct {
+        dir, name, content string
+        want               string
+        existed            bool
+    }{
+        {"/assets", "pic.png", "one", "/assets/pic.png", false},     // creates the folder
+        {"/assets", "copy.png", "one", "/assets/pic.png", true},     // same content, any name
+        {"/assets", "pic.png", "two", "/assets/pic 1.png", false},   // same name and size, new content
+        {"/assets", "pic.png", "three", "/assets/pic 2.png", false}, // next free number
+        {"/assets", "pic.png", "two", "/assets/pic 1.png", true},
+        {"/assets", "../../up.png", "four", "/assets/up.png", false}, // only the base name is used
+        {"/assets", "sub/notes", "five", "/assets/notes", false},
+        {"/other", "new.png", "one", "/other/pic.png", true}, // dedup looks in dir only
+        {"/", "pic.png", "one", "/pic.png", false},
+    }
+    for _, tt := range tests {
+        if p, existed := save(tt.dir, tt.name, tt.content); p != tt.want || existed != tt.existed {
+            t.Errorf("save %s in %s: %s, existed %v, want %s, %v", tt.name, tt.dir, p, existed, tt.want, tt.existed)
+        }
+    }
+    for p, content := range map[string]string{"/assets/pic.png": "one", "/assets/pic 1.png": "two", "/assets/pic 2.png": "three"} {
+        if got := read(t, s, p); got != content { t.Errorf("%s = %q, want %q", p, got, content) }
+    }
+
+    for _, name := range []string{"", ".", "/", ".hidden", "dir/.env"} {
+        if _, _, err := s.SaveAttachment("/assets", name, strings.NewReader("x")); err == nil {
+            t.Errorf("saved invalid name %q", name)
+        }
+    }
+
+    // No temporary files are left behind
+    entries, err := os.ReadDir(filepath.Join(s.root, "assets"))
+    if err != nil { t.Fatal(err) }
+    for _, e := range entries {
+        if strings.HasPrefix(e.Name(), TempPrefix) { t.Errorf("temporary file %s left", e.Name()) }
+    }
+    if len(entries) != 5 { t.Errorf("%d files in /assets, want 5", len(entries)) }
+}
@@ -0,0 +1,77 @@
+package filesystem
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "io/fs"
+    "strings"
+
+    "github.com/spf13/afero"
+)
+
+// ErrETagMismatch is returned by IfMatch when the path changed since the
+// client read it.
+var ErrETagMismatch = errors.New("path changed since it was read")
+
+// ContentETag returns the ETag of file content: a quoted hash prefix.
+func ContentETag(content []byte) string {
+    sum := sha256.Sum256(content)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// ETag returns the current ETag of a path. Files are tagged by content,
+// folders by modification time.
+func (s *Service) ETag(relPath string) (string, error) {
+    abs, err := s.abs(relPath)
+    if err != nil {
+        return "", err
+    }
+    info, err := s.fs.Stat(abs)
+    if err != nil {
+        return "", err
+    }
+    if info.IsDir() {
+        return fmt.Sprintf(`"d-%x"`, info.ModTime().UnixNano()), nil
+    }
+    b, err := afero.ReadFile(s.fs, abs)
+    if err != nil {
+        return "", err
+    }
+    return ContentETag(b), nil
+}
+
+// IfMatch runs fn if ifMatch, the value of an If-Match header, matches the
+// current ETag of relPath. An empty ifMatch always matches; "*" matches any
+// existing path. Checks and fn are serialized so two guarded writes cannot
+// both pass the check.
+func (s *Service) IfMatch(relPath, ifMatch string, fn func() error) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if ifMatch = strings.TrimSpace(ifMatch); ifMatch != "" {
+        current, err := s.ETag(relPath)
+        if errors.Is(err, fs.ErrNotExist) {
+            return ErrETagMismatch
+        }
+        if err != nil {
+            return err
+        }
+        if !etagMatches(ifMatch, current) {
+            return ErrETagMismatch
+        }
+    }
+    return fn()
+}
+
+// etagMatches compares an If-Match list against an ETag. Weak tags compare
+// by value.
+func etagMatches(ifMatch, current string) bool {
+    for _, tag := range strings.Split(ifMatch, ",") {
+        tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+        if tag == "*" || tag == current {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,124 @@
+package filesystem
+
+import (
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestETag(t *testing.T) {
+    s := testService(t, map[string]string{"/a.md": "same", "/dir/b.md": "same"})
+    a, err := s.ETag("/a.md")
+    if err != nil { t.Fatal(err) }
+    if b, _ := s.ETag("/dir/b.md"); a != ContentETag([]byte("same")) || b != a {
+        t.Errorf("file etags %s, %s, want %s", a, b, ContentETag([]byte("same")))
+    }
+    if ContentETag([]byte("other")) == a { t.Error("different content, same etag") }
+
+    // Folders are tagged by modification time
+    dir, err := s.ETag("/dir")
+    if err != nil { t.Fatal(err) }
+    if dir == a || dir[:3] != `"d-` { t.Errorf("folder etag %s", dir) }
+    later := time.Now().Add(time.Hour)
+    if err := os.Chtimes(filepath.Join(s.root, "dir"), later, later); err != nil { t.Fatal(err) }
+    if changed, _ := s.ETag("/dir"); changed == dir { t.Error("folder etag unchanged after its mtime changed") }
+
+    if _, err := s.ETag("/missing.md"); !errors.Is(err, fs.ErrNotExist) { t.Errorf("missing path: %v", err) }
+}
+
+func TestIfMatch(t *testing.T) {
+    s := testService(t, map[string]string{"/a.md": "a"})
+    current := ContentETag([]byte("a"))
+    stale := ContentETag([]byte("old"))
+    tests := []struct {
+        path, ifMatch string
+        want          error
+    }{
+        {"/a.md", "", nil},
+        {"/missing.md", "", nil},
+        {"/a.md", current, nil},
+        {"/a.md", " " + current + " ", nil},
+        {"/a.md", "W/" + current, nil},
+        {"/a.md", stale + ", " + current, nil},
+        {"/a.md", "*", nil},
+        {"/a.md", stale, ErrETagMismatch},
+        {"/a.md", stale + ", W/" + stale, ErrETagMismatch},
+        {"/a.md", current[1 : len(current)-1], ErrETagMismatch}, // unquoted
+        {"/missing.md", "*", ErrETagMismatch},
+        {"/missing.md", current, ErrETagMismatch},
+    }
+    for _, tt := range tests {
+        ran := false
+        err := s.IfMatch(tt.path, tt.ifMatch, func() error { ran = true; return nil })
+        if err != tt.want || ran != (tt.want == nil) {
+            t.Errorf("IfMatch(%s, %q) = %v, ran %v, want %v", tt.path, tt.ifMatch, err, ran, tt.want)
+        }
+    }
+
+    // The error of fn is returned as is
+    errFn := errors.New("fn failed")
+    if err := s.IfMatch("/a.md", current, func() error { return errFn }); err != errFn {
+        t.Errorf("IfMatch returned %v, want the error of fn", err)
+    }
+}
+
+func TestMovePath(t *testing.T) {
+    files := map[string]string{"/a.md": "a", "/b.md": "b"}
+
+    t.Run("free target", func(t *testing.T) {
+        s := testService(t, files)
+        replaced, err := s.MovePath("/a.md", "/dir/c.md", "", "", false)
+        if err != nil || replaced != nil { t.Fatalf("move: %+v, %v", replaced, err) }
+        if got := read(t, s, "/dir/c.md"); got != "a" { t.Errorf("moved content %q", got) }
+    })
+
+    t.Run("existing target", func(t *testing.T) {
+        s := testService(t, files)
+        _, err := s.MovePath("/a.md", "/b.md", "", "", false)
+        var target *fs.PathError
+        if !errors.Is(err, ErrConflict) || !errors.As(err, &target) || target.Path != "/b.md" {
+            t.Fatalf("move onto /b.md: %v, want ErrConflict for /b.md", err)
+        }
+        if read(t, s, "/a.md") != "a" || read(t, s, "/b.md") != "b" { t.Error("files changed") }
+    })
+
+    t.Run("stale target etag", func(t *testing.T) {
+        s := testService(t, files)
+        _, err := s.MovePath("/a.md", "/b.md", "", ContentETag([]byte("old b")), false)
+        var target *fs.PathError
+        if !errors.Is(err, ErrETagMismatch) || !errors.As(err, &target) {
+            t.Fatalf("move with stale ifMatchTo: %v", err)
+        }
+    })
+
+    t.Run("stale source etag", func(t *testing.T) {
+        s := testService(t, files)
+        _, err := s.MovePath("/a.md", "/c.md", ContentETag([]byte("old a")), "", false)
+        var target *fs.PathError
+        if !errors.Is(err, ErrETagMismatch) || errors.As(err, &target) {
+            t.Fatalf("move with stale If-Match: %v", err)
+        }
+    })
+
+    for name, move := range map[string]func(*Service) (*TrashItem, error){
+        "overwrite": func(s *Service) (*TrashItem, error) { return s.MovePath("/a.md", "/b.md", "", "", true) },
+        "target etag": func(s *Service) (*TrashItem, error) {
+            return s.MovePath("/a.md", "/b.md", ContentETag([]byte("a")), `"x", `+ContentETag([]byte("b")), false)
+        },
+    } {
+        t.Run(name, func(t *testing.T) {
+            s := testService(t, files)
+            replaced, err := move(s)
+            if err != nil || replaced == nil || replaced.Path != "/b.md" { t.Fatalf("move: %+v, %v", replaced, err) }
+            if got := read(t, s, "/b.md"); got != "a" { t.Errorf("/b.md = %q", got) }
+            if _, err := s.Stat("/a.md"); !errors.Is(err, os.ErrNotExist) { t.Errorf("/a.md still there: %v", err) }
+            // The replaced file can be brought back from the trash
+            if p, err := s.RestoreTrash(replaced.ID, ConflictRename); err != nil || read(t, s, p) != "b" {
+                t.Errorf("restore replaced: %q, %v", p, err)
+            }
+        })
+    }
+}
@@ -3,44 +3,61 @@ package filesystem
 import (
     "errors"
     "io/fs"
+    "log"
     "mime"
+    "os"
     "path/filepath"
-    "sort"
     "strings"
+    "sync"
 
     "github.com/spf13/afero"
+    "obsidianfs/internal/ignore"
+    "obsidianfs/internal/safepath"
 )
 
 type Service struct {
-    fs   afero.Fs
-    root string
+    fs       afero.Fs
+    root     string
+    resolver *safepath.Resolver
+    ignore   *ignore.Matcher
+    history  History
+    mu       sync.Mutex // serializes IfMatch checks
+}
+
+// History records versions of the files written through the Service.
+type History interface {
+    Has(relPath string) bool
+    Snapshot(relPath string, content []byte, source string) error
+    Move(oldRel, newRel string) error
+    // Skip tells the history that content is about to be written to
+    // relPath without a version, so the watcher event for it records none.
+    Skip(relPath string, content []byte)
 }
 
 type Node struct {
-    Name     string  `json:"name"`
-    Path     string  `json:"path"`
-    Type     string  `json:"type"` // file | folder
-    FileType string  `json:"fileType,omitempty"`
-    Children []Node  `json:"children,omitempty"`
+    Name       string `json:"name"`
+    Path       string `json:"path"`
+    Type       string `json:"type"` // file | folder
+    FileType   string `json:"fileType,omitempty"`
+    Size       int64  `json:"size,omitempty"`       // files only
+    ModTime    int64  `json:"mtime,omitempty"`      // unix milliseconds
+    ChildCount *int   `json:"childCount,omitempty"` // folders only
+    TagCount   int    `json:"tagCount,omitempty"`   // filled in by the API
+    Children   []Node `json:"children,omitempty"`
+    NextCursor string `json:"nextCursor,omitempty"` // set when Children was cut off by a limit
 }
 
-func NewService(root string) (*Service, error) {
+// NewService creates the file service for the root of resolver, which
+// checks every path the service touches. history may be nil.
+func NewService(resolver *safepath.Resolver, ignore *ignore.Matcher, history History) (*Service, error) {
     afs := afero.NewOsFs()
-    return &Service{fs: afs, root: root}, nil
+    return &Service{fs: afs, root: resolver.Root(), resolver: resolver, ignore: ignore, history: history}, nil
 }
 
+// abs maps a vault path ("/folder/file.md") to the filesystem, refusing
+// paths that escape the vault.
 func (s *Service) abs(rel string) (string, error) {
-    if rel == "" || rel == "/" {
-        return s.root, nil
-    }
-    clean := filepath.Clean(rel)
-    if strings.HasPrefix(clean, "..") {
-        return "", errors.New("invalid path")
-    }
-    if strings.HasPrefix(clean, s.root) {
-        return clean, nil
-    }
-    return filepath.Join(s.root, strings.TrimPrefix(clean, "/")), nil
+    return s.resolver.Resolve(rel)
 }
 
 func (s *Service) rel(abs string) string {
@@ -64,61 +81,37 @@ func (s *Service) detectFileType(name string) string {
         return "html"
     case ".js", ".ts", ".tsx", ".jsx", ".go", ".py", ".rs", ".java":
         return "code"
+    case ".pdf":
+        return "pdf"
+    case ".png", ".jpg", ".jpeg", ".gif", ".bmp", ".svg", ".webp", ".avif", ".ico":
+        return "image"
+    case ".mp3", ".wav", ".m4a", ".ogg", ".oga", ".flac", ".aac", ".3gp":
+        return "audio"
+    case ".mp4", ".webm", ".ogv", ".mov", ".mkv":
+        return "video"
     default:
         // try mime
-        if mt := mime.TypeByExtension(ext); strings.Contains(mt, "text/") {
+        mt := mime.TypeByExtension(ext)
+        switch {
+        case strings.HasPrefix(mt, "image/"):
+            return "image"
+        case strings.HasPrefix(mt, "audio/"):
+            return "audio"
+        case strings.HasPrefix(mt, "video/"):
+            return "video"
+        case strings.Contains(mt, "text/"):
             return "code"
         }
         return "file"
     }
 }
 
-func (s *Service) ListTree(relPath string, depth int) (Node, error) {
+func (s *Service) Stat(relPath string) (os.FileInfo, error) {
     abs, err := s.abs(relPath)
     if err != nil {
-        return Node{}, err
-    }
-    info, err := afero.ReadDir(s.fs, abs)
-    if err != nil && !errors.Is(err, fs.ErrNotExist) {
-        return Node{}, err
-    }
-    // Create node for the directory itself
-    dirName := filepath.Base(abs)
-    if relPath == "" || relPath == "/" {
-        dirName = "root"
-    }
-    node := Node{Name: dirName, Path: s.rel(abs), Type: "folder"}
-    // Sort: folders first, then files, by name
-    sort.Slice(info, func(i, j int) bool {
-        if info[i].IsDir() && !info[j].IsDir() {
-            return true
-        }
-        if !info[i].IsDir() && info[j].IsDir() {
-            return false
-        }
-        return strings.ToLower(info[i].Name()) < strings.ToLower(info[j].Name())
-    })
-    for _, entry := range info {
-        entryAbs := filepath.Join(abs, entry.Name())
-        if entry.IsDir() {
-            child := Node{Name: entry.Name(), Path: s.rel(entryAbs), Type: "folder"}
-            if depth != 0 {
-                sub, err := s.ListTree(s.rel(entryAbs), depth-1)
-                if err == nil {
-                    child.Children = sub.Children
-                }
-            }
-            node.Children = append(node.Children, child)
-            continue
-        }
-        node.Children = append(node.Children, Node{
-            Name:     entry.Name(),
-            Path:     s.rel(entryAbs),
-            Type:     "file",
-            FileType: s.detectFileType(entry.Name()),
-        })
+        return nil, err
     }
-    return node, nil
+    return s.fs.Stat(abs)
 }
 
 func (s *Service) ReadFile(relPath string) (string, error) {
@@ -138,12 +131,61 @@ func (s *Service) WriteFile(relPath string, content string) error {
     if err != nil {
         return err
     }
-    if err := afero.WriteFile(s.fs, abs, []byte(content), 0o644); err != nil {
+    rel := s.rel(abs)
+    if s.history != nil && !s.history.Has(rel) {
+        // Keep what was there before the first tracked write
+        if prev, err := afero.ReadFile(s.fs, abs); err == nil {
+            _ = s.history.Snapshot(rel, prev, "initial")
+        }
+    }
+    if err := WriteFileAtomic(s.fs, abs, []byte(content), 0o644); err != nil {
+        return err
+    }
+    s.snapshot(rel, content)
+    return nil
+}
+
+// WriteFileUnversioned writes a file like WriteFile but records no version
+// of the new content, for frequent saves such as those of collaborative
+// sessions; RecordVersion records one when it matters.
+func (s *Service) WriteFileUnversioned(relPath string, content string) error {
+    abs, err := s.abs(relPath)
+    if err != nil {
+        return err
+    }
+    rel := s.rel(abs)
+    if s.history != nil {
+        if !s.history.Has(rel) {
+            if prev, err := afero.ReadFile(s.fs, abs); err == nil {
+                _ = s.history.Snapshot(rel, prev, "initial")
+            }
+        }
+        s.history.Skip(rel, []byte(content))
+    }
+    return WriteFileAtomic(s.fs, abs, []byte(content), 0o644)
+}
+
+// RecordVersion records content as a version of relPath written through
+// the API.
+func (s *Service) RecordVersion(relPath string, content string) error {
+    abs, err := s.abs(relPath)
+    if err != nil {
         return err
     }
+    s.snapshot(s.rel(abs), content)
     return nil
 }
 
+// snapshot records a version of a file written through the Service.
+func (s *Service) snapshot(rel, content string) {
+    if s.history == nil {
+        return
+    }
+    if err := s.history.Snapshot(rel, []byte(content), "api"); err != nil {
+        log.Printf("history snapshot %s: %v", rel, err)
+    }
+}
+
 func (s *Service) CreateFile(relPath, content string) error {
     abs, err := s.abs(relPath)
     if err != nil {
@@ -152,7 +194,11 @@ func (s *Service) CreateFile(relPath, content string) error {
     if err := s.ensureDir(filepath.Dir(abs)); err != nil {
         return err
     }
-    return afero.WriteFile(s.fs, abs, []byte(content), 0o644)
+    if err := WriteFileAtomic(s.fs, abs, []byte(content), 0o644); err != nil {
+        return err
+    }
+    s.snapshot(s.rel(abs), content)
+    return nil
 }
 
 func (s *Service) CreateFolder(relPath string) error {
@@ -187,6 +233,59 @@ func (s *Service) RenamePath(oldRel, newRel string) error {
     if err := s.ensureDir(filepath.Dir(newAbs)); err != nil {
         return err
     }
-    return s.fs.Rename(oldAbs, newAbs)
+    if err := s.fs.Rename(oldAbs, newAbs); err != nil {
+        return err
+    }
+    if s.history != nil {
+        if err := s.history.Move(s.rel(oldAbs), s.rel(newAbs)); err != nil {
+            log.Printf("history move %s: %v", oldRel, err)
+        }
+    }
+    return nil
+}
+
+// MovePath renames oldRel to newRel if ifMatch (as in IfMatch) matches
+// oldRel. An existing newRel is only replaced when overwrite is set or
+// ifMatchTo matches its current ETag; otherwise MovePath fails with
+// ErrConflict or ErrETagMismatch wrapped in an *fs.PathError for newRel.
+// What it replaces is moved to the trash and returned.
+func (s *Service) MovePath(oldRel, newRel, ifMatch, ifMatchTo string, overwrite bool) (*TrashItem, error) {
+    var replaced *TrashItem
+    err := s.IfMatch(oldRel, ifMatch, func() error {
+        oldInfo, err := s.Stat(oldRel)
+        if err != nil {
+            return err
+        }
+        newInfo, err := s.Stat(newRel)
+        // A case-only rename on a case-insensitive disk finds the source
+        if err == nil && !os.SameFile(oldInfo, newInfo) {
+            if ifMatchTo = strings.TrimSpace(ifMatchTo); ifMatchTo != "" {
+                current, err := s.ETag(newRel)
+                if err != nil {
+                    return err
+                }
+                if !etagMatches(ifMatchTo, current) {
+                    return &fs.PathError{Op: "move", Path: newRel, Err: ErrETagMismatch}
+                }
+            } else if !overwrite {
+                return &fs.PathError{Op: "move", Path: newRel, Err: ErrConflict}
+            }
+            if replaced, err = s.TrashPath(newRel); err != nil {
+                return err
+            }
+        } else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+        if err := s.RenamePath(oldRel, newRel); err != nil {
+            if replaced != nil {
+                // Bring the replaced target back
+                _, _ = s.RestoreTrash(replaced.ID, ConflictFail)
+                replaced = nil
+            }
+            return err
+        }
+        return nil
+    })
+    return replaced, err
 }
 
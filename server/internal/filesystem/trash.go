@@ -0,0 +1,228 @@
+package filesystem
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "log"
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/spf13/afero"
+    "obsidianfs/internal/utils"
+)
+
+// TrashDir is the folder under the vault root that holds deleted items. Each
+// item is stored as .trash/<id>/<name> with its metadata in .trash/<id>.json.
+const TrashDir = ".trash"
+
+// Restore conflict policies: what to do when the original path is taken.
+const (
+    ConflictFail      = "fail"
+    ConflictRename    = "rename"
+    ConflictOverwrite = "overwrite"
+)
+
+// ErrConflict is returned by RestoreTrash when the original path exists and
+// the policy is ConflictFail.
+var ErrConflict = errors.New("path already exists")
+
+type TrashItem struct {
+    ID        string    `json:"id"`
+    Path      string    `json:"path"` // original path, e.g. "/folder/file.md"
+    Type      string    `json:"type"` // file | folder
+    DeletedAt time.Time `json:"deletedAt"`
+}
+
+func (s *Service) trashRoot() string {
+    return filepath.Join(s.root, TrashDir)
+}
+
+// TrashPath moves a file or folder into the trash instead of removing it.
+func (s *Service) TrashPath(relPath string) (*TrashItem, error) {
+    abs, err := s.abs(relPath)
+    if err != nil {
+        return nil, err
+    }
+    rel := s.rel(abs)
+    if rel == "/" || rel == "/"+TrashDir || strings.HasPrefix(rel, "/"+TrashDir+"/") {
+        return nil, errors.New("invalid path")
+    }
+    info, err := s.fs.Stat(abs)
+    if err != nil {
+        return nil, err
+    }
+
+    item := &TrashItem{ID: utils.GenerateID(), Path: rel, Type: "file", DeletedAt: time.Now().UTC()}
+    if info.IsDir() {
+        item.Type = "folder"
+    }
+    dir := filepath.Join(s.trashRoot(), item.ID)
+    if err := s.ensureDir(dir); err != nil {
+        return nil, err
+    }
+    if err := s.fs.Rename(abs, filepath.Join(dir, filepath.Base(abs))); err != nil {
+        _ = s.fs.Remove(dir)
+        return nil, err
+    }
+    b, _ := json.MarshalIndent(item, "", "  ")
+    if err := afero.WriteFile(s.fs, dir+".json", b, 0o644); err != nil {
+        return nil, err
+    }
+    return item, nil
+}
+
+// ListTrash returns the trashed items, most recently deleted first.
+func (s *Service) ListTrash() ([]TrashItem, error) {
+    entries, err := afero.ReadDir(s.fs, s.trashRoot())
+    if err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return []TrashItem{}, nil
+        }
+        return nil, err
+    }
+    items := []TrashItem{}
+    for _, e := range entries {
+        if e.IsDir() || filepath.Ext(e.Name()) != ".json" {
+            continue
+        }
+        item, err := s.trashItem(strings.TrimSuffix(e.Name(), ".json"))
+        if err != nil {
+            continue
+        }
+        items = append(items, *item)
+    }
+    sort.Slice(items, func(i, j int) bool { return items[i].DeletedAt.After(items[j].DeletedAt) })
+    return items, nil
+}
+
+func (s *Service) trashItem(id string) (*TrashItem, error) {
+    if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+        return nil, errors.New("invalid trash id")
+    }
+    b, err := afero.ReadFile(s.fs, filepath.Join(s.trashRoot(), id+".json"))
+    if err != nil {
+        return nil, err
+    }
+    var item TrashItem
+    if err := json.Unmarshal(b, &item); err != nil {
+        return nil, err
+    }
+    return &item, nil
+}
+
+// RestoreTrash moves a trashed item back to its original path and returns
+// the path it was restored to. conflict decides what happens when that path
+// is taken: fail (ErrConflict), rename (pick a free name) or overwrite, which
+// moves what is there to the trash first.
+func (s *Service) RestoreTrash(id, conflict string) (string, error) {
+    item, err := s.trashItem(id)
+    if err != nil {
+        return "", err
+    }
+    target := item.Path
+    var replaced *TrashItem
+    if _, err := s.Stat(target); err == nil {
+        switch conflict {
+        case ConflictRename:
+            if target, err = s.freePath(target); err != nil {
+                return "", err
+            }
+        case ConflictOverwrite:
+            if replaced, err = s.TrashPath(target); err != nil {
+                return "", err
+            }
+        default:
+            return target, ErrConflict
+        }
+    }
+
+    targetAbs, err := s.abs(target)
+    if err != nil {
+        return "", err
+    }
+    if err := s.ensureDir(filepath.Dir(targetAbs)); err != nil {
+        return "", err
+    }
+    dir := filepath.Join(s.trashRoot(), id)
+    if err := s.fs.Rename(filepath.Join(dir, path.Base(item.Path)), targetAbs); err != nil {
+        if replaced != nil {
+            // Put back what was there
+            _, _ = s.RestoreTrash(replaced.ID, ConflictFail)
+        }
+        return "", err
+    }
+    _ = s.fs.RemoveAll(dir)
+    _ = s.fs.Remove(dir + ".json")
+    return target, nil
+}
+
+// freePath returns the first of "name 1.ext", "name 2.ext", ... that does
+// not exist.
+func (s *Service) freePath(rel string) (string, error) {
+    ext := path.Ext(rel)
+    base := strings.TrimSuffix(rel, ext)
+    for i := 1; i < 1000; i++ {
+        candidate := fmt.Sprintf("%s %d%s", base, i, ext)
+        if _, err := s.Stat(candidate); errors.Is(err, fs.ErrNotExist) {
+            return candidate, nil
+        }
+    }
+    return "", ErrConflict
+}
+
+// PurgeTrash permanently deletes one trashed item.
+func (s *Service) PurgeTrash(id string) error {
+    if _, err := s.trashItem(id); err != nil {
+        return err
+    }
+    dir := filepath.Join(s.trashRoot(), id)
+    if err := s.fs.RemoveAll(dir); err != nil {
+        return err
+    }
+    return s.fs.Remove(dir + ".json")
+}
+
+// EmptyTrash permanently deletes items deleted more than olderThan ago, or
+// every item when olderThan is 0. It returns the number of items removed.
+func (s *Service) EmptyTrash(olderThan time.Duration) (int, error) {
+    items, err := s.ListTrash()
+    if err != nil {
+        return 0, err
+    }
+    cutoff := time.Now().Add(-olderThan)
+    n := 0
+    for _, item := range items {
+        if olderThan > 0 && item.DeletedAt.After(cutoff) {
+            continue
+        }
+        if err := s.PurgeTrash(item.ID); err != nil {
+            return n, err
+        }
+        n++
+    }
+    return n, nil
+}
+
+// RunTrashRetention empties items older than maxAge every interval until
+// stop is closed. It is meant to run in its own goroutine.
+func (s *Service) RunTrashRetention(maxAge, interval time.Duration, stop <-chan struct{}) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        if n, err := s.EmptyTrash(maxAge); err != nil {
+            log.Printf("trash retention: %v", err)
+        } else if n > 0 {
+            log.Printf("trash retention: purged %d item(s)", n)
+        }
+        select {
+        case <-ticker.C:
+        case <-stop:
+            return
+        }
+    }
+}
@@ -0,0 +1,131 @@
+package filesystem
+
+import (
+    "errors"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "obsidianfs/internal/safepath"
+)
+
+// testService returns a Service for a vault in a temporary directory
+// holding files, given by vault path with their content.
+func testService(t *testing.T, files map[string]string) *Service {
+    t.Helper()
+    root, err := filepath.EvalSymlinks(t.TempDir())
+    if err != nil { t.Fatal(err) }
+    for p, content := range files {
+        abs := filepath.Join(root, filepath.FromSlash(p))
+        if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil { t.Fatal(err) }
+        if err := os.WriteFile(abs, []byte(content), 0o644); err != nil { t.Fatal(err) }
+    }
+    resolver, err := safepath.New(root, safepath.SymlinkInside)
+    if err != nil { t.Fatal(err) }
+    s, err := NewService(resolver, nil, nil)
+    if err != nil { t.Fatal(err) }
+    return s
+}
+
+func read(t *testing.T, s *Service, p string) string {
+    t.Helper()
+    content, err := s.ReadFile(p)
+    if err != nil { t.Fatalf("read %s: %v", p, err) }
+    return content
+}
+
+func TestTrashRoundTrip(t *testing.T) {
+    s := testService(t, map[string]string{"/dir/a.md": "a", "/dir/sub/b.md": "b"})
+    file, err := s.TrashPath("/dir/a.md")
+    if err != nil { t.Fatal(err) }
+    folder, err := s.TrashPath("/dir")
+    if err != nil { t.Fatal(err) }
+    if file.Type != "file" || folder.Type != "folder" || folder.Path != "/dir" {
+        t.Errorf("items %+v, %+v", file, folder)
+    }
+    if _, err := s.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+        t.Errorf("/dir still there: %v", err)
+    }
+    items, err := s.ListTrash()
+    if err != nil || len(items) != 2 {
+        t.Fatalf("trash %+v, %v", items, err)
+    }
+
+    if p, err := s.RestoreTrash(folder.ID, ConflictFail); err != nil || p != "/dir" {
+        t.Fatalf("restore folder: %q, %v", p, err)
+    }
+    if p, err := s.RestoreTrash(file.ID, ConflictFail); err != nil || p != "/dir/a.md" {
+        t.Fatalf("restore file: %q, %v", p, err)
+    }
+    if read(t, s, "/dir/a.md") != "a" || read(t, s, "/dir/sub/b.md") != "b" {
+        t.Error("restored content differs")
+    }
+    if items, _ := s.ListTrash(); len(items) != 0 {
+        t.Errorf("trash not empty: %+v", items)
+    }
+}
+
+func TestTrashRefusesRootAndTrash(t *testing.T) {
+    s := testService(t, map[string]string{"/a.md": "a"})
+    for _, p := range []string{"/", "/" + TrashDir, "/" + TrashDir + "/x"} {
+        if _, err := s.TrashPath(p); err == nil {
+            t.Errorf("TrashPath(%q) succeeded", p)
+        }
+    }
+    if _, err := s.RestoreTrash("../a", ConflictFail); err == nil {
+        t.Error("restore of an invalid id succeeded")
+    }
+}
+
+func TestRestoreConflicts(t *testing.T) {
+    s := testService(t, map[string]string{"/a.md": "old"})
+    item, err := s.TrashPath("/a.md")
+    if err != nil { t.Fatal(err) }
+    if err := s.WriteFile("/a.md", "new"); err != nil { t.Fatal(err) }
+
+    if _, err := s.RestoreTrash(item.ID, ConflictFail); !errors.Is(err, ErrConflict) {
+        t.Fatalf("fail policy: %v, want %v", err, ErrConflict)
+    }
+    p, err := s.RestoreTrash(item.ID, ConflictRename)
+    if err != nil || p != "/a 1.md" || read(t, s, "/a 1.md") != "old" || read(t, s, "/a.md") != "new" {
+        t.Fatalf("rename policy: %q, %v", p, err)
+    }
+
+    // Overwriting keeps the replaced file in the trash
+    item, err = s.TrashPath("/a 1.md")
+    if err != nil { t.Fatal(err) }
+    if err := s.WriteFile("/a 1.md", "newer"); err != nil { t.Fatal(err) }
+    if p, err := s.RestoreTrash(item.ID, ConflictOverwrite); err != nil || p != "/a 1.md" {
+        t.Fatalf("overwrite policy: %q, %v", p, err)
+    }
+    if got := read(t, s, "/a 1.md"); got != "old" {
+        t.Errorf("restored %q, want %q", got, "old")
+    }
+    items, err := s.ListTrash()
+    if err != nil || len(items) != 1 || items[0].Path != "/a 1.md" {
+        t.Fatalf("trash %+v, %v", items, err)
+    }
+    if _, err := s.RestoreTrash(items[0].ID, ConflictRename); err != nil {
+        t.Fatal(err)
+    }
+    if got := read(t, s, "/a 1 1.md"); got != "newer" {
+        t.Errorf("replaced file restored as %q, want %q", got, "newer")
+    }
+}
+
+func TestEmptyTrash(t *testing.T) {
+    s := testService(t, map[string]string{"/a.md": "a", "/b.md": "b"})
+    for _, p := range []string{"/a.md", "/b.md"} {
+        if _, err := s.TrashPath(p); err != nil { t.Fatal(err) }
+    }
+    if n, err := s.EmptyTrash(time.Hour); err != nil || n != 0 {
+        t.Errorf("EmptyTrash(1h) = %d, %v, want 0", n, err)
+    }
+    if n, err := s.EmptyTrash(0); err != nil || n != 2 {
+        t.Errorf("EmptyTrash(0) = %d, %v, want 2", n, err)
+    }
+    if items, _ := s.ListTrash(); len(items) != 0 {
+        t.Errorf("trash not empty: %+v", items)
+    }
+}
@@ -0,0 +1,259 @@
+package filesystem
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/spf13/afero"
+)
+
+// OrderFile is the sidecar file holding the custom order of a folder's
+// entries: a JSON array of names. Names not listed follow, sorted by name.
+const OrderFile = ".obsidianfs-order.json"
+
+// Sort keys of a tree listing.
+const (
+    SortName   = "name"
+    SortMTime  = "mtime"
+    SortSize   = "size"
+    SortCustom = "custom"
+)
+
+// TreeOptions control ListTreeWith.
+type TreeOptions struct {
+    // Depth is how many levels below the direct children are expanded;
+    // 0 lists only the direct children, a negative value everything.
+    Depth int
+    // Sort is one of the Sort* keys (default SortName) and Desc reverses
+    // it. Folders always come before files.
+    Sort string
+    Desc bool
+    // Limit caps the direct children returned (0 means no limit); the
+    // node's NextCursor then continues the listing when passed as Cursor.
+    Limit  int
+    Cursor string
+}
+
+// ListTree lists relPath with its entries sorted by name, expanding depth
+// levels below the direct children.
+func (s *Service) ListTree(relPath string, depth int) (Node, error) {
+    return s.ListTreeWith(relPath, TreeOptions{Depth: depth})
+}
+
+// ListTreeWith lists the folder relPath. Ignored entries and entries the
+// resolver refuses are left out.
+func (s *Service) ListTreeWith(relPath string, opts TreeOptions) (Node, error) {
+    switch opts.Sort {
+    case "":
+        opts.Sort = SortName
+    case SortName, SortMTime, SortSize, SortCustom:
+    default:
+        return Node{}, fmt.Errorf("unknown sort %q", opts.Sort)
+    }
+    offset := 0
+    if opts.Cursor != "" {
+        n, err := strconv.Atoi(opts.Cursor)
+        if err != nil || n < 0 {
+            return Node{}, fmt.Errorf("invalid cursor %q", opts.Cursor)
+        }
+        offset = n
+    }
+    abs, err := s.abs(relPath)
+    if err != nil {
+        return Node{}, err
+    }
+    dirName := filepath.Base(abs)
+    if relPath == "" || relPath == "/" {
+        dirName = "root"
+    }
+    node := Node{Name: dirName, Path: s.rel(abs), Type: "folder"}
+    if info, err := s.fs.Stat(abs); err == nil {
+        node.ModTime = info.ModTime().UnixMilli()
+    }
+
+    entries, err := s.entries(abs, opts)
+    if err != nil {
+        return Node{}, err
+    }
+    count := len(entries)
+    node.ChildCount = &count
+    if offset > len(entries) {
+        offset = len(entries)
+    }
+    entries = entries[offset:]
+    if opts.Limit > 0 && len(entries) > opts.Limit {
+        entries = entries[:opts.Limit]
+        node.NextCursor = strconv.Itoa(offset + opts.Limit)
+    }
+
+    sub := opts
+    sub.Depth, sub.Limit, sub.Cursor = opts.Depth-1, 0, ""
+    for _, entry := range entries {
+        entryAbs := filepath.Join(abs, entry.Name())
+        if !entry.IsDir() {
+            node.Children = append(node.Children, Node{
+                Name:     entry.Name(),
+                Path:     s.rel(entryAbs),
+                Type:     "file",
+                FileType: s.detectFileType(entry.Name()),
+                Size:     entry.Size(),
+                ModTime:  entry.ModTime().UnixMilli(),
+            })
+            continue
+        }
+        if opts.Depth != 0 {
+            child, err := s.ListTreeWith(s.rel(entryAbs), sub)
+            if err == nil {
+                node.Children = append(node.Children, child)
+                continue
+            }
+        }
+        child := Node{
+            Name:    entry.Name(),
+            Path:    s.rel(entryAbs),
+            Type:    "folder",
+            ModTime: entry.ModTime().UnixMilli(),
+        }
+        if n, err := s.countEntries(entryAbs); err == nil {
+            child.ChildCount = &n
+        }
+        node.Children = append(node.Children, child)
+    }
+    return node, nil
+}
+
+// entries returns the visible entries of the directory abs in listing
+// order. A missing directory has none.
+func (s *Service) entries(abs string, opts TreeOptions) ([]os.FileInfo, error) {
+    all, err := afero.ReadDir(s.fs, abs)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
+    entries := all[:0]
+    for _, entry := range all {
+        if s.visible(abs, entry) {
+            entries = append(entries, entry)
+        }
+    }
+
+    var rank map[string]int
+    if opts.Sort == SortCustom {
+        rank = make(map[string]int)
+        for i, name := range s.readOrder(abs) {
+            if _, ok := rank[name]; !ok {
+                rank[name] = i
+            }
+        }
+    }
+    byName := func(a, b os.FileInfo) bool {
+        return strings.ToLower(a.Name()) < strings.ToLower(b.Name())
+    }
+    less := func(a, b os.FileInfo) bool {
+        switch opts.Sort {
+        case SortMTime:
+            if !a.ModTime().Equal(b.ModTime()) {
+                return a.ModTime().Before(b.ModTime())
+            }
+        case SortSize:
+            if !a.IsDir() && a.Size() != b.Size() {
+                return a.Size() < b.Size()
+            }
+        case SortCustom:
+            ra, oka := rank[a.Name()]
+            rb, okb := rank[b.Name()]
+            if oka != okb {
+                return oka
+            }
+            if oka {
+                return ra < rb
+            }
+        }
+        return byName(a, b)
+    }
+    sort.SliceStable(entries, func(i, j int) bool {
+        a, b := entries[i], entries[j]
+        if a.IsDir() != b.IsDir() {
+            return a.IsDir()
+        }
+        if opts.Desc {
+            return less(b, a)
+        }
+        return less(a, b)
+    })
+    return entries, nil
+}
+
+func (s *Service) visible(dirAbs string, entry os.FileInfo) bool {
+    entryAbs := filepath.Join(dirAbs, entry.Name())
+    return entry.Name() != OrderFile &&
+        !s.ignore.MatchAbs(entryAbs, entry.IsDir()) &&
+        s.resolver.Check(entryAbs) == nil
+}
+
+// countEntries returns the number of visible entries in the directory abs.
+func (s *Service) countEntries(abs string) (int, error) {
+    all, err := afero.ReadDir(s.fs, abs)
+    if err != nil {
+        return 0, err
+    }
+    n := 0
+    for _, entry := range all {
+        if s.visible(abs, entry) {
+            n++
+        }
+    }
+    return n, nil
+}
+
+// readOrder returns the custom order of the directory abs, or nil.
+func (s *Service) readOrder(abs string) []string {
+    b, err := afero.ReadFile(s.fs, filepath.Join(abs, OrderFile))
+    if err != nil {
+        return nil
+    }
+    var names []string
+    if json.Unmarshal(b, &names) != nil {
+        return nil
+    }
+    return names
+}
+
+// SetOrder stores the custom order of the folder relPath. An empty list
+// removes it.
+func (s *Service) SetOrder(relPath string, names []string) error {
+    abs, err := s.abs(relPath)
+    if err != nil {
+        return err
+    }
+    info, err := s.fs.Stat(abs)
+    if err != nil {
+        return err
+    }
+    if !info.IsDir() {
+        return fmt.Errorf("%s: not a folder", relPath)
+    }
+    orderAbs := filepath.Join(abs, OrderFile)
+    if len(names) == 0 {
+        if err := s.fs.Remove(orderAbs); err != nil && !errors.Is(err, fs.ErrNotExist) {
+            return err
+        }
+        return nil
+    }
+    for _, name := range names {
+        if name == "" || strings.ContainsAny(name, `/\`) {
+            return fmt.Errorf("invalid name %q in order", name)
+        }
+    }
+    b, err := json.Marshal(names)
+    if err != nil {
+        return err
+    }
+    return WriteFileAtomic(s.fs, orderAbs, b, 0o644)
+}
@@ -0,0 +1,140 @@
+package filesystem
+
+import (
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func childNames(node Node) []string {
+    var names []string
+    for _, child := range node.Children {
+        names = append(names, child.Name)
+    }
+    return names
+}
+
+// testTree returns a vault with two folders and three files of different
+// sizes and modification times.
+func testTree(t *testing.T) *Service {
+    t.Helper()
+    s := testService(t, map[string]string{
+        "/A.md":     "aaaaaaaaaa",
+        "/b.md":     "bbb",
+        "/c.txt":    "c",
+        "/dir/x.md": "x",
+        "/Sub/y.md": "y",
+        "/Sub/z.md": "z",
+    })
+    base := time.Now().Add(-time.Hour)
+    for i, name := range []string{"c.txt", "A.md", "b.md", "Sub", "dir"} {
+        mtime := base.Add(time.Duration(i) * time.Minute)
+        if err := os.Chtimes(filepath.Join(s.root, name), mtime, mtime); err != nil { t.Fatal(err) }
+    }
+    return s
+}
+
+func TestListTreeSort(t *testing.T) {
+    s := testTree(t)
+    if err := s.SetOrder("/", []string{"c.txt", "Sub", "missing"}); err != nil { t.Fatal(err) }
+
+    tests := []struct {
+        sort string
+        desc bool
+        want []string
+    }{
+        {"", false, []string{"dir", "Sub", "A.md", "b.md", "c.txt"}},
+        {SortName, true, []string{"Sub", "dir", "c.txt", "b.md", "A.md"}},
+        {SortMTime, false, []string{"Sub", "dir", "c.txt", "A.md", "b.md"}},
+        {SortMTime, true, []string{"dir", "Sub", "b.md", "A.md", "c.txt"}},
+        {SortSize, false, []string{"dir", "Sub", "c.txt", "b.md", "A.md"}}, // folders by name
+        {SortCustom, false, []string{"Sub", "dir", "c.txt", "A.md", "b.md"}},
+        {SortCustom, true, []string{"dir", "Sub", "b.md", "A.md", "c.txt"}},
+    }
+    for _, tt := range tests {
+        node, err := s.ListTreeWith("/", TreeOptions{Sort: tt.sort, Desc: tt.desc})
+        if err != nil { t.Fatal(err) }
+        if got := childNames(node); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("sort %q desc %v: %q, want %q", tt.sort, tt.desc, got, tt.want)
+        }
+        // The order file is not listed
+        if *node.ChildCount != 5 { t.Errorf("sort %q: child count %d", tt.sort, *node.ChildCount) }
+    }
+
+    if _, err := s.ListTreeWith("/", TreeOptions{Sort: "color"}); err == nil { t.Error("unknown sort accepted") }
+}
+
+func TestListTreeCursor(t *testing.T) {
+    s := testTree(t)
+    var pages [][]string
+    cursor := ""
+    for {
+        node, err := s.ListTreeWith("/", TreeOptions{Limit: 2, Cursor: cursor})
+        if err != nil { t.Fatal(err) }
+        if *node.ChildCount != 5 { t.Errorf("child count %d on page %d", *node.ChildCount, len(pages)) }
+        pages = append(pages, childNames(node))
+        if cursor = node.NextCursor; cursor == "" || len(pages) > 5 {
+            break
+        }
+    }
+    want := [][]string{{"dir", "Sub"}, {"A.md", "b.md"}, {"c.txt"}}
+    if !reflect.DeepEqual(pages, want) { t.Errorf("pages %q, want %q", pages, want) }
+
+    if node, err := s.ListTreeWith("/", TreeOptions{Cursor: "9"}); err != nil || len(node.Children) != 0 || node.NextCursor != "" {
+        t.Errorf("cursor past the end: %+v, %v", node, err)
+    }
+    for _, cursor := range []string{"x", "-1"} {
+        if _, err := s.ListTreeWith("/", TreeOptions{Cursor: cursor}); err == nil { t.Errorf("cursor %q accepted", cursor) }
+    }
+
+    // The limit applies to the listed folder only, not to expanded ones
+    node, err := s.ListTreeWith("/", TreeOptions{Depth: 1, Limit: 2})
+    if err != nil { t.Fatal(err) }
+    if sub := node.Children[1]; !reflect.DeepEqual(childNames(sub), []string{"y.md", "z.md"}) || sub.NextCursor != "" {
+        t.Errorf("expanded folder %+v", sub)
+    }
+}
+
+func TestListTreeDepth(t *testing.T) {
+    s := testTree(t)
+    node, err := s.ListTree("/", 0)
+    if err != nil { t.Fatal(err) }
+    dir := node.Children[0]
+    if dir.Name != "dir" || dir.Children != nil || dir.ChildCount == nil || *dir.ChildCount != 1 {
+        t.Errorf("lazy folder %+v", dir)
+    }
+    if file := node.Children[2]; file.Type != "file" || file.Size != 10 || file.ModTime == 0 || file.Path != "/A.md" {
+        t.Errorf("file %+v", file)
+    }
+
+    node, err = s.ListTree("/", 1)
+    if err != nil { t.Fatal(err) }
+    if dir := node.Children[0]; !reflect.DeepEqual(childNames(dir), []string{"x.md"}) || dir.Path != "/dir" {
+        t.Errorf("expanded folder %+v", dir)
+    }
+
+    // A missing folder lists as empty
+    if node, err := s.ListTree("/missing", 0); err != nil || *node.ChildCount != 0 {
+        t.Errorf("missing folder: %+v, %v", node, err)
+    }
+}
+
+func TestSetOrder(t *testing.T) {
+    s := testTree(t)
+    for _, names := range [][]string{{""}, {"a/b"}, {`a\b`}} {
+        if err := s.SetOrder("/", names); err == nil { t.Errorf("order %q accepted", names) }
+    }
+    if err := s.SetOrder("/A.md", []string{"x"}); err == nil { t.Error("order set on a file") }
+
+    if err := s.SetOrder("/", []string{"b.md"}); err != nil { t.Fatal(err) }
+    if err := s.SetOrder("/", nil); err != nil { t.Fatal(err) }
+    if _, err := os.Stat(filepath.Join(s.root, OrderFile)); !os.IsNotExist(err) { t.Errorf("order file kept: %v", err) }
+    // Without an order file custom sorting is by name
+    node, err := s.ListTreeWith("/", TreeOptions{Sort: SortCustom})
+    if err != nil { t.Fatal(err) }
+    if got := childNames(node); !reflect.DeepEqual(got, []string{"dir", "Sub", "A.md", "b.md", "c.txt"}) {
+        t.Errorf("custom sort without an order: %q", got)
+    }
+}
@@ -2,51 +2,102 @@ package filesystem
 
 import (
     "log"
+    "os"
     "path/filepath"
+    "strings"
+    "time"
 
     "github.com/fsnotify/fsnotify"
-    "obsidianfs/internal/tags"
+    "obsidianfs/internal/ignore"
     "obsidianfs/internal/ws"
 )
 
+// DefaultDebounce is the window in which raw events for one path are coalesced.
+const DefaultDebounce = 200 * time.Millisecond
+
+// Listener receives filesystem changes. absPath is absolute; action is one of
+// created | modified | deleted | renamed (renamed carries the old path).
+type Listener interface {
+    OnFsEvent(action string, absPath string)
+}
+
+// RenameListener is implemented by listeners that can move their state when a
+// path is renamed, instead of receiving renamed(old) followed by created(new).
+type RenameListener interface {
+    OnFsRename(fromAbs string, toAbs string)
+}
+
+// pending is a coalesced change for one path that has not been emitted yet.
+type pending struct {
+    kind  string // created | modified | deleted | renamed
+    from  string // for a paired rename, the old absolute path
+    moved bool   // renamed away but not yet paired with a create
+    gen   int
+    timer *time.Timer
+}
+
+type fired struct {
+    path string
+    gen  int
+}
+
 type Watcher struct {
-    root    string
-    watcher *fsnotify.Watcher
-    hub     *ws.Hub
-    indexer *tags.Indexer
+    root      string
+    watcher   *fsnotify.Watcher
+    hub       *ws.Hub
+    listeners []Listener
+    debounce  time.Duration
+    ignore    *ignore.Matcher
+
+    // Only touched by the Run goroutine
+    dirs       map[string]bool
+    files      map[string]bool // files known to exist, to tell a replace from a create
+    pending    map[string]*pending
+    lastRename string
+    gen        int
+    fire       chan fired
+    done       chan struct{} // closed when Run returns
 }
 
-func NewWatcher(root string, hub *ws.Hub, indexer *tags.Indexer) (*Watcher, error) {
+// NewWatcher creates a watcher for every directory under root that is not
+// ignored. Events for a path are coalesced within the debounce window
+// (DefaultDebounce if <= 0). Changes to the ignore file reload it.
+func NewWatcher(root string, hub *ws.Hub, debounce time.Duration, ignore *ignore.Matcher, listeners ...Listener) (*Watcher, error) {
     w, err := fsnotify.NewWatcher()
     if err != nil {
         return nil, err
     }
-    return &Watcher{root: root, watcher: w, hub: hub, indexer: indexer}, nil
+    if debounce <= 0 {
+        debounce = DefaultDebounce
+    }
+    return &Watcher{
+        root:      root,
+        watcher:   w,
+        hub:       hub,
+        listeners: listeners,
+        debounce:  debounce,
+        ignore:    ignore,
+        dirs:      make(map[string]bool),
+        files:     make(map[string]bool),
+        pending:   make(map[string]*pending),
+        fire:      make(chan fired, 64),
+        done:      make(chan struct{}),
+    }, nil
 }
 
 func (w *Watcher) Run() {
-    // Watch root recursively by adding directories on the fly
-    _ = w.watcher.Add(w.root)
+    defer w.stopTimers()
+    w.addTree(w.root)
     for {
         select {
         case evt, ok := <-w.watcher.Events:
             if !ok { return }
-            rel := "/"
-            if p, err := filepath.Rel(w.root, evt.Name); err == nil {
-                rel = "/" + filepath.ToSlash(p)
-            }
-            kind := "modified"
-            if evt.Op&fsnotify.Create == fsnotify.Create { kind = "created" }
-            if evt.Op&fsnotify.Remove == fsnotify.Remove { kind = "deleted" }
-            if evt.Op&fsnotify.Rename == fsnotify.Rename { kind = "renamed" }
-            w.hub.Broadcast(ws.Event{Type: "fs", Action: kind, Path: rel})
-            if w.indexer != nil {
-                // events provide absolute path in evt.Name
-                w.indexer.OnFsEvent(kind, evt.Name)
-            }
-            // Add new directory watches
-            if evt.Op&fsnotify.Create == fsnotify.Create {
-                _ = w.watcher.Add(evt.Name)
+            w.handle(evt)
+        case f := <-w.fire:
+            if p, ok := w.pending[f.path]; ok && p.gen == f.gen {
+                delete(w.pending, f.path)
+                if w.lastRename == f.path { w.lastRename = "" }
+                w.emit(f.path, p)
             }
         case err, ok := <-w.watcher.Errors:
             if !ok { return }
@@ -57,3 +108,196 @@ func (w *Watcher) Run() {
 
 func (w *Watcher) Close() error { return w.watcher.Close() }
 
+// stopTimers cancels the debounce timers of the changes not emitted yet.
+func (w *Watcher) stopTimers() {
+    close(w.done)
+    for _, p := range w.pending {
+        p.timer.Stop()
+    }
+}
+
+// addTree watches dir and every directory below it, and records the files
+// in them.
+func (w *Watcher) addTree(dir string) {
+    _ = filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+        if err != nil { return nil }
+        if !d.IsDir() {
+            if !w.ignore.MatchAbs(p, false) { w.files[p] = true }
+            return nil
+        }
+        if p != w.root && w.ignore.MatchAbs(p, true) { return filepath.SkipDir }
+        if err := w.watcher.Add(p); err != nil {
+            log.Printf("fsnotify watch %s: %v", p, err)
+            return nil
+        }
+        w.dirs[p] = true
+        return nil
+    })
+}
+
+// removeTree stops watching dir and every directory below it, and forgets
+// the files in them; dir may be a file.
+func (w *Watcher) removeTree(dir string) {
+    delete(w.files, dir)
+    if !w.dirs[dir] { return }
+    prefix := dir + string(filepath.Separator)
+    for p := range w.dirs {
+        if p == dir || strings.HasPrefix(p, prefix) {
+            _ = w.watcher.Remove(p)
+            delete(w.dirs, p)
+        }
+    }
+    for p := range w.files {
+        if strings.HasPrefix(p, prefix) { delete(w.files, p) }
+    }
+}
+
+// handle merges a raw fsnotify event into the pending change for its path.
+func (w *Watcher) handle(evt fsnotify.Event) {
+    path := evt.Name
+    // fsnotify reports a moved watched directory a second time with no name
+    if path == "" || w.ignored(path) { return }
+    p := w.pending[path]
+    switch {
+    case evt.Op&fsnotify.Create == fsnotify.Create:
+        // A rename over a file replaces it without removing it first
+        replaced := w.files[path]
+        if info, err := os.Stat(path); err == nil && info.IsDir() {
+            w.addTree(path)
+        } else if err == nil {
+            w.files[path] = true
+        }
+        // A create right after a rename is the other half of a move
+        if old := w.lastRename; old != "" && old != path {
+            w.lastRename = ""
+            if src := w.pending[old]; src != nil && src.moved {
+                if replaced {
+                    // Saved atomically over path: old is gone, path changed
+                    w.schedule(old, &pending{kind: "deleted"})
+                    if p == nil || p.kind != "created" {
+                        p = &pending{kind: "modified"}
+                    }
+                    w.schedule(path, p)
+                    return
+                }
+                w.drop(old)
+                w.schedule(path, &pending{kind: "renamed", from: old})
+                return
+            }
+        }
+        switch {
+        case p == nil && replaced:
+            p = &pending{kind: "modified"}
+        case p == nil:
+            p = &pending{kind: "created"}
+        case p.kind == "deleted" || p.moved:
+            // Replaced in place, e.g. an editor's atomic save
+            p = &pending{kind: "modified"}
+            if w.lastRename == path { w.lastRename = "" }
+        }
+    case evt.Op&fsnotify.Remove == fsnotify.Remove, evt.Op&fsnotify.Rename == fsnotify.Rename:
+        w.removeTree(path)
+        rename := evt.Op&fsnotify.Rename == fsnotify.Rename
+        switch {
+        case p != nil && p.kind == "created":
+            // Appeared and vanished within the window: nothing to report
+            w.drop(path)
+            if w.lastRename == path { w.lastRename = "" }
+            return
+        case rename:
+            p = &pending{kind: "renamed", moved: true}
+            w.lastRename = path
+        case p != nil && p.from != "":
+            // Moved here and then deleted: the old path is what disappeared
+            w.drop(path)
+            w.schedule(p.from, &pending{kind: "deleted"})
+            return
+        default:
+            p = &pending{kind: "deleted"}
+        }
+    default: // Write, Chmod
+        if p == nil {
+            p = &pending{kind: "modified"}
+        }
+    }
+    w.schedule(path, p)
+}
+
+// schedule (re)starts the debounce timer for path.
+func (w *Watcher) schedule(path string, p *pending) {
+    if old := w.pending[path]; old != nil && old != p {
+        old.timer.Stop()
+    }
+    w.gen++
+    p.gen = w.gen
+    w.pending[path] = p
+    f := fired{path: path, gen: p.gen}
+    p.timer = time.AfterFunc(w.debounce, func() {
+        select {
+        case w.fire <- f:
+        case <-w.done:
+        }
+    })
+}
+
+// drop forgets the pending change for path.
+func (w *Watcher) drop(path string) {
+    if p := w.pending[path]; p != nil {
+        p.timer.Stop()
+        delete(w.pending, path)
+    }
+}
+
+// ignored reports whether events for path should be dropped. A path that no
+// longer exists is matched both as a file and as a directory.
+func (w *Watcher) ignored(path string) bool {
+    if info, err := os.Stat(path); err == nil {
+        return w.ignore.MatchAbs(path, info.IsDir())
+    }
+    return w.ignore.MatchAbs(path, false) || w.ignore.MatchAbs(path, true)
+}
+
+// reloadIgnore re-reads the ignore file and re-creates the directory watches
+// so newly ignored directories are dropped and re-included ones are added.
+func (w *Watcher) reloadIgnore() {
+    if err := w.ignore.Reload(); err != nil {
+        log.Printf("reload %s: %v", ignore.FileName, err)
+    }
+    w.removeTree(w.root)
+    w.addTree(w.root)
+}
+
+func (w *Watcher) rel(abs string) string {
+    if p, err := filepath.Rel(w.root, abs); err == nil {
+        return "/" + filepath.ToSlash(p)
+    }
+    return "/"
+}
+
+// emit broadcasts a coalesced change and passes it to the listeners.
+func (w *Watcher) emit(path string, p *pending) {
+    if w.ignore.IsIgnoreFile(path) || w.ignore.IsIgnoreFile(p.from) {
+        w.reloadIgnore()
+    }
+    if p.kind == "renamed" && p.from == "" {
+        // Moved out of the tree
+        p.kind = "deleted"
+    }
+    if p.kind == "renamed" {
+        from, to := w.rel(p.from), w.rel(path)
+        w.hub.Broadcast(ws.Event{Type: "fs", Action: "renamed", Path: to, From: from, To: to})
+        for _, l := range w.listeners {
+            if rl, ok := l.(RenameListener); ok {
+                rl.OnFsRename(p.from, path)
+                continue
+            }
+            l.OnFsEvent("renamed", p.from)
+            l.OnFsEvent("created", path)
+        }
+        return
+    }
+    w.hub.Broadcast(ws.Event{Type: "fs", Action: p.kind, Path: w.rel(path)})
+    for _, l := range w.listeners {
+        l.OnFsEvent(p.kind, path)
+    }
+}
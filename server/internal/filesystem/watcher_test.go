@@ -0,0 +1,127 @@
+package filesystem
+
+import (
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+
+    "obsidianfs/internal/ws"
+)
+
+// recorder is a Listener keeping the events it gets, with paths relative
+// to root.
+type recorder struct {
+    root   string
+    mu     sync.Mutex
+    events []string
+}
+
+func (r *recorder) OnFsEvent(action, absPath string) {
+    rel, _ := filepath.Rel(r.root, absPath)
+    r.mu.Lock()
+    r.events = append(r.events, action+" "+filepath.ToSlash(rel))
+    r.mu.Unlock()
+}
+
+// watch runs a watcher on a temporary directory holding files and returns
+// the directory, the recorder and a function stopping the watcher.
+func watch(t *testing.T, files ...string) (string, *recorder, func()) {
+    t.Helper()
+    root, err := filepath.EvalSymlinks(t.TempDir())
+    if err != nil { t.Fatal(err) }
+    for _, f := range files {
+        if err := os.WriteFile(filepath.Join(root, f), []byte("old"), 0o644); err != nil { t.Fatal(err) }
+    }
+    rec := &recorder{root: root}
+    w, err := NewWatcher(root, ws.NewHub(), 20*time.Millisecond, nil, rec)
+    if err != nil { t.Fatal(err) }
+    done := make(chan struct{})
+    go func() {
+        w.Run()
+        close(done)
+    }()
+    // Let Run add the watches
+    time.Sleep(50 * time.Millisecond)
+    return root, rec, func() {
+        w.Close()
+        <-done
+    }
+}
+
+// settle waits for the debounce window to pass and returns the events.
+func (r *recorder) settle() []string {
+    time.Sleep(200 * time.Millisecond)
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return append([]string(nil), r.events...)
+}
+
+func expect(t *testing.T, got []string, want ...string) {
+    t.Helper()
+    if len(got) != len(want) {
+        t.Fatalf("events %q, want %q", got, want)
+    }
+    seen := map[string]int{}
+    for _, e := range got { seen[e]++ }
+    for _, e := range want {
+        if seen[e]--; seen[e] < 0 {
+            t.Fatalf("events %q, want %q", got, want)
+        }
+    }
+}
+
+func TestWatcherAtomicSave(t *testing.T) {
+    root, rec, stop := watch(t, "note.md")
+    defer stop()
+    tmp := filepath.Join(root, "note.md.tmp")
+    if err := os.WriteFile(tmp, []byte("new"), 0o644); err != nil { t.Fatal(err) }
+    if err := os.Rename(tmp, filepath.Join(root, "note.md")); err != nil { t.Fatal(err) }
+    expect(t, rec.settle(), "modified note.md")
+}
+
+func TestWatcherRenameOverTrackedFile(t *testing.T) {
+    root, rec, stop := watch(t, "a.md", "b.md")
+    defer stop()
+    if err := os.Rename(filepath.Join(root, "a.md"), filepath.Join(root, "b.md")); err != nil { t.Fatal(err) }
+    expect(t, rec.settle(), "deleted a.md", "modified b.md")
+}
+
+func TestWatcherRenameAndCreate(t *testing.T) {
+    root, rec, stop := watch(t, "a.md")
+    defer stop()
+    if err := os.Rename(filepath.Join(root, "a.md"), filepath.Join(root, "c.md")); err != nil { t.Fatal(err) }
+    if err := os.WriteFile(filepath.Join(root, "d.md"), []byte("x"), 0o644); err != nil { t.Fatal(err) }
+    expect(t, rec.settle(), "renamed a.md", "created c.md", "created d.md")
+    // c.md is tracked now: saving over it is a modification
+    if err := os.WriteFile(filepath.Join(root, "c.tmp"), []byte("y"), 0o644); err != nil { t.Fatal(err) }
+    if err := os.Rename(filepath.Join(root, "c.tmp"), filepath.Join(root, "c.md")); err != nil { t.Fatal(err) }
+    expect(t, rec.settle()[3:], "modified c.md")
+}
+
+// TestWatcherStopsTimers checks that the debounce timers of changes still
+// pending when Run returns are stopped.
+func TestWatcherStopsTimers(t *testing.T) {
+    root := t.TempDir()
+    w, err := NewWatcher(root, ws.NewHub(), time.Hour, nil)
+    if err != nil { t.Fatal(err) }
+    done := make(chan struct{})
+    go func() {
+        w.Run()
+        close(done)
+    }()
+    time.Sleep(50 * time.Millisecond)
+    if err := os.WriteFile(filepath.Join(root, "late.md"), []byte("x"), 0o644); err != nil { t.Fatal(err) }
+    time.Sleep(50 * time.Millisecond)
+    w.Close()
+    <-done
+    if len(w.pending) == 0 {
+        t.Fatal("no pending change")
+    }
+    for path, p := range w.pending {
+        if p.timer.Stop() {
+            t.Errorf("timer for %s still running", path)
+        }
+    }
+}
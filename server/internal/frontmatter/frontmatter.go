@@ -0,0 +1,213 @@
+// Package frontmatter reads the YAML properties at the top of a markdown
+// file, between a leading --- line and the next --- or ... line.
+package frontmatter
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Property types, as used by the attributes table.
+const (
+	TypeText     = "text"
+	TypeNumber   = "number"
+	TypeCheckbox = "checkbox"
+	TypeDate     = "date"
+	TypeDateTime = "datetime"
+	TypeLink     = "link"
+	TypeList     = "list"
+	TypeObject   = "object"
+)
+
+// Frontmatter is the parsed YAML of a file.
+type Frontmatter struct {
+	// Root is the top-level mapping.
+	Root *yaml.Node
+
+	content string
+	lines   []int // byte offset of each line of the YAML text in content
+}
+
+// Property is one top-level key with its value in a form that sorts and
+// compares as the type suggests: numbers in decimal, dates as
+// 2006-01-02[T15:04:05[Z]], lists and objects as JSON.
+type Property struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// Parse returns the frontmatter of content, or nil when there is none or
+// it is not a YAML mapping.
+func Parse(content string) *Frontmatter {
+	start, end, lines := split(content)
+	if end < 0 {
+		return nil
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content[start:end]), &doc); err != nil {
+		return nil
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	return &Frontmatter{Root: doc.Content[0], content: content, lines: lines}
+}
+
+// Length returns the number of bytes of the frontmatter block of content,
+// with its --- lines, whether or not it is valid YAML; 0 when there is
+// none.
+func Length(content string) int {
+	_, end, _ := split(content)
+	if end < 0 {
+		return 0
+	}
+	if k := strings.IndexByte(content[end:], '\n'); k >= 0 {
+		return end + k + 1
+	}
+	return len(content)
+}
+
+// split finds the YAML text of content[start:end] and the offsets of its
+// lines; end is -1 when content has no frontmatter.
+func split(content string) (start, end int, lines []int) {
+	first, _, ok := strings.Cut(content, "\n")
+	if !ok || strings.TrimRight(first, "\r") != "---" {
+		return 0, -1, nil
+	}
+	start = len(first) + 1
+	for off := start; off < len(content); {
+		line := content[off:]
+		if k := strings.IndexByte(line, '\n'); k >= 0 {
+			line = line[:k]
+		}
+		if t := strings.TrimRight(line, "\r"); t == "---" || t == "..." {
+			return start, off, lines
+		}
+		lines = append(lines, off)
+		off += len(line) + 1
+	}
+	return 0, -1, nil
+}
+
+// Offset returns the byte offset in the file of where n starts, which for a
+// quoted scalar is the opening quote.
+func (f *Frontmatter) Offset(n *yaml.Node) int {
+	if n.Line < 1 || n.Line > len(f.lines) {
+		return -1
+	}
+	off := f.lines[n.Line-1]
+	for col := 1; col < n.Column && off < len(f.content); col++ {
+		_, size := utf8.DecodeRuneInString(f.content[off:])
+		off += size
+	}
+	return off
+}
+
+// Get returns the value of key, matched case-insensitively, or nil.
+func (f *Frontmatter) Get(key string) *yaml.Node {
+	for i := 0; i+1 < len(f.Root.Content); i += 2 {
+		if strings.EqualFold(f.Root.Content[i].Value, key) {
+			return f.Root.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// Properties returns the top-level keys with their typed values. A key
+// given twice keeps its first value.
+func (f *Frontmatter) Properties() []Property {
+	var out []Property
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(f.Root.Content); i += 2 {
+		name := f.Root.Content[i].Value
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		typ, value := typed(f.Root.Content[i+1])
+		out = append(out, Property{Name: name, Type: typ, Value: value})
+	}
+	return out
+}
+
+// dateLayouts are the date and time forms recognized in strings, besides
+// the ones YAML resolves as timestamps.
+var dateLayouts = []string{"2006-01-02", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02 15:04:05", time.RFC3339}
+
+func typed(n *yaml.Node) (string, string) {
+	if n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	switch n.Kind {
+	case yaml.SequenceNode:
+		// An unquoted [[Note]] reads as a list in a list
+		if len(n.Content) == 1 && n.Content[0].Kind == yaml.SequenceNode && len(n.Content[0].Content) == 1 &&
+			n.Content[0].Content[0].Kind == yaml.ScalarNode {
+			return TypeLink, "[[" + n.Content[0].Content[0].Value + "]]"
+		}
+		items := make([]string, 0, len(n.Content))
+		for _, item := range n.Content {
+			if _, v := typed(item); v != "" {
+				items = append(items, v)
+			}
+		}
+		b, _ := json.Marshal(items)
+		return TypeList, string(b)
+	case yaml.MappingNode:
+		var v any
+		if err := n.Decode(&v); err == nil {
+			if b, err := json.Marshal(v); err == nil {
+				return TypeObject, string(b)
+			}
+		}
+		return TypeObject, "{}"
+	}
+	switch n.ShortTag() {
+	case "!!null":
+		return TypeText, ""
+	case "!!bool":
+		var b bool
+		if n.Decode(&b) == nil {
+			return TypeCheckbox, strconv.FormatBool(b)
+		}
+	case "!!int", "!!float":
+		var f float64
+		if n.Decode(&f) == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return TypeNumber, strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	case "!!timestamp":
+		var t time.Time
+		if n.Decode(&t) == nil {
+			return formatTime(t, n.Value)
+		}
+	}
+	v := strings.TrimSpace(n.Value)
+	if strings.HasPrefix(v, "[[") && strings.HasSuffix(v, "]]") && !strings.Contains(v[2:len(v)-2], "]]") {
+		return TypeLink, v
+	}
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return formatTime(t, v)
+		}
+	}
+	return TypeText, n.Value
+}
+
+// formatTime writes t as a date when raw has no time of day, keeping the
+// zone only when raw gave one.
+func formatTime(t time.Time, raw string) (string, string) {
+	if !strings.ContainsAny(raw, "Tt :") {
+		return TypeDate, t.Format("2006-01-02")
+	}
+	if len(raw) > 10 && strings.ContainsAny(raw[10:], "Zz+-") {
+		return TypeDateTime, t.UTC().Format(time.RFC3339)
+	}
+	return TypeDateTime, t.Format("2006-01-02T15:04:05")
+}
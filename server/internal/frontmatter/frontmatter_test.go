@@ -0,0 +1,136 @@
+package frontmatter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		keys    int // -1 when there is no frontmatter
+		length  int
+	}{
+		{"no frontmatter", "# Title\n\ntitle: x", -1, 0},
+		{"empty file", "", -1, 0},
+		{"only a rule", "---", -1, 0},
+		{"unclosed", "---\ntitle: x\n", -1, 0},
+		{"not at the start", "\n---\ntitle: x\n---\n", -1, 0},
+		{"invalid yaml", "---\ntitle: [x\n---\nbody", -1, 18},
+		{"not a mapping", "---\n- a\n- b\n---\n", -1, 16},
+		{"empty", "---\n---\nbody", -1, 8},
+		{"mapping", "---\ntitle: x\nn: 1\n---\nbody", 2, 22},
+		{"dots end it", "---\ntitle: x\n...\nbody", 1, 17},
+		{"crlf", "---\r\ntitle: x\r\n---\r\nbody", 1, 20},
+		{"ends the file", "---\ntitle: x\n---", 1, 16},
+	}
+	for _, tt := range tests {
+		fm := Parse(tt.content)
+		switch {
+		case tt.keys < 0 && fm != nil:
+			t.Errorf("%s: parsed %d keys", tt.name, len(fm.Root.Content)/2)
+		case tt.keys >= 0 && (fm == nil || len(fm.Root.Content)/2 != tt.keys):
+			t.Errorf("%s: got %v, want %d keys", tt.name, fm, tt.keys)
+		}
+		if n := Length(tt.content); n != tt.length {
+			t.Errorf("%s: Length %d, want %d", tt.name, n, tt.length)
+		}
+	}
+}
+
+func TestProperties(t *testing.T) {
+	content := `---
+title: Note
+empty:
+count: 3
+ratio: 1.50
+big: .inf
+done: true
+day: 2024-01-02
+quoted day: "2024-03-04"
+stamp: 2024-01-02T10:30:00Z
+offset: 2024-01-02T10:30:00+02:00
+local: 2024-01-02 10:30
+related: "[[Other]]"
+up: [[Index]]
+tags: [a, b, ~, a]
+numbers:
+  - 1
+  - 2.0
+meta:
+  author: Me
+  n: 1
+  inner: {deep: [x]}
+items:
+  - {a: 1}
+  - [y, z]
+base: &b 5
+copy: *b
+Title: case differs
+title: again
+---
+body`
+	fm := Parse(content)
+	if fm == nil {
+		t.Fatal("no frontmatter")
+	}
+	want := []Property{
+		{"title", TypeText, "Note"},
+		{"empty", TypeText, ""},
+		{"count", TypeNumber, "3"},
+		{"ratio", TypeNumber, "1.5"},
+		{"big", TypeText, ".inf"},
+		{"done", TypeCheckbox, "true"},
+		{"day", TypeDate, "2024-01-02"},
+		{"quoted day", TypeDate, "2024-03-04"},
+		{"stamp", TypeDateTime, "2024-01-02T10:30:00Z"},
+		{"offset", TypeDateTime, "2024-01-02T08:30:00Z"},
+		{"local", TypeDateTime, "2024-01-02T10:30:00"},
+		{"related", TypeLink, "[[Other]]"},
+		{"up", TypeLink, "[[Index]]"},
+		{"tags", TypeList, `["a","b","a"]`},
+		{"numbers", TypeList, `["1","2"]`},
+		{"meta", TypeObject, `{"author":"Me","inner":{"deep":["x"]},"n":1}`},
+		{"items", TypeList, `["{\"a\":1}","[\"y\",\"z\"]"]`},
+		{"base", TypeNumber, "5"},
+		{"copy", TypeNumber, "5"},
+		{"Title", TypeText, "case differs"},
+	}
+	got := fm.Properties()
+	if !reflect.DeepEqual(got, want) {
+		for i := range max(len(got), len(want)) {
+			var g, w Property
+			if i < len(got) {
+				g = got[i]
+			}
+			if i < len(want) {
+				w = want[i]
+			}
+			if g != w {
+				t.Errorf("property %d: %+v, want %+v", i, g, w)
+			}
+		}
+	}
+}
+
+func TestGetAndOffset(t *testing.T) {
+	content := "---\nTitle: plain\nключ: \"quoted\"\n---\n"
+	fm := Parse(content)
+	if fm == nil {
+		t.Fatal("no frontmatter")
+	}
+	if n := fm.Get("title"); n == nil || n.Value != "plain" {
+		t.Errorf("Get(title) = %v", n)
+	}
+	if n := fm.Get("missing"); n != nil {
+		t.Errorf("Get(missing) = %v", n)
+	}
+	if off := fm.Offset(fm.Get("title")); content[off:off+5] != "plain" {
+		t.Errorf("offset of plain: %d", off)
+	}
+	// Columns count characters, and a quoted value starts at its quote
+	if off := fm.Offset(fm.Get("ключ")); content[off:off+8] != `"quoted"` {
+		t.Errorf("offset of quoted: %d", off)
+	}
+}
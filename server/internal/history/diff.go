@@ -0,0 +1,137 @@
+package history
+
+import (
+	"fmt"
+	"strings"
+
+	"obsidianfs/internal/myers"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+type opKind byte
+
+const (
+	opEqual  opKind = ' '
+	opDelete opKind = '-'
+	opInsert opKind = '+'
+)
+
+type op struct {
+	kind opKind
+	a, b int // line index in a (equal, delete) and b (equal, insert)
+}
+
+// UnifiedDiff returns the unified diff between two texts, labelled with
+// aName and bName. It is empty when the texts are equal.
+func UnifiedDiff(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	al, bl := splitLines(a), splitLines(b)
+	ops := diffLines(al, bl)
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+	for start := 0; start < len(ops); {
+		// Find the next change
+		for start < len(ops) && ops[start].kind == opEqual {
+			start++
+		}
+		if start == len(ops) {
+			break
+		}
+		// Extend the hunk while changes are within 2*context of each other
+		lo := max(start-diffContext, 0)
+		end := start
+		for {
+			for end < len(ops) && ops[end].kind != opEqual {
+				end++
+			}
+			next := end
+			for next < len(ops) && ops[next].kind == opEqual {
+				next++
+			}
+			if next == len(ops) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		hi := min(end+diffContext, len(ops))
+		writeHunk(&out, ops[lo:hi], al, bl)
+		start = hi
+	}
+	return out.String()
+}
+
+func writeHunk(out *strings.Builder, ops []op, al, bl []string) {
+	aStart, bStart, aLen, bLen := -1, -1, 0, 0
+	for _, o := range ops {
+		if o.kind != opInsert {
+			if aStart < 0 {
+				aStart = o.a
+			}
+			aLen++
+		}
+		if o.kind != opDelete {
+			if bStart < 0 {
+				bStart = o.b
+			}
+			bLen++
+		}
+	}
+	// An empty range is written as the line before it
+	if aStart < 0 {
+		aStart = ops[0].a - 1
+	}
+	if bStart < 0 {
+		bStart = ops[0].b - 1
+	}
+	fmt.Fprintf(out, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+	for _, o := range ops {
+		line := ""
+		if o.kind == opInsert {
+			line = bl[o.b]
+		} else {
+			line = al[o.a]
+		}
+		out.WriteByte(byte(o.kind))
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(start, n int) string {
+	if n == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// splitLines splits s after each newline, keeping the newlines.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes a shortest edit script. Insert and delete ops carry
+// the position in the other text as well, so hunk headers can be computed
+// for pure insertions or deletions.
+func diffLines(a, b []string) []op {
+	kinds := map[myers.Kind]opKind{myers.Equal: opEqual, myers.Delete: opDelete, myers.Insert: opInsert}
+	edits := myers.Diff(len(a), len(b), func(i, j int) bool { return a[i] == b[j] })
+	ops := make([]op, len(edits))
+	for i, e := range edits {
+		ops[i] = op{kind: kinds[e.Kind], a: e.A, b: e.B}
+	}
+	return ops
+}
@@ -0,0 +1,62 @@
+package history
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{
+			"change in the middle",
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			"--- a\n+++ b\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"insert into empty",
+			"",
+			"x\n",
+			"--- a\n+++ b\n@@ -0,0 +1 @@\n+x\n",
+		},
+		{
+			"missing final newline",
+			"a\nb",
+			"a\nc",
+			"--- a\n+++ b\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			"two hunks",
+			strings.Repeat("x\n", 3) + "old\n" + strings.Repeat("y\n", 10) + "gone\n",
+			strings.Repeat("x\n", 3) + "new\n" + strings.Repeat("y\n", 10),
+			"--- a\n+++ b\n@@ -1,7 +1,7 @@\n x\n x\n x\n-old\n+new\n y\n y\n y\n@@ -12,4 +12,3 @@\n y\n y\n y\n-gone\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := UnifiedDiff("a", "b", tt.a, tt.b); got != tt.want {
+			t.Errorf("%s:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestUnifiedDiffLarge diffs two large texts with nothing in common, which
+// must neither take the memory of a full Myers trace nor lose lines.
+func TestUnifiedDiffLarge(t *testing.T) {
+	var a, b strings.Builder
+	for i := 0; i < 20000; i++ {
+		a.WriteString("a line\n")
+		b.WriteString("b line\n")
+	}
+	got := UnifiedDiff("a", "b", a.String(), b.String())
+	if n := strings.Count(got, "\n-a line"); n != 20000 {
+		t.Errorf("%d deleted lines, want 20000", n)
+	}
+	if n := strings.Count(got, "\n+b line"); n != 20000 {
+		t.Errorf("%d inserted lines, want 20000", n)
+	}
+}
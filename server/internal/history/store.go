@@ -0,0 +1,389 @@
+// Package history keeps snapshots of vault files. File contents are stored
+// once per distinct content under objects/<sha256>, and each file has an
+// index listing its versions.
+package history
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/utils"
+)
+
+var osFs = afero.NewOsFs()
+
+// MaxSnapshotSize is the largest file the watcher snapshots.
+const MaxSnapshotSize = 10 << 20
+
+// Sources of a version.
+const (
+	SourceAPI      = "api"
+	SourceExternal = "external"
+	SourceInitial  = "initial" // content found before the first tracked write
+)
+
+// ErrNotFound is returned for an unknown file or version.
+var ErrNotFound = errors.New("version not found")
+
+type Version struct {
+	ID     string    `json:"id"`
+	Hash   string    `json:"hash"`
+	Size   int       `json:"size"`
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+}
+
+type fileIndex struct {
+	Path     string    `json:"path"`
+	Versions []Version `json:"versions"` // oldest first
+}
+
+// Store is a content-addressed version store. MaxCount and MaxAge limit the
+// versions kept per file (0 means no limit); the newest version of a file is
+// always kept.
+type Store struct {
+	dir       string
+	vaultRoot string
+	MaxCount  int
+	MaxAge    time.Duration
+	mu        sync.Mutex
+	skip      map[string]string // path -> hash of content written without a version
+}
+
+// NewStore opens the store in dir for the vault at vaultRoot.
+func NewStore(dir, vaultRoot string, maxCount int, maxAge time.Duration) (*Store, error) {
+	for _, d := range []string{filepath.Join(dir, "objects"), filepath.Join(dir, "index")} {
+		if err := os.MkdirAll(d, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	// Drop writes interrupted by a crash
+	if _, err := filesystem.RemoveTempFiles(osFs, dir); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, vaultRoot: vaultRoot, MaxCount: maxCount, MaxAge: maxAge}, nil
+}
+
+func normalize(relPath string) string {
+	return "/" + strings.Trim(filepath.ToSlash(relPath), "/")
+}
+
+func (s *Store) indexPath(relPath string) string {
+	sum := sha1.Sum([]byte(relPath))
+	return filepath.Join(s.dir, "index", hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *Store) objectPath(hash string) string {
+	return filepath.Join(s.dir, "objects", hash[:2], hash[2:])
+}
+
+func (s *Store) readIndex(relPath string) (*fileIndex, error) {
+	b, err := os.ReadFile(s.indexPath(relPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &fileIndex{Path: relPath}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx fileIndex
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, err
+	}
+	return &idx, nil
+}
+
+func (s *Store) writeIndex(idx *fileIndex) error {
+	if len(idx.Versions) == 0 {
+		err := os.Remove(s.indexPath(idx.Path))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return filesystem.WriteFileAtomic(osFs, s.indexPath(idx.Path), b, 0o644)
+}
+
+// Snapshot records content as the newest version of relPath unless it equals
+// the current newest version.
+func (s *Store) Snapshot(relPath string, content []byte, source string) error {
+	relPath = normalize(relPath)
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.readIndex(relPath)
+	if err != nil {
+		return err
+	}
+	if n := len(idx.Versions); n > 0 && idx.Versions[n-1].Hash == hash {
+		return nil
+	}
+
+	obj := s.objectPath(hash)
+	if _, err := os.Stat(obj); errors.Is(err, fs.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(obj), 0o755); err != nil {
+			return err
+		}
+		if err := filesystem.WriteFileAtomic(osFs, obj, content, 0o644); err != nil {
+			return err
+		}
+	}
+	idx.Versions = append(idx.Versions, Version{
+		ID:     utils.GenerateID(),
+		Hash:   hash,
+		Size:   len(content),
+		Time:   time.Now().UTC(),
+		Source: source,
+	})
+	s.prune(idx, time.Now())
+	return s.writeIndex(idx)
+}
+
+// prune drops versions beyond MaxCount or older than MaxAge, keeping the
+// newest one.
+func (s *Store) prune(idx *fileIndex, now time.Time) {
+	vs := idx.Versions
+	if s.MaxCount > 0 && len(vs) > s.MaxCount {
+		vs = vs[len(vs)-s.MaxCount:]
+	}
+	if s.MaxAge > 0 {
+		cutoff := now.Add(-s.MaxAge)
+		i := 0
+		for i < len(vs)-1 && vs[i].Time.Before(cutoff) {
+			i++
+		}
+		vs = vs[i:]
+	}
+	idx.Versions = vs
+}
+
+// Skip makes the watcher event for relPath record no version while the file
+// holds content, which was written on purpose without one.
+func (s *Store) Skip(relPath string, content []byte) {
+	sum := sha256.Sum256(content)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.skip == nil {
+		s.skip = make(map[string]string)
+	}
+	s.skip[normalize(relPath)] = hex.EncodeToString(sum[:])
+}
+
+// skipped reports whether content of relPath was written without a version.
+func (s *Store) skipped(relPath string, content []byte) bool {
+	relPath = normalize(relPath)
+	sum := sha256.Sum256(content)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hash, ok := s.skip[relPath]
+	if ok && hash != hex.EncodeToString(sum[:]) {
+		// Changed since: the skip no longer applies
+		delete(s.skip, relPath)
+		return false
+	}
+	return ok
+}
+
+// Has reports whether relPath has any version.
+func (s *Store) Has(relPath string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := os.Stat(s.indexPath(normalize(relPath)))
+	return err == nil
+}
+
+// List returns the versions of relPath, newest first.
+func (s *Store) List(relPath string) ([]Version, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.readIndex(normalize(relPath))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Version, 0, len(idx.Versions))
+	for i := len(idx.Versions) - 1; i >= 0; i-- {
+		out = append(out, idx.Versions[i])
+	}
+	return out, nil
+}
+
+// Get returns one version of relPath and its content.
+func (s *Store) Get(relPath, id string) (*Version, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idx, err := s.readIndex(normalize(relPath))
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range idx.Versions {
+		if v.ID == id {
+			b, err := os.ReadFile(s.objectPath(v.Hash))
+			if err != nil {
+				return nil, nil, fmt.Errorf("read object %s: %w", v.Hash, err)
+			}
+			return &v, b, nil
+		}
+	}
+	return nil, nil, ErrNotFound
+}
+
+// Move transfers the history of oldRel, and of every file below it, to the
+// new location.
+func (s *Store) Move(oldRel, newRel string) error {
+	oldRel, newRel = normalize(oldRel), normalize(newRel)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idxs, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	for _, idx := range idxs {
+		var target string
+		switch {
+		case idx.Path == oldRel:
+			target = newRel
+		case strings.HasPrefix(idx.Path, oldRel+"/"):
+			target = newRel + strings.TrimPrefix(idx.Path, oldRel)
+		default:
+			continue
+		}
+		dest, err := s.readIndex(target)
+		if err != nil {
+			return err
+		}
+		dest.Versions = append(dest.Versions, idx.Versions...)
+		sort.SliceStable(dest.Versions, func(i, j int) bool { return dest.Versions[i].Time.Before(dest.Versions[j].Time) })
+		if err := s.writeIndex(dest); err != nil {
+			return err
+		}
+		if err := os.Remove(s.indexPath(idx.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) indexes() ([]*fileIndex, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, "index"))
+	if err != nil {
+		return nil, err
+	}
+	var out []*fileIndex
+	for _, e := range entries {
+		b, err := os.ReadFile(filepath.Join(s.dir, "index", e.Name()))
+		if err != nil {
+			continue
+		}
+		var idx fileIndex
+		if json.Unmarshal(b, &idx) == nil {
+			out = append(out, &idx)
+		}
+	}
+	return out, nil
+}
+
+// Prune applies the age limit to every file and deletes objects no version
+// refers to any more.
+func (s *Store) Prune() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	idxs, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	now := time.Now()
+	for _, idx := range idxs {
+		n := len(idx.Versions)
+		s.prune(idx, now)
+		if len(idx.Versions) != n {
+			if err := s.writeIndex(idx); err != nil {
+				return err
+			}
+		}
+		for _, v := range idx.Versions {
+			live[v.Hash] = true
+		}
+	}
+	return filepath.WalkDir(filepath.Join(s.dir, "objects"), func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		hash := filepath.Base(filepath.Dir(p)) + d.Name()
+		if !live[hash] {
+			_ = os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// RunRetention calls Prune every interval until stop is closed. It is meant
+// to run in its own goroutine.
+func (s *Store) RunRetention(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := s.Prune(); err != nil {
+			log.Printf("history retention: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// OnFsEvent snapshots files changed outside the API.
+func (s *Store) OnFsEvent(action string, absPath string) {
+	if action != "created" && action != "modified" {
+		return
+	}
+	info, err := os.Stat(absPath)
+	if err != nil || !info.Mode().IsRegular() || info.Size() > MaxSnapshotSize {
+		return
+	}
+	rel, err := filepath.Rel(s.vaultRoot, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	b, err := os.ReadFile(absPath)
+	if err != nil || s.skipped(rel, b) {
+		return
+	}
+	if err := s.Snapshot(rel, b, SourceExternal); err != nil {
+		log.Printf("history snapshot %s: %v", rel, err)
+	}
+}
+
+// OnFsRename keeps the history of files renamed outside the API.
+func (s *Store) OnFsRename(fromAbs, toAbs string) {
+	from, err1 := filepath.Rel(s.vaultRoot, fromAbs)
+	to, err2 := filepath.Rel(s.vaultRoot, toAbs)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	if err := s.Move(from, to); err != nil {
+		log.Printf("history move %s: %v", from, err)
+	}
+}
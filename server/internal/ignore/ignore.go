@@ -0,0 +1,253 @@
+// Package ignore decides which vault paths are hidden from the tree API, the
+// indexers and the watcher. Rules come from built-in defaults and from a
+// gitignore-style .obsidianignore file at the vault root.
+package ignore
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// FileName is the ignore file looked up at the vault root.
+const FileName = ".obsidianignore"
+
+// Defaults are always applied before the rules of the ignore file, which may
+// re-include them with "!" patterns.
+var Defaults = []string{
+	".plugins",
+	".plugins.db",
+	"/.trash/",
+	".git/",
+	"node_modules/",
+	".DS_Store",
+	// Editor swap and backup files
+	"*.swp",
+	"*.swo",
+	"*.swx",
+	"*~",
+	".#*",
+	`\#*#`,
+	// Temporary files of atomic writes and uploads in progress
+	".obsidianfs-tmp-*",
+	// Custom sort order of a folder, see filesystem.OrderFile
+	".obsidianfs-order.json",
+}
+
+type rule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher matches vault paths against the default and file rules. A nil
+// Matcher ignores nothing.
+type Matcher struct {
+	root      string
+	mu        sync.RWMutex
+	rules     []rule
+	listeners []func()
+}
+
+// New loads the ignore file under root, if there is one. A relative root is
+// made absolute, as MatchAbs gets absolute paths.
+func New(root string) (*Matcher, error) {
+	if abs, err := filepath.Abs(root); err == nil {
+		root = abs
+	}
+	m := &Matcher{root: root}
+	return m, m.load()
+}
+
+// Path returns the absolute path of the ignore file.
+func (m *Matcher) Path() string {
+	return filepath.Join(m.root, FileName)
+}
+
+// IsIgnoreFile reports whether absPath is the ignore file.
+func (m *Matcher) IsIgnoreFile(absPath string) bool {
+	return m != nil && filepath.Clean(absPath) == m.Path()
+}
+
+// OnChange registers fn to run after every Reload.
+func (m *Matcher) OnChange(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+// Reload re-reads the ignore file and notifies the OnChange listeners.
+func (m *Matcher) Reload() error {
+	err := m.load()
+	m.mu.RLock()
+	listeners := append([]func(){}, m.listeners...)
+	m.mu.RUnlock()
+	for _, fn := range listeners {
+		fn()
+	}
+	return err
+}
+
+func (m *Matcher) load() error {
+	rules := parse(Defaults)
+	f, err := os.Open(m.Path())
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		err = nil
+	case err == nil:
+		var lines []string
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		err = scanner.Err()
+		f.Close()
+		rules = append(rules, parse(lines)...)
+	}
+	m.mu.Lock()
+	m.rules = rules
+	m.mu.Unlock()
+	return err
+}
+
+// Match reports whether relPath (relative to the vault root, with or without
+// a leading "/") is ignored. As with git, a path inside an ignored directory
+// is ignored whatever the later rules say.
+func (m *Matcher) Match(relPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	p := strings.Trim(filepath.ToSlash(relPath), "/")
+	if p == "" || p == "." {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	segments := strings.Split(p, "/")
+	for i := 1; i < len(segments); i++ {
+		if m.match(strings.Join(segments[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.match(p, isDir)
+}
+
+// MatchAbs is Match for an absolute path under the vault root.
+func (m *Matcher) MatchAbs(absPath string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+	rel, err := filepath.Rel(m.root, absPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+	return m.Match(rel, isDir)
+}
+
+// match applies the rules to one path; the last matching rule wins.
+func (m *Matcher) match(p string, isDir bool) bool {
+	ignored := false
+	for _, r := range m.rules {
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(p) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func parse(lines []string) []rule {
+	var rules []rule
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var r rule
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		// A slash anywhere but at the end anchors the pattern to the root
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		expr := translate(line)
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "^(?:.*/)?" + expr + "$"
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		r.re = re
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// translate converts a gitignore glob to a regular expression.
+func translate(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				atStart := i == 0 || pattern[i-1] == '/'
+				rest := pattern[i+2:]
+				switch {
+				case atStart && strings.HasPrefix(rest, "/"):
+					// "**/" matches zero or more directories
+					b.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				case atStart && rest == "":
+					b.WriteString(".*")
+					i++
+					continue
+				}
+			}
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
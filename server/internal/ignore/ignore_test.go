@@ -0,0 +1,116 @@
+package ignore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaults(t *testing.T) {
+	m, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"note.md", false, false},
+		{"folder/note.md", false, false},
+		{".plugins", true, true},
+		{".trash", true, true},
+		{"folder/.trash", true, false},
+		{".git/config", false, true},
+		{"folder/node_modules", true, true},
+		{"note.md.swp", false, true},
+		{"note.md~", false, true},
+		{".#note.md", false, true},
+		{"#note.md#", false, true},
+		{"folder/#note.md#", false, true},
+		{"#note.md", false, false},
+		{".obsidianfs-tmp-123", false, true},
+		{".obsidianfs-order.json", false, true},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestFileRules(t *testing.T) {
+	root := t.TempDir()
+	rules := `# a comment
+\#literal
+*.tmp
+!keep.tmp
+/drafts/
+build/
+docs/**/*.bak
+\!bang
+a?c
+[ab].log
+`
+	if err := os.WriteFile(filepath.Join(root, FileName), []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{"# a comment", false, false},
+		{"#literal", false, true},
+		{"x.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"drafts", true, true},
+		{"drafts/note.md", false, true},
+		{"sub/drafts", true, false},
+		{"build", false, false},
+		{"sub/build/out.md", false, true},
+		{"docs/a/b/old.bak", false, true},
+		{"docs/old.bak", false, true},
+		{"old.bak", false, false},
+		{"!bang", false, true},
+		{"abc", false, true},
+		{"ac", false, false},
+		{"a.log", false, true},
+		{"c.log", false, false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+func TestRelativeRoot(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Mkdir("vault", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New("vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs(filepath.Join("vault", ".git"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.MatchAbs(abs, true) {
+		t.Errorf("MatchAbs(%q) = false, want true", abs)
+	}
+}
@@ -0,0 +1,185 @@
+// Package myers computes shortest edit scripts between two sequences with
+// the linear space variant of Myers' diff algorithm: it looks for the
+// middle of the script from both ends and recurses on the halves, so
+// memory stays O(n+m) however different the sequences are.
+package myers
+
+// Kind is the kind of an Edit.
+type Kind byte
+
+const (
+	Equal  Kind = '='
+	Delete Kind = '-'
+	Insert Kind = '+'
+)
+
+// Edit is one step of a script: keep a[A] as b[B], delete a[A] or insert
+// b[B]. Deletes carry the position in b they happen at and inserts the
+// position in a, so empty ranges can be located.
+type Edit struct {
+	Kind Kind
+	A, B int
+}
+
+// maxSteps bounds the work of one Diff, counted in comparisons while
+// searching for middle points; beyond it the ranges left are replaced
+// whole. Only very different long inputs come near it.
+const maxSteps = 1 << 24
+
+// Diff returns a shortest edit script turning the n elements of a into the
+// m elements of b; eq(i, j) reports whether a[i] equals b[j]. Within each
+// change, deletes come before inserts. Should finding it take more than
+// maxSteps comparisons, the script is correct but may not be the shortest.
+func Diff(n, m int, eq func(i, j int) bool) []Edit {
+	d := &differ{eq: eq, budget: maxSteps}
+	d.compare(0, n, 0, m)
+
+	// Put deletes first in each change and number the edits
+	out := make([]Edit, 0, len(d.kinds))
+	i, j := 0, 0
+	for start := 0; start < len(d.kinds); {
+		if d.kinds[start] == Equal {
+			out = append(out, Edit{Equal, i, j})
+			i, j, start = i+1, j+1, start+1
+			continue
+		}
+		end, inserts := start, 0
+		for ; end < len(d.kinds) && d.kinds[end] != Equal; end++ {
+			if d.kinds[end] == Insert {
+				inserts++
+			}
+		}
+		for k := 0; k < end-start-inserts; k++ {
+			out = append(out, Edit{Delete, i, j})
+			i++
+		}
+		for k := 0; k < inserts; k++ {
+			out = append(out, Edit{Insert, i, j})
+			j++
+		}
+		start = end
+	}
+	return out
+}
+
+type differ struct {
+	eq     func(i, j int) bool
+	kinds  []Kind
+	budget int // comparisons left for middle
+}
+
+func (d *differ) emit(k Kind, n int) {
+	for ; n > 0; n-- {
+		d.kinds = append(d.kinds, k)
+	}
+}
+
+// compare appends the script turning a[a0:a1] into b[b0:b1].
+func (d *differ) compare(a0, a1, b0, b1 int) {
+	prefix := 0
+	for a0+prefix < a1 && b0+prefix < b1 && d.eq(a0+prefix, b0+prefix) {
+		prefix++
+	}
+	d.emit(Equal, prefix)
+	a0, b0 = a0+prefix, b0+prefix
+	suffix := 0
+	for a0 < a1-suffix && b0 < b1-suffix && d.eq(a1-suffix-1, b1-suffix-1) {
+		suffix++
+	}
+	a1, b1 = a1-suffix, b1-suffix
+
+	switch {
+	case a0 == a1:
+		d.emit(Insert, b1-b0)
+	case b0 == b1:
+		d.emit(Delete, a1-a0)
+	default:
+		x, y := d.middle(a0, a1, b0, b1)
+		if (x == a0 && y == b0) || (x == a1 && y == b1) {
+			// No split that makes progress; replace the whole range
+			d.emit(Delete, a1-a0)
+			d.emit(Insert, b1-b0)
+			break
+		}
+		d.compare(a0, x, b0, y)
+		d.compare(x, a1, y, b1)
+	}
+	d.emit(Equal, suffix)
+}
+
+// middle returns a point on a shortest path through a[a0:a1] and b[b0:b1]
+// where the forward and the backward searches meet, with the ends trimmed
+// of equal elements. Out of budget it returns (a0, b0).
+func (d *differ) middle(a0, a1, b0, b1 int) (int, int) {
+	n, m := a1-a0, b1-b0
+	maxD := (n + m + 1) / 2
+	off := maxD + 1
+	size := 2*maxD + 3
+	fwd, bwd := make([]int, size), make([]int, size)
+	for i := range fwd {
+		fwd[i], bwd[i] = -1, -1
+	}
+	fwd[off+1], bwd[off+1] = 0, 0
+	delta := n - m
+	// With an odd delta the paths meet during a forward step
+	odd := delta%2 != 0
+	// Diagonals that ran off the grid are not searched again
+	fStart, fEnd, bStart, bEnd := 0, 0, 0, 0
+	for step := 0; step < maxD && d.budget > 0; step++ {
+		d.budget -= 2*step + 2
+		for k := -step + fStart; k <= step-fEnd; k += 2 {
+			var x int
+			if k == -step || (k != step && fwd[off+k-1] < fwd[off+k+1]) {
+				x = fwd[off+k+1]
+			} else {
+				x = fwd[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.eq(a0+x, b0+y) {
+				x++
+				y++
+				d.budget--
+			}
+			fwd[off+k] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				if bk := off + delta - k; bk >= 0 && bk < size && bwd[bk] != -1 && x >= n-bwd[bk] {
+					return a0 + x, b0 + y
+				}
+			}
+		}
+		for k := -step + bStart; k <= step-bEnd; k += 2 {
+			var x int
+			if k == -step || (k != step && bwd[off+k-1] < bwd[off+k+1]) {
+				x = bwd[off+k+1]
+			} else {
+				x = bwd[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && d.eq(a1-x-1, b1-y-1) {
+				x++
+				y++
+				d.budget--
+			}
+			bwd[off+k] = x
+			switch {
+			case x > n:
+				bEnd += 2
+			case y > m:
+				bStart += 2
+			case !odd:
+				if fk := off + delta - k; fk >= 0 && fk < size && fwd[fk] != -1 {
+					fx := fwd[fk]
+					if fy := fx - (fk - off); fx >= n-x {
+						return a0 + fx, b0 + fy
+					}
+				}
+			}
+		}
+	}
+	return a0, b0
+}
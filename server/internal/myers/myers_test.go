@@ -0,0 +1,153 @@
+package myers
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// lcs returns the length of the longest common subsequence of a and b.
+func lcs(a, b []byte) int {
+	prev, cur := make([]int, len(b)+1), make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// check verifies that script turns a into b, that its positions are right
+// and that it is as short as possible.
+func check(t *testing.T, a, b []byte, script []Edit) {
+	t.Helper()
+	var out []byte
+	i, j, edits := 0, 0, 0
+	for _, e := range script {
+		if e.A != i || e.B != j {
+			t.Fatalf("diff(%q, %q): edit %c at (%d, %d), want (%d, %d)", a, b, e.Kind, e.A, e.B, i, j)
+		}
+		switch e.Kind {
+		case Equal:
+			if a[i] != b[j] {
+				t.Fatalf("diff(%q, %q): keeps a[%d] = %q as b[%d] = %q", a, b, i, a[i], j, b[j])
+			}
+			out = append(out, a[i])
+			i, j = i+1, j+1
+		case Delete:
+			i++
+			edits++
+		case Insert:
+			out = append(out, b[j])
+			j++
+			edits++
+		}
+	}
+	if i != len(a) || string(out) != string(b) {
+		t.Fatalf("diff(%q, %q) gives %q", a, b, out)
+	}
+	if want := len(a) + len(b) - 2*lcs(a, b); edits != want {
+		t.Fatalf("diff(%q, %q) has %d edits, want %d", a, b, edits, want)
+	}
+}
+
+func diffBytes(a, b []byte) []Edit {
+	return Diff(len(a), len(b), func(i, j int) bool { return a[i] == b[j] })
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct{ a, b string }{
+		{"", ""},
+		{"", "abc"},
+		{"abc", ""},
+		{"abc", "abc"},
+		{"abcabba", "cbabac"},
+		{"x", "y"},
+		{"ab", "ba"},
+		{"abcdef", "azcdzf"},
+		{"aaaa", "aa"},
+		{"kitten", "sitting"},
+	}
+	for _, tt := range tests {
+		check(t, []byte(tt.a), []byte(tt.b), diffBytes([]byte(tt.a), []byte(tt.b)))
+	}
+}
+
+func TestDiffRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	gen := func() []byte {
+		s := make([]byte, rng.Intn(40))
+		for i := range s {
+			s[i] = "abc"[rng.Intn(3)]
+		}
+		return s
+	}
+	for n := 0; n < 2000; n++ {
+		a, b := gen(), gen()
+		check(t, a, b, diffBytes(a, b))
+	}
+}
+
+func TestDeletesFirst(t *testing.T) {
+	script := diffBytes([]byte("axb"), []byte("ayb"))
+	want := []Edit{{Equal, 0, 0}, {Delete, 1, 1}, {Insert, 2, 1}, {Equal, 2, 2}}
+	if len(script) != len(want) {
+		t.Fatalf("got %v, want %v", script, want)
+	}
+	for i := range want {
+		if script[i] != want[i] {
+			t.Fatalf("got %v, want %v", script, want)
+		}
+	}
+}
+
+// TestBudget checks that a diff too costly to minimize still turns a into b.
+func TestBudget(t *testing.T) {
+	const n = 20000
+	x, y := make([]int, n), make([]int, n)
+	for i := range x {
+		x[i], y[i] = i, i
+		if i%3 == 0 {
+			y[i] = -i - 1
+		}
+	}
+	script := Diff(n, n, func(i, j int) bool { return x[i] == y[j] })
+	i, j := 0, 0
+	for _, e := range script {
+		switch e.Kind {
+		case Equal:
+			if x[i] != y[j] {
+				t.Fatalf("keeps x[%d] as y[%d]", i, j)
+			}
+			i, j = i+1, j+1
+		case Delete:
+			i++
+		case Insert:
+			j++
+		}
+	}
+	if i != n || j != n {
+		t.Fatalf("script ends at (%d, %d)", i, j)
+	}
+}
+
+// BenchmarkDisjoint diffs two long texts with nothing in common, where a
+// full trace would need (n+m)² memory.
+func BenchmarkDisjoint(b *testing.B) {
+	const n = 20000
+	x, y := make([]int, n), make([]int, n)
+	for i := range x {
+		x[i], y[i] = i, -i-1
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Diff(n, n, func(i, j int) bool { return x[i] == y[j] })
+	}
+}
@@ -11,6 +11,10 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/spf13/afero"
+
+	"obsidianfs/internal/filesystem"
+	"obsidianfs/internal/safepath"
 )
 
 type Service struct {
@@ -179,11 +183,23 @@ func (s *Service) installFromZip(zipPath string) (*Plugin, error) {
 		return nil, fmt.Errorf("plugin %s is already installed", manifest.ID)
 	}
 
-	// Create plugin directory
-	pluginDir := filepath.Join(s.pluginsDir, manifest.ID)
+	// Create plugin directory; the ID and the archive entries must not
+	// point outside the plugins directory
+	plugins, err := safepath.New(s.pluginsDir, safepath.SymlinkDeny)
+	if err != nil {
+		return nil, err
+	}
+	pluginDir, err := plugins.Resolve(manifest.ID)
+	if err != nil || pluginDir == s.pluginsDir || filepath.Dir(pluginDir) != plugins.Root() {
+		return nil, fmt.Errorf("invalid plugin id %q", manifest.ID)
+	}
 	if err := os.MkdirAll(pluginDir, 0755); err != nil {
 		return nil, err
 	}
+	files, err := safepath.New(pluginDir, safepath.SymlinkDeny)
+	if err != nil {
+		return nil, err
+	}
 
 	// Extract files
 	for _, f := range r.File {
@@ -192,7 +208,10 @@ func (s *Service) installFromZip(zipPath string) (*Plugin, error) {
 		}
 
 		// Create directory structure
-		destPath := filepath.Join(pluginDir, f.Name)
+		destPath, err := files.Resolve(f.Name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path %q in plugin archive: %v", f.Name, err)
+		}
 		destDir := filepath.Dir(destPath)
 		if err := os.MkdirAll(destDir, 0755); err != nil {
 			return nil, err
@@ -204,16 +223,8 @@ func (s *Service) installFromZip(zipPath string) (*Plugin, error) {
 			return nil, err
 		}
 
-		destFile, err := os.Create(destPath)
-		if err != nil {
-			rc.Close()
-			return nil, err
-		}
-
-		_, err = io.Copy(destFile, rc)
+		err = filesystem.WriteAtomic(afero.NewOsFs(), destPath, rc, 0644)
 		rc.Close()
-		destFile.Close()
-
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,176 @@
+// Package safepath maps client supplied paths to filesystem paths under a
+// root directory, rejecting anything that would end up outside of it:
+// ".." segments, absolute paths sharing a prefix with the root and symlinks
+// pointing elsewhere.
+package safepath
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrOutsideRoot is returned for a path that resolves outside the root.
+var ErrOutsideRoot = errors.New("path is outside the root")
+
+// ErrSymlink is returned for a path through a symlink under SymlinkDeny.
+var ErrSymlink = errors.New("path contains a symlink")
+
+// SymlinkPolicy decides how symlinks inside the root are treated.
+type SymlinkPolicy int
+
+const (
+	// SymlinkInside follows symlinks whose target is inside the root.
+	SymlinkInside SymlinkPolicy = iota
+	// SymlinkDeny rejects every path that goes through a symlink.
+	SymlinkDeny
+	// SymlinkFollow follows all symlinks, wherever they point.
+	SymlinkFollow
+)
+
+// ParsePolicy parses "inside" (also ""), "deny" or "follow".
+func ParsePolicy(s string) (SymlinkPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "inside":
+		return SymlinkInside, nil
+	case "deny":
+		return SymlinkDeny, nil
+	case "follow":
+		return SymlinkFollow, nil
+	}
+	return 0, fmt.Errorf("unknown symlink policy %q", s)
+}
+
+// Resolver resolves paths relative to a root.
+type Resolver struct {
+	root     string // as configured, cleaned
+	realRoot string // with symlinks evaluated
+	policy   SymlinkPolicy
+}
+
+// New creates a resolver for root, which must exist.
+func New(root string, policy SymlinkPolicy) (*Resolver, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{root: root, realRoot: real, policy: policy}, nil
+}
+
+// Root returns the root directory as configured.
+func (r *Resolver) Root() string { return r.root }
+
+// Resolve maps a root-relative path such as "/folder/file.md" to an
+// absolute path under the root. The path need not exist; the part of it that
+// does is checked against the symlink policy.
+func (r *Resolver) Resolve(relPath string) (string, error) {
+	if strings.ContainsRune(relPath, 0) {
+		return "", ErrOutsideRoot
+	}
+	slashed := strings.ReplaceAll(relPath, `\`, "/")
+	for _, seg := range strings.Split(slashed, "/") {
+		if seg == ".." {
+			return "", ErrOutsideRoot
+		}
+	}
+	abs := filepath.Join(r.root, filepath.FromSlash(strings.TrimLeft(slashed, "/")))
+	if err := r.check(abs); err != nil {
+		return "", err
+	}
+	return abs, nil
+}
+
+// Check verifies that an absolute path, e.g. one reported by a directory
+// walk or the watcher, is under the root and allowed by the symlink policy.
+func (r *Resolver) Check(absPath string) error {
+	abs := filepath.Clean(absPath)
+	if !within(r.root, abs) {
+		return ErrOutsideRoot
+	}
+	return r.check(abs)
+}
+
+// Rel returns the root-relative form ("/folder/file.md") of an absolute path
+// under the root.
+func (r *Resolver) Rel(absPath string) (string, error) {
+	rel, err := filepath.Rel(r.root, absPath)
+	if err != nil || !within(r.root, absPath) {
+		return "", ErrOutsideRoot
+	}
+	if rel == "." {
+		return "/", nil
+	}
+	return "/" + filepath.ToSlash(rel), nil
+}
+
+// check applies the symlink policy to the existing part of abs, which is
+// lexically under the root.
+func (r *Resolver) check(abs string) error {
+	if r.policy == SymlinkFollow {
+		return nil
+	}
+	rel, err := filepath.Rel(r.root, abs)
+	if err != nil {
+		return ErrOutsideRoot
+	}
+	cur := r.root
+	if rel == "." {
+		return nil
+	}
+	for _, seg := range strings.Split(rel, string(filepath.Separator)) {
+		cur = filepath.Join(cur, seg)
+		info, err := os.Lstat(cur)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Nothing below a missing component can be a symlink
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		if r.policy == SymlinkDeny {
+			return ErrSymlink
+		}
+		target, err := filepath.EvalSymlinks(cur)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Dangling: check where it would point
+			dest, lerr := os.Readlink(cur)
+			if lerr != nil {
+				return lerr
+			}
+			if !filepath.IsAbs(dest) {
+				dest = filepath.Join(filepath.Dir(cur), dest)
+			}
+			if !within(r.root, dest) && !within(r.realRoot, dest) {
+				return ErrOutsideRoot
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !within(r.realRoot, target) {
+			return ErrOutsideRoot
+		}
+	}
+	return nil
+}
+
+// within reports whether p is root or below it. Both must be clean and
+// absolute.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
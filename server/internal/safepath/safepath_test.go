@@ -0,0 +1,180 @@
+package safepath
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// vault builds base/workspace with symlinks pointing in and out of it, next
+// to base/workspace-other and base/outside, and returns base and the root.
+func vault(t *testing.T) (base, root string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(base, "workspace")
+	for _, dir := range []string{root, filepath.Join(root, "dir"), filepath.Join(base, "workspace-other"), filepath.Join(base, "outside")} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "note.md"), filepath.Join(base, "workspace-other", "secret.md"), filepath.Join(base, "outside", "secret.md")} {
+		if err := os.WriteFile(f, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"link-inside":  "note.md",
+		"link-out":     "../outside/secret.md",
+		"linkdir-out":  filepath.Join(base, "outside"),
+		"dangling-in":  "missing.md",
+		"dangling-out": "../outside/missing.md",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	return base, root
+}
+
+// outcome is the error expected under SymlinkInside, SymlinkDeny and
+// SymlinkFollow, in that order.
+type outcome [3]error
+
+var (
+	allOK      = outcome{nil, nil, nil}
+	allOutside = outcome{ErrOutsideRoot, ErrOutsideRoot, ErrOutsideRoot}
+	escapes    = outcome{ErrOutsideRoot, ErrSymlink, nil}
+	staysIn    = outcome{nil, ErrSymlink, nil}
+)
+
+var policies = []SymlinkPolicy{SymlinkInside, SymlinkDeny, SymlinkFollow}
+
+func TestResolve(t *testing.T) {
+	_, root := vault(t)
+	tests := []struct {
+		name string
+		path string
+		want outcome
+		abs  string // expected result, relative to the root, when allowed
+	}{
+		{"plain file", "/note.md", allOK, "note.md"},
+		{"no leading slash", "note.md", allOK, "note.md"},
+		{"missing file", "/dir/missing/child.md", allOK, "dir/missing/child.md"},
+		{"absolute path stays under the root", "/etc/passwd", allOK, "etc/passwd"},
+		{"dot dot segment", "/dir/../note.md", allOutside, ""},
+		{"dot dot to prefix sibling", "../workspace-other/secret.md", allOutside, ""},
+		{"leading dot dot", "/../outside/secret.md", allOutside, ""},
+		{"backslash dot dot", `..\outside\secret.md`, allOutside, ""},
+		{"backslash inner dot dot", `dir\..\..\outside`, allOutside, ""},
+		{"backslash separators", `dir\note.md`, allOK, "dir/note.md"},
+		{"NUL byte", "/note.md\x00.txt", allOutside, ""},
+		{"symlink inside the root", "/link-inside", staysIn, "link-inside"},
+		{"symlink escaping the root", "/link-out", escapes, "link-out"},
+		{"symlinked directory outside the root", "/linkdir-out/secret.md", escapes, "linkdir-out/secret.md"},
+		{"dangling symlink inside", "/dangling-in", staysIn, "dangling-in"},
+		{"dangling symlink outside", "/dangling-out", escapes, "dangling-out"},
+	}
+	for _, policy := range policies {
+		r, err := New(root, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			got, err := r.Resolve(tt.path)
+			if want := tt.want[policy]; !errors.Is(err, want) {
+				t.Errorf("policy %d: Resolve(%q) error = %v, want %v", policy, tt.path, err, want)
+				continue
+			}
+			if err == nil && got != filepath.Join(root, filepath.FromSlash(tt.abs)) {
+				t.Errorf("policy %d: Resolve(%q) = %q, want %q", policy, tt.path, got, filepath.Join(root, tt.abs))
+			}
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	base, root := vault(t)
+	tests := []struct {
+		name string
+		path string
+		want outcome
+	}{
+		{"root", root, allOK},
+		{"file", filepath.Join(root, "note.md"), allOK},
+		{"prefix sibling", filepath.Join(base, "workspace-other", "secret.md"), allOutside},
+		{"prefix sibling directory", root + "-other", allOutside},
+		{"outside", filepath.Join(base, "outside", "secret.md"), allOutside},
+		{"unclean dot dot", root + "/../outside/secret.md", allOutside},
+		{"symlink inside the root", filepath.Join(root, "link-inside"), staysIn},
+		{"symlink escaping the root", filepath.Join(root, "link-out"), escapes},
+		{"below a symlinked directory", filepath.Join(root, "linkdir-out", "secret.md"), escapes},
+		{"dangling symlink inside", filepath.Join(root, "dangling-in"), staysIn},
+		{"dangling symlink outside", filepath.Join(root, "dangling-out"), escapes},
+	}
+	for _, policy := range policies {
+		r, err := New(root, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			err := r.Check(tt.path)
+			if want := tt.want[policy]; !errors.Is(err, want) {
+				t.Errorf("policy %d: Check(%s) = %v, want %v", policy, tt.name, err, want)
+			}
+		}
+	}
+}
+
+// TestSymlinkedRoot checks that a root reached through a symlink still
+// accepts symlinks pointing into its real location.
+func TestSymlinkedRoot(t *testing.T) {
+	base, root := vault(t)
+	alias := filepath.Join(base, "alias")
+	if err := os.Symlink(root, alias); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(root, "note.md"), filepath.Join(root, "abs-inside")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := New(alias, SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/note.md", "/abs-inside", "/link-inside"} {
+		if _, err := r.Resolve(p); err != nil {
+			t.Errorf("Resolve(%q) = %v", p, err)
+		}
+	}
+	if _, err := r.Resolve("/link-out"); !errors.Is(err, ErrOutsideRoot) {
+		t.Errorf("Resolve(/link-out) = %v, want %v", err, ErrOutsideRoot)
+	}
+}
+
+func TestRel(t *testing.T) {
+	_, root := vault(t)
+	r, err := New(root, SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		abs  string
+		want string
+		err  error
+	}{
+		{root, "/", nil},
+		{filepath.Join(root, "dir", "note.md"), "/dir/note.md", nil},
+		{root + "-other", "", ErrOutsideRoot},
+		{filepath.Dir(root), "", ErrOutsideRoot},
+	}
+	for _, tt := range tests {
+		got, err := r.Rel(tt.abs)
+		if got != tt.want || !errors.Is(err, tt.err) {
+			t.Errorf("Rel(%q) = %q, %v, want %q, %v", tt.abs, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/utils"
+)
+
+// Level 权限级别，数值越大权限越高
+type Level int
+
+const (
+	LevelNone Level = iota
+	LevelRead
+	LevelWrite
+	LevelAdmin
+)
+
+var levelNames = []string{"none", "read", "write", "admin"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel 解析 none、read、write 或 admin
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if s == name {
+			return Level(i), nil
+		}
+	}
+	return LevelNone, fmt.Errorf("无效的权限级别: %q", s)
+}
+
+// Access 是某个用户的有效权限。路径的权限由最长匹配的规则决定，
+// 同一路径上的笔记本规则与路径规则取较高者，没有匹配规则时为 none。
+// nil 表示未启用认证，所有操作都允许。
+type Access struct {
+	admin bool
+	rules []accessRule
+}
+
+type accessRule struct {
+	prefix string // "/笔记本/文件夹"，"/" 表示整个库
+	level  Level
+}
+
+func normalizePath(p string) string {
+	return "/" + strings.Trim(strings.ReplaceAll(p, `\`, "/"), "/")
+}
+
+func under(p, prefix string) bool {
+	return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// Level 返回路径上的权限级别
+func (a *Access) Level(p string) Level {
+	if a == nil || a.admin {
+		return LevelAdmin
+	}
+	p = normalizePath(p)
+	best, bestLen := LevelNone, -1
+	for _, r := range a.rules {
+		if !under(p, r.prefix) {
+			continue
+		}
+		if n := len(r.prefix); n > bestLen || (n == bestLen && r.level > best) {
+			best, bestLen = r.level, n
+		}
+	}
+	return best
+}
+
+// Can 判断路径上是否至少有 level 权限
+func (a *Access) Can(p string, level Level) bool {
+	return a.Level(p) >= level
+}
+
+// Visible 判断路径是否应出现在目录树中：可读，或其下有可读的内容
+func (a *Access) Visible(p string) bool {
+	if a.Can(p, LevelRead) {
+		return true
+	}
+	p = normalizePath(p)
+	for _, r := range a.rules {
+		if r.level >= LevelRead && r.prefix != p && under(r.prefix, p) && a.Can(r.prefix, LevelRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin 判断是否为全局管理员
+func (a *Access) IsAdmin() bool {
+	return a == nil || a.admin
+}
+
+// AccessService 管理按笔记本和路径前缀授予的权限。
+// 全局管理员（role=admin）拥有所有权限，不受规则限制。
+type AccessService struct {
+	db        *database.DB
+	notebooks *NotebookService
+	root      string
+
+	mu    sync.Mutex
+	cache map[string]*Access // user ID -> 有效权限
+}
+
+// NewAccessService 创建权限服务，root 为库的根目录，用于跟随文件系统中的重命名
+func NewAccessService(db *database.DB, notebooks *NotebookService, root string) *AccessService {
+	return &AccessService{db: db, notebooks: notebooks, root: root, cache: make(map[string]*Access)}
+}
+
+// Invalidate 丢弃缓存的有效权限，在权限或笔记本变化后调用
+func (s *AccessService) Invalidate() {
+	s.mu.Lock()
+	s.cache = make(map[string]*Access)
+	s.mu.Unlock()
+}
+
+// For 返回用户的有效权限。user 为 nil（未启用认证）时返回 nil，即全部允许。
+func (s *AccessService) For(user *database.User) (*Access, error) {
+	if user == nil {
+		return nil, nil
+	}
+	if user.Role == database.RoleAdmin {
+		return &Access{admin: true}, nil
+	}
+	s.mu.Lock()
+	a, ok := s.cache[user.ID]
+	s.mu.Unlock()
+	if ok {
+		return a, nil
+	}
+
+	grants, err := s.ListGrants(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	folders := make(map[string]string)
+	if len(grants) > 0 {
+		notebooks, err := s.notebooks.ListNotebooks()
+		if err != nil {
+			return nil, err
+		}
+		for _, nb := range notebooks {
+			folders[nb.ID] = FolderPath(nb.Name)
+		}
+	}
+	a = &Access{}
+	for _, g := range grants {
+		level, err := ParseLevel(g.Level)
+		if err != nil {
+			continue
+		}
+		prefix := g.Path
+		if g.Notebook != "" {
+			if prefix = folders[g.Notebook]; prefix == "" {
+				continue
+			}
+		}
+		a.rules = append(a.rules, accessRule{prefix: normalizePath(prefix), level: level})
+	}
+
+	s.mu.Lock()
+	s.cache[user.ID] = a
+	s.mu.Unlock()
+	return a, nil
+}
+
+// ListGrants 列出用户的权限规则，userID 为空时列出全部
+func (s *AccessService) ListGrants(userID string) ([]*database.Permission, error) {
+	query := `SELECT id, user_id, notebook, path, level, created FROM permissions`
+	var args []interface{}
+	if userID != "" {
+		query += ` WHERE user_id = ?`
+		args = append(args, userID)
+	}
+	rows, err := s.db.Query(query+` ORDER BY created`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("查询权限失败: %w", err)
+	}
+	defer rows.Close()
+
+	grants := []*database.Permission{}
+	for rows.Next() {
+		g := &database.Permission{}
+		var created string
+		if err := rows.Scan(&g.ID, &g.UserID, &g.Notebook, &g.Path, &g.Level, &created); err != nil {
+			return nil, fmt.Errorf("扫描权限数据失败: %w", err)
+		}
+		g.Created, _ = time.Parse(time.RFC3339, created)
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+// GetGrant 根据ID获取权限规则
+func (s *AccessService) GetGrant(id string) (*database.Permission, error) {
+	g := &database.Permission{}
+	var created string
+	err := s.db.QueryRow(`SELECT id, user_id, notebook, path, level, created FROM permissions WHERE id = ?`, id).
+		Scan(&g.ID, &g.UserID, &g.Notebook, &g.Path, &g.Level, &created)
+	if err != nil {
+		return nil, fmt.Errorf("获取权限失败: %w", err)
+	}
+	g.Created, _ = time.Parse(time.RFC3339, created)
+	return g, nil
+}
+
+// ScopePath 返回权限规则作用的路径
+func (s *AccessService) ScopePath(notebook, path string) (string, error) {
+	if notebook == "" {
+		return normalizePath(path), nil
+	}
+	nb, err := s.notebooks.GetNotebook(notebook)
+	if err != nil {
+		return "", err
+	}
+	return FolderPath(nb.Name), nil
+}
+
+// Grant 设置用户在笔记本或路径前缀上的权限，已存在的规则会被覆盖
+func (s *AccessService) Grant(userID, notebook, path, level string) (*database.Permission, error) {
+	if (notebook == "") == (path == "") {
+		return nil, fmt.Errorf("需要指定 notebook 或 path 之一")
+	}
+	if _, err := ParseLevel(level); err != nil {
+		return nil, err
+	}
+	if notebook != "" {
+		if _, err := s.notebooks.GetNotebook(notebook); err != nil {
+			return nil, err
+		}
+	} else {
+		if strings.Contains(path, "..") {
+			return nil, fmt.Errorf("无效的路径: %q", path)
+		}
+		path = normalizePath(path)
+	}
+
+	g := &database.Permission{
+		ID:       utils.GenerateID(),
+		UserID:   userID,
+		Notebook: notebook,
+		Path:     path,
+		Level:    level,
+		Created:  time.Now(),
+	}
+	_, err := s.db.Exec(`INSERT INTO permissions (id, user_id, notebook, path, level, created)
+			  VALUES (?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(user_id, notebook, path) DO UPDATE SET level = excluded.level`,
+		g.ID, g.UserID, g.Notebook, g.Path, g.Level, g.Created.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("设置权限失败: %w", err)
+	}
+	s.Invalidate()
+	err = s.db.QueryRow(`SELECT id FROM permissions WHERE user_id = ? AND notebook = ? AND path = ?`,
+		userID, notebook, path).Scan(&g.ID)
+	if err != nil {
+		return nil, fmt.Errorf("获取权限失败: %w", err)
+	}
+	return g, nil
+}
+
+// Revoke 删除权限规则
+func (s *AccessService) Revoke(id string) error {
+	res, err := s.db.Exec("DELETE FROM permissions WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("删除权限失败: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("权限不存在: %s", id)
+	}
+	s.Invalidate()
+	return nil
+}
+
+// MovePath 在文件或文件夹移动后更新路径规则
+func (s *AccessService) MovePath(from, to string) error {
+	from, to = normalizePath(from), normalizePath(to)
+	grants, err := s.ListGrants("")
+	if err != nil {
+		return err
+	}
+	for _, g := range grants {
+		if g.Path == "" || !under(g.Path, from) || from == "/" {
+			continue
+		}
+		moved := to + strings.TrimPrefix(g.Path, from)
+		if _, err := s.db.Exec("UPDATE OR REPLACE permissions SET path = ? WHERE id = ?", moved, g.ID); err != nil {
+			return fmt.Errorf("更新权限路径失败: %w", err)
+		}
+	}
+	s.Invalidate()
+	return nil
+}
+
+// OnFsEvent 实现 filesystem.Listener；权限规则只需跟随重命名
+func (s *AccessService) OnFsEvent(action string, absPath string) {}
+
+// OnFsRename 让路径规则跟随文件夹或文件的重命名（包括笔记本重命名）
+func (s *AccessService) OnFsRename(fromAbs, toAbs string) {
+	from, err1 := filepath.Rel(s.root, fromAbs)
+	to, err2 := filepath.Rel(s.root, toAbs)
+	if err1 != nil || err2 != nil || strings.HasPrefix(from, "..") || strings.HasPrefix(to, "..") {
+		return
+	}
+	if err := s.MovePath(filepath.ToSlash(from), filepath.ToSlash(to)); err != nil {
+		log.Printf("更新权限路径失败: %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/utils"
+)
+
+// ErrInvalidCredentials 用户名或密码错误，或令牌无效、已过期
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// MinPasswordLength 密码最短长度
+const MinPasswordLength = 8
+
+var (
+	dummyOnce sync.Once
+	dummyHash []byte
+)
+
+// AuthService 管理本地用户、登录会话和 API 令牌。
+// 会话令牌与 API 令牌都是随机字符串，数据库中只保存其 SHA-256。
+type AuthService struct {
+	db         *database.DB
+	sessionTTL time.Duration
+}
+
+func NewAuthService(db *database.DB, sessionTTL time.Duration) *AuthService {
+	return &AuthService{db: db, sessionTTL: sessionTTL}
+}
+
+// SessionTTL 返回会话有效期
+func (s *AuthService) SessionTTL() time.Duration {
+	return s.sessionTTL
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateUsername(name string) error {
+	if name == "" || len(name) > 64 || strings.ContainsAny(name, " \t\r\n/\\:") {
+		return fmt.Errorf("无效的用户名: %q", name)
+	}
+	return nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < MinPasswordLength {
+		return fmt.Errorf("密码至少需要 %d 个字符", MinPasswordLength)
+	}
+	return nil
+}
+
+// UserCount 返回用户数量
+func (s *AuthService) UserCount() (int, error) {
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+		return 0, fmt.Errorf("查询用户数量失败: %w", err)
+	}
+	return n, nil
+}
+
+// CreateUser 创建用户
+func (s *AuthService) CreateUser(username, password, role string) (*database.User, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, err
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, err
+	}
+	if role == "" {
+		role = database.RoleUser
+	}
+	if role != database.RoleAdmin && role != database.RoleUser {
+		return nil, fmt.Errorf("无效的角色: %q", role)
+	}
+	if existing, _ := s.userByName(username); existing != nil {
+		return nil, fmt.Errorf("用户 %s 已存在", username)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("密码哈希失败: %w", err)
+	}
+
+	now := time.Now()
+	user := &database.User{ID: utils.GenerateID(), Username: username, Role: role, Created: now, Updated: now}
+	_, err = s.db.Exec(`INSERT INTO users (id, username, password_hash, role, created, updated)
+			  VALUES (?, ?, ?, ?, ?, ?)`,
+		user.ID, user.Username, string(hash), user.Role,
+		now.Format(time.RFC3339), now.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("创建用户失败: %w", err)
+	}
+	return user, nil
+}
+
+func scanUser(row interface{ Scan(...interface{}) error }, hash *string) (*database.User, error) {
+	user := &database.User{}
+	var created, updated string
+	dest := []interface{}{&user.ID, &user.Username, &user.Role, &created, &updated}
+	if hash != nil {
+		dest = append(dest, hash)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	user.Created, _ = time.Parse(time.RFC3339, created)
+	user.Updated, _ = time.Parse(time.RFC3339, updated)
+	return user, nil
+}
+
+func (s *AuthService) userByName(username string) (*database.User, error) {
+	row := s.db.QueryRow(`SELECT id, username, role, created, updated FROM users WHERE username = ?`, username)
+	return scanUser(row, nil)
+}
+
+// GetUser 根据ID获取用户
+func (s *AuthService) GetUser(id string) (*database.User, error) {
+	row := s.db.QueryRow(`SELECT id, username, role, created, updated FROM users WHERE id = ?`, id)
+	user, err := scanUser(row, nil)
+	if err != nil {
+		return nil, fmt.Errorf("获取用户失败: %w", err)
+	}
+	return user, nil
+}
+
+// ListUsers 列出所有用户
+func (s *AuthService) ListUsers() ([]*database.User, error) {
+	rows, err := s.db.Query(`SELECT id, username, role, created, updated FROM users ORDER BY username`)
+	if err != nil {
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+	defer rows.Close()
+
+	users := []*database.User{}
+	for rows.Next() {
+		user, err := scanUser(rows, nil)
+		if err != nil {
+			return nil, fmt.Errorf("扫描用户数据失败: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// DeleteUser 删除用户及其会话和令牌
+func (s *AuthService) DeleteUser(id string) error {
+	res, err := s.db.Exec("DELETE FROM users WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("删除用户失败: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("用户不存在: %s", id)
+	}
+	return nil
+}
+
+// SetPassword 修改密码，并使该用户的所有会话失效
+func (s *AuthService) SetPassword(userID, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("密码哈希失败: %w", err)
+	}
+	res, err := s.db.Exec("UPDATE users SET password_hash = ?, updated = ? WHERE id = ?",
+		string(hash), time.Now().Format(time.RFC3339), userID)
+	if err != nil {
+		return fmt.Errorf("修改密码失败: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("用户不存在: %s", userID)
+	}
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("清除会话失败: %w", err)
+	}
+	return nil
+}
+
+// Authenticate 校验用户名和密码
+func (s *AuthService) Authenticate(username, password string) (*database.User, error) {
+	var hash string
+	row := s.db.QueryRow(`SELECT id, username, role, created, updated, password_hash FROM users WHERE username = ?`, username)
+	user, err := scanUser(row, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		// 仍然计算一次哈希，避免通过响应时间判断用户是否存在
+		dummyOnce.Do(func() { dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost) })
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询用户失败: %w", err)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// CreateSession 为用户创建登录会话，返回会话令牌
+func (s *AuthService) CreateSession(userID string) (string, time.Time, error) {
+	token, err := newToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(s.sessionTTL)
+	_, err = s.db.Exec(`INSERT INTO sessions (token_hash, user_id, expires, created) VALUES (?, ?, ?, ?)`,
+		hashToken(token), userID, expires.UTC().Format(time.RFC3339), now.Format(time.RFC3339))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("创建会话失败: %w", err)
+	}
+	return token, expires, nil
+}
+
+// DeleteSession 注销会话
+func (s *AuthService) DeleteSession(token string) error {
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(token)); err != nil {
+		return fmt.Errorf("删除会话失败: %w", err)
+	}
+	return nil
+}
+
+// PurgeSessions 删除过期会话
+func (s *AuthService) PurgeSessions() error {
+	if _, err := s.db.Exec("DELETE FROM sessions WHERE expires < ?", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return fmt.Errorf("清理过期会话失败: %w", err)
+	}
+	return nil
+}
+
+// UserForToken 根据会话令牌或 API 令牌查找用户
+func (s *AuthService) UserForToken(token string) (*database.User, error) {
+	if token == "" {
+		return nil, ErrInvalidCredentials
+	}
+	h := hashToken(token)
+
+	var expires string
+	row := s.db.QueryRow(`SELECT u.id, u.username, u.role, u.created, u.updated, s.expires
+			  FROM sessions s JOIN users u ON u.id = s.user_id
+			  WHERE s.token_hash = ?`, h)
+	user, err := scanUser(row, &expires)
+	if err == nil {
+		if t, _ := time.Parse(time.RFC3339, expires); time.Now().After(t) {
+			s.db.Exec("DELETE FROM sessions WHERE token_hash = ?", h)
+			return nil, ErrInvalidCredentials
+		}
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("查询会话失败: %w", err)
+	}
+
+	var tokenID string
+	row = s.db.QueryRow(`SELECT u.id, u.username, u.role, u.created, u.updated, t.id
+			  FROM api_tokens t JOIN users u ON u.id = t.user_id
+			  WHERE t.token_hash = ?`, h)
+	user, err = scanUser(row, &tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("查询令牌失败: %w", err)
+	}
+	s.db.Exec("UPDATE api_tokens SET last_used = ? WHERE id = ?", time.Now().Format(time.RFC3339), tokenID)
+	return user, nil
+}
+
+// CreateAPIToken 为用户创建 API 令牌，令牌只在此处返回
+func (s *AuthService) CreateAPIToken(userID, name string) (string, *database.APIToken, error) {
+	if name = strings.TrimSpace(name); name == "" {
+		return "", nil, errors.New("令牌名称不能为空")
+	}
+	token, err := newToken()
+	if err != nil {
+		return "", nil, err
+	}
+	t := &database.APIToken{ID: utils.GenerateID(), UserID: userID, Name: name, Created: time.Now()}
+	_, err = s.db.Exec(`INSERT INTO api_tokens (id, user_id, name, token_hash, created) VALUES (?, ?, ?, ?, ?)`,
+		t.ID, t.UserID, t.Name, hashToken(token), t.Created.Format(time.RFC3339))
+	if err != nil {
+		return "", nil, fmt.Errorf("创建令牌失败: %w", err)
+	}
+	return token, t, nil
+}
+
+// ListAPITokens 列出用户的 API 令牌
+func (s *AuthService) ListAPITokens(userID string) ([]*database.APIToken, error) {
+	rows, err := s.db.Query(`SELECT id, user_id, name, created, last_used FROM api_tokens
+			  WHERE user_id = ? ORDER BY created`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("查询令牌失败: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*database.APIToken{}
+	for rows.Next() {
+		t := &database.APIToken{}
+		var created, lastUsed string
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &created, &lastUsed); err != nil {
+			return nil, fmt.Errorf("扫描令牌数据失败: %w", err)
+		}
+		t.Created, _ = time.Parse(time.RFC3339, created)
+		t.LastUsed, _ = time.Parse(time.RFC3339, lastUsed)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken 删除用户的 API 令牌
+func (s *AuthService) DeleteAPIToken(userID, id string) error {
+	res, err := s.db.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return fmt.Errorf("删除令牌失败: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("令牌不存在: %s", id)
+	}
+	return nil
+}
+
+// Bootstrap 在没有任何用户时创建管理员。password 为空时生成随机密码并返回。
+func (s *AuthService) Bootstrap(username, password string) (created bool, generated string, err error) {
+	n, err := s.UserCount()
+	if err != nil || n > 0 {
+		return false, "", err
+	}
+	if username == "" {
+		username = "admin"
+	}
+	if password == "" {
+		if generated, err = newToken(); err != nil {
+			return false, "", err
+		}
+		generated = generated[:16]
+		password = generated
+	}
+	if _, err := s.CreateUser(username, password, database.RoleAdmin); err != nil {
+		return false, "", err
+	}
+	return true, generated, nil
+}
@@ -1,19 +1,96 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"obsidianfs/internal/database"
+	"obsidianfs/internal/filesystem"
 	"obsidianfs/internal/utils"
 )
 
+// NotebookService 管理笔记本。每个笔记本对应文件系统根目录下的一个同名文件夹，
+// 创建、重命名、删除笔记本时会同步修改该文件夹。
 type NotebookService struct {
-	db *database.DB
+	db      *database.DB
+	fs      *filesystem.Service
+	root    string
+	exclude string // 不作为笔记本的根目录文件夹（附件目录）
 }
 
-func NewNotebookService(db *database.DB) *NotebookService {
-	return &NotebookService{db: db}
+// NewNotebookService 创建笔记本服务。root 为文件系统根目录的绝对路径，
+// attachmentsDir 为附件目录，位于根目录下时不登记为笔记本
+func NewNotebookService(db *database.DB, fsSvc *filesystem.Service, root, attachmentsDir string) *NotebookService {
+	exclude := strings.TrimPrefix(path.Clean("/"+attachmentsDir), "/")
+	if strings.Contains(exclude, "/") {
+		exclude = ""
+	}
+	return &NotebookService{db: db, fs: fsSvc, root: root, exclude: exclude}
+}
+
+// FolderPath 返回笔记本对应的文件夹路径（相对文件系统根目录）
+func FolderPath(name string) string {
+	return "/" + name
+}
+
+// validateNotebookName 校验笔记本名称能否作为文件夹名使用
+func validateNotebookName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("笔记本名称不能为空")
+	}
+	if name == "." || name == ".." || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("笔记本名称不能以 . 开头")
+	}
+	if strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("笔记本名称不能包含路径分隔符")
+	}
+	return nil
+}
+
+// folderExists 检查文件夹是否存在
+func (s *NotebookService) folderExists(path string) (bool, error) {
+	info, err := s.fs.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// renameFolder 在笔记本改名时同步重命名文件夹
+func (s *NotebookService) renameFolder(oldName, newName string) error {
+	if oldName == newName {
+		return nil
+	}
+	if err := validateNotebookName(newName); err != nil {
+		return err
+	}
+	exists, err := s.folderExists(FolderPath(newName))
+	if err != nil {
+		return fmt.Errorf("检查笔记本文件夹失败: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("文件夹 %s 已存在", newName)
+	}
+	oldExists, err := s.folderExists(FolderPath(oldName))
+	if err != nil {
+		return fmt.Errorf("检查笔记本文件夹失败: %w", err)
+	}
+	if !oldExists {
+		return s.fs.CreateFolder(FolderPath(newName))
+	}
+	if err := s.fs.RenamePath(FolderPath(oldName), FolderPath(newName)); err != nil {
+		return fmt.Errorf("重命名笔记本文件夹失败: %w", err)
+	}
+	return nil
 }
 
 // ListNotebooks 获取所有笔记本列表
@@ -91,6 +168,13 @@ func (s *NotebookService) GetNotebook(id string) (*database.Notebook, error) {
 
 // CreateNotebook 创建新笔记本
 func (s *NotebookService) CreateNotebook(name, icon string) (*database.Notebook, error) {
+	if err := validateNotebookName(name); err != nil {
+		return nil, err
+	}
+	if existing, _ := s.getNotebookByName(name); existing != nil {
+		return nil, fmt.Errorf("笔记本 %s 已存在", name)
+	}
+
 	// 生成ID
 	id := utils.GenerateID()
 	now := time.Now()
@@ -129,6 +213,12 @@ func (s *NotebookService) CreateNotebook(name, icon string) (*database.Notebook,
 		return nil, fmt.Errorf("创建笔记本失败: %w", err)
 	}
 
+	// 创建对应的文件夹（已存在时直接沿用）
+	if err := s.fs.CreateFolder(FolderPath(name)); err != nil {
+		s.db.Exec("DELETE FROM notebooks WHERE id = ?", notebook.ID)
+		return nil, fmt.Errorf("创建笔记本文件夹失败: %w", err)
+	}
+
 	return notebook, nil
 }
 
@@ -136,12 +226,21 @@ func (s *NotebookService) CreateNotebook(name, icon string) (*database.Notebook,
 func (s *NotebookService) UpdateNotebook(id, name, icon string) (*database.Notebook, error) {
 	now := time.Now()
 
+	current, err := s.GetNotebook(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.renameFolder(current.Name, name); err != nil {
+		return nil, err
+	}
+
 	query := `UPDATE notebooks 
 			  SET name = ?, icon = ?, updated = ? 
 			  WHERE id = ?`
 
 	result, err := s.db.Exec(query, name, icon, now.Format(time.RFC3339), id)
 	if err != nil {
+		s.renameFolder(name, current.Name)
 		return nil, fmt.Errorf("更新笔记本失败: %w", err)
 	}
 
@@ -162,12 +261,21 @@ func (s *NotebookService) UpdateNotebook(id, name, icon string) (*database.Noteb
 func (s *NotebookService) RenameNotebook(id, name string) (*database.Notebook, error) {
 	now := time.Now()
 
+	current, err := s.GetNotebook(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.renameFolder(current.Name, name); err != nil {
+		return nil, err
+	}
+
 	query := `UPDATE notebooks 
 			  SET name = ?, updated = ? 
 			  WHERE id = ?`
 
 	result, err := s.db.Exec(query, name, now.Format(time.RFC3339), id)
 	if err != nil {
+		s.renameFolder(name, current.Name)
 		return nil, fmt.Errorf("重命名笔记本失败: %w", err)
 	}
 
@@ -254,36 +362,53 @@ func (s *NotebookService) CloseNotebook(id string) error {
 	return nil
 }
 
-// DeleteNotebook 删除笔记本
-func (s *NotebookService) DeleteNotebook(id string) error {
+// DeleteNotebook 删除笔记本，对应的文件夹移入回收站，返回回收站条目（文件夹不存在时为 nil）
+func (s *NotebookService) DeleteNotebook(id string) (*filesystem.TrashItem, error) {
+	notebook, err := s.GetNotebook(id)
+	if err != nil {
+		return nil, err
+	}
+
 	tx, err := s.db.BeginTx()
 	if err != nil {
-		return fmt.Errorf("开始事务失败: %w", err)
+		return nil, fmt.Errorf("开始事务失败: %w", err)
 	}
 	defer tx.Rollback()
 
 	// 删除笔记本下的所有块
 	_, err = tx.Exec("DELETE FROM blocks WHERE box = ?", id)
 	if err != nil {
-		return fmt.Errorf("删除笔记本下的块失败: %w", err)
+		return nil, fmt.Errorf("删除笔记本下的块失败: %w", err)
 	}
 
 	// 删除笔记本
 	result, err := tx.Exec("DELETE FROM notebooks WHERE id = ?", id)
 	if err != nil {
-		return fmt.Errorf("删除笔记本失败: %w", err)
+		return nil, fmt.Errorf("删除笔记本失败: %w", err)
 	}
 
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("获取影响行数失败: %w", err)
+		return nil, fmt.Errorf("获取影响行数失败: %w", err)
 	}
 
 	if rowsAffected == 0 {
-		return fmt.Errorf("笔记本不存在")
+		return nil, fmt.Errorf("笔记本不存在")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("提交事务失败: %w", err)
 	}
 
-	return tx.Commit()
+	// 提交成功后再把对应的文件夹移入回收站，文件夹不存在时没有可恢复的内容
+	item, err := s.fs.TrashPath(FolderPath(notebook.Name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("笔记本已删除，但移动文件夹到回收站失败: %w", err)
+	}
+	return item, nil
 }
 
 // ChangeSortNotebook 更改笔记本排序
@@ -328,3 +453,94 @@ func (s *NotebookService) IsNotebookExists(id string) (bool, error) {
 	}
 	return count > 0, nil
 }
+
+// getNotebookByName 根据名称获取笔记本
+func (s *NotebookService) getNotebookByName(name string) (*database.Notebook, error) {
+	var id string
+	err := s.db.QueryRow("SELECT id FROM notebooks WHERE name = ?", name).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetNotebook(id)
+}
+
+// BoxForPath 返回文件所属笔记本的ID，文件不在任何笔记本文件夹下时返回空字符串
+func (s *NotebookService) BoxForPath(relPath string) string {
+	top := strings.SplitN(strings.TrimPrefix(relPath, "/"), "/", 2)[0]
+	if top == "" {
+		return ""
+	}
+	notebook, err := s.getNotebookByName(top)
+	if err != nil {
+		return ""
+	}
+	return notebook.ID
+}
+
+// SyncFolders 同步笔记本与文件夹：为缺少文件夹的笔记本创建文件夹，
+// 并把根目录下尚未登记的文件夹登记为笔记本（忽略的文件夹和附件目录除外）
+func (s *NotebookService) SyncFolders() error {
+	notebooks, err := s.ListNotebooks()
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool, len(notebooks))
+	for _, notebook := range notebooks {
+		known[notebook.Name] = true
+		if err := s.fs.CreateFolder(FolderPath(notebook.Name)); err != nil {
+			return fmt.Errorf("创建笔记本文件夹失败: %w", err)
+		}
+	}
+
+	tree, err := s.fs.ListTree("/", 0)
+	if err != nil {
+		return fmt.Errorf("读取根目录失败: %w", err)
+	}
+	for _, child := range tree.Children {
+		if child.Type != "folder" || known[child.Name] || child.Name == s.exclude || validateNotebookName(child.Name) != nil {
+			continue
+		}
+		if _, err := s.CreateNotebook(child.Name, "📔"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OnFsEvent 实现 filesystem.Listener；笔记本只需跟随重命名
+func (s *NotebookService) OnFsEvent(action string, absPath string) {}
+
+// OnFsRename 在根目录下的笔记本文件夹被重命名（通过 /api/move 或外部程序）
+// 时同步修改笔记本名称
+func (s *NotebookService) OnFsRename(fromAbs, toAbs string) {
+	from, err1 := filepath.Rel(s.root, fromAbs)
+	to, err2 := filepath.Rel(s.root, toAbs)
+	if err1 != nil || err2 != nil {
+		return
+	}
+	from, to = filepath.ToSlash(from), filepath.ToSlash(to)
+	if strings.Contains(from, "/") || strings.Contains(to, "/") || strings.HasPrefix(from, "..") || strings.HasPrefix(to, "..") {
+		return
+	}
+	notebook, err := s.getNotebookByName(from)
+	if err != nil {
+		// 笔记本重命名时数据库已先行更新
+		return
+	}
+	if to == s.exclude || validateNotebookName(to) != nil {
+		log.Printf("文件夹 %s 已重命名为 %s，无法作为笔记本名称", from, to)
+		return
+	}
+	if existing, _ := s.getNotebookByName(to); existing != nil {
+		log.Printf("文件夹 %s 已重命名为 %s，但笔记本 %s 已存在", from, to, to)
+		return
+	}
+	query := `UPDATE notebooks 
+			  SET name = ?, updated = ? 
+			  WHERE id = ?`
+	if _, err := s.db.Exec(query, to, time.Now().Format(time.RFC3339), notebook.ID); err != nil {
+		log.Printf("更新笔记本名称失败: %v", err)
+	}
+}
@@ -0,0 +1,265 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/tags"
+)
+
+const (
+	defaultSearchPageSize = 32
+	maxSearchPageSize     = 200
+)
+
+// SearchService 基于 blocks_fts 全文索引的搜索
+type SearchService struct {
+	db   *database.DB
+	tags *tags.Indexer
+}
+
+func NewSearchService(db *database.DB, tagIndexer *tags.Indexer) *SearchService {
+	return &SearchService{db: db, tags: tagIndexer}
+}
+
+// SearchOptions 搜索参数
+type SearchOptions struct {
+	Query    string                 // 关键词，支持 "短语" 与 前缀*
+	Path     string                 // 仅搜索该路径（文件或文件夹）下的内容
+	Notebook string                 // 笔记本ID
+	Tag      string                 // 仅搜索带有该标签（含其子标签）的文件
+	Allow    func(path string) bool // 不为 nil 时只返回其允许的文件中的块
+	Page     int                    // 从 1 开始
+	PageSize int                    // 最大 200
+}
+
+// minMatchTerm 是 trigram 分词能用 MATCH 查找的最短词长（字符数）
+const minMatchTerm = 3
+
+// ParseQuery 把用户输入转换为 FTS5 MATCH 表达式：
+// 引号内的内容作为短语，以 * 结尾的词作为前缀匹配，其余词按 AND 组合。
+// 每个词都会加引号，避免用户输入中的 FTS5 语法字符导致查询出错。
+// trigram 分词无法用 MATCH 查找不足三个字符的词（如两个字的中文词），
+// 这些词单独返回，由调用方用 LIKE 子串匹配。
+func ParseQuery(input string) (match string, short []string) {
+	var terms []string
+	add := func(term string, prefix bool) {
+		if utf8.RuneCountInString(term) < minMatchTerm {
+			short = append(short, term)
+			return
+		}
+		term = quoteTerm(term)
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	rest := strings.TrimSpace(input)
+	for rest != "" {
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			var phrase string
+			if end < 0 {
+				phrase, rest = rest[1:], ""
+			} else {
+				phrase, rest = rest[1:end+1], rest[end+2:]
+			}
+			if strings.TrimSpace(phrase) != "" {
+				add(phrase, false)
+			}
+		} else {
+			end := strings.IndexAny(rest, " \t\n\"")
+			var word string
+			if end < 0 {
+				word, rest = rest, ""
+			} else {
+				word, rest = rest[:end], rest[end:]
+			}
+			prefix := strings.HasSuffix(word, "*")
+			word = strings.TrimRight(word, "*")
+			if word != "" {
+				add(word, prefix)
+			}
+		}
+		rest = strings.TrimLeft(rest, " \t\n")
+	}
+	return strings.Join(terms, " "), short
+}
+
+func quoteTerm(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
+
+// likePattern 返回匹配包含 term 的文本的 LIKE 模式（转义字符为 \）
+func likePattern(term string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(term) + "%"
+}
+
+// Search 执行全文搜索，返回带高亮片段（<mark>）的块列表和分页信息
+func (s *SearchService) Search(opts SearchOptions) (*database.SearchResult, error) {
+	if !s.db.HasFTS() {
+		return nil, fmt.Errorf("全文搜索不可用：服务端需使用 -tags sqlite_fts5 构建")
+	}
+	match, short := ParseQuery(opts.Query)
+	if match == "" && len(short) == 0 {
+		return nil, fmt.Errorf("搜索关键词不能为空")
+	}
+	if opts.Page < 1 {
+		opts.Page = 1
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = defaultSearchPageSize
+	}
+	opts.PageSize = min(opts.PageSize, maxSearchPageSize)
+
+	var where []string
+	var args []interface{}
+	if match != "" {
+		where = append(where, "blocks_fts MATCH ?")
+		args = append(args, match)
+	}
+	for _, term := range short {
+		where = append(where, `f.content LIKE ? ESCAPE '\'`)
+		args = append(args, likePattern(term))
+	}
+	if p := strings.TrimSuffix(opts.Path, "/"); p != "" {
+		where = append(where, "(f.path = ? OR substr(f.path, 1, ?) = ?)")
+		args = append(args, p, utf8.RuneCountInString(p)+1, p+"/")
+	}
+	if opts.Notebook != "" {
+		where = append(where, "f.box = ?")
+		args = append(args, opts.Notebook)
+	}
+	// 标签索引使用同一个数据库连接，须在开始事务前查询
+	var tagPaths []string
+	if opts.Tag != "" {
+		if s.tags != nil {
+			for _, ref := range s.tags.FilesForTag(opts.Tag, true) {
+				tagPaths = append(tagPaths, ref.Path)
+			}
+		}
+		if len(tagPaths) == 0 {
+			return &database.SearchResult{Blocks: []*database.Block{}}, nil
+		}
+	}
+
+	// 标签和权限筛选出的文件可能很多，放进临时表而不是逐个绑定参数，
+	// 以免超过 SQLite 的参数个数上限。临时表的内容只在本次事务内有效
+	tx, err := s.db.BeginTx()
+	if err != nil {
+		return nil, fmt.Errorf("搜索失败: %w", err)
+	}
+	defer tx.Rollback()
+
+	if tagPaths != nil {
+		if err := fillPathTable(tx, "search_tag_paths", tagPaths); err != nil {
+			return nil, err
+		}
+		where = append(where, "f.path IN (SELECT path FROM temp.search_tag_paths)")
+	}
+	cond := strings.Join(where, " AND ")
+
+	if opts.Allow != nil {
+		paths, err := matchedPaths(tx, cond, args)
+		if err != nil {
+			return nil, err
+		}
+		var allowed []string
+		for _, p := range paths {
+			if opts.Allow(p) {
+				allowed = append(allowed, p)
+			}
+		}
+		if len(allowed) == 0 {
+			return &database.SearchResult{Blocks: []*database.Block{}}, nil
+		}
+		if err := fillPathTable(tx, "search_allowed_paths", allowed); err != nil {
+			return nil, err
+		}
+		cond += " AND f.path IN (SELECT path FROM temp.search_allowed_paths)"
+	}
+
+	result := &database.SearchResult{Blocks: []*database.Block{}}
+	err = tx.QueryRow("SELECT COUNT(*), COUNT(DISTINCT f.root_id) FROM blocks_fts f WHERE "+cond, args...).
+		Scan(&result.MatchedBlockCount, &result.MatchedRootCount)
+	if err != nil {
+		return nil, fmt.Errorf("搜索失败: %w", err)
+	}
+	result.PageCount = (result.MatchedBlockCount + opts.PageSize - 1) / opts.PageSize
+
+	query := `SELECT b.id, b.parent_id, b.root_id, b.type, b.subtype,
+			  snippet(blocks_fts, 5, '<mark>', '</mark>', '...', 32),
+			  b.markdown, b.path, b.hpath, b.name, b.alias, b.memo, b.tag, b.ial, b.sort, b.box, b.created, b.updated
+			  FROM blocks_fts f JOIN blocks b ON b.rowid = f.rowid
+			  WHERE ` + cond + `
+			  ORDER BY rank
+			  LIMIT ? OFFSET ?`
+	rows, err := tx.Query(query, append(args, opts.PageSize, (opts.Page-1)*opts.PageSize)...)
+	if err != nil {
+		return nil, fmt.Errorf("搜索失败: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		block := &database.Block{}
+		var created, updated string
+		err := rows.Scan(
+			&block.ID, &block.ParentID, &block.RootID, &block.Type, &block.SubType,
+			&block.Content,
+			&block.Markdown, &block.Path, &block.HPath, &block.Name, &block.Alias, &block.Memo, &block.Tag, &block.IAL,
+			&block.Sort, &block.Box, &created, &updated,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("扫描搜索结果失败: %w", err)
+		}
+		block.Created, _ = time.Parse(time.RFC3339, created)
+		block.Updated, _ = time.Parse(time.RFC3339, updated)
+		result.Blocks = append(result.Blocks, block)
+	}
+
+	return result, nil
+}
+
+// matchedPaths 返回满足条件的块所在的文件
+func matchedPaths(tx *sql.Tx, cond string, args []interface{}) ([]string, error) {
+	rows, err := tx.Query("SELECT DISTINCT f.path FROM blocks_fts f WHERE "+cond, args...)
+	if err != nil {
+		return nil, fmt.Errorf("搜索失败: %w", err)
+	}
+	defer rows.Close()
+	var paths []string
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return nil, fmt.Errorf("扫描搜索结果失败: %w", err)
+		}
+		paths = append(paths, p)
+	}
+	return paths, rows.Err()
+}
+
+// fillPathTable 在事务内创建（或清空）临时表 table，并写入 paths
+func fillPathTable(tx *sql.Tx, table string, paths []string) error {
+	if _, err := tx.Exec("CREATE TEMP TABLE IF NOT EXISTS " + table + " (path TEXT PRIMARY KEY)"); err != nil {
+		return fmt.Errorf("创建临时表失败: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM temp." + table); err != nil {
+		return fmt.Errorf("清空临时表失败: %w", err)
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO temp." + table + " (path) VALUES (?)")
+	if err != nil {
+		return fmt.Errorf("写入临时表失败: %w", err)
+	}
+	defer stmt.Close()
+	for _, p := range paths {
+		if _, err := stmt.Exec(p); err != nil {
+			return fmt.Errorf("写入临时表失败: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"obsidianfs/internal/database"
+	"obsidianfs/internal/safepath"
+	"obsidianfs/internal/tags"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		input string
+		match string
+		short []string
+	}{
+		{"", "", nil},
+		{"hello world", `"hello" "world"`, nil},
+		{`"exact phrase" word`, `"exact phrase" "word"`, nil},
+		{"pre*", `"pre"*`, nil},
+		{`unclosed "quote here`, `"unclosed" "quote here"`, nil},
+		{`abc"def"ghi`, `"abc" "def" "ghi"`, nil},
+		{`NOT OR AND`, `"NOT" "AND"`, []string{"OR"}},
+		{`"say ""hi"""`, `"say "`, []string{"hi"}},
+		{"中文 搜索测试", `"搜索测试"`, []string{"中文"}},
+		{"ab* 日本語", `"日本語"`, []string{"ab"}},
+		{`"" ***`, "", nil},
+	}
+	for _, tt := range tests {
+		match, short := ParseQuery(tt.input)
+		if match != tt.match || !reflect.DeepEqual(short, tt.short) {
+			t.Errorf("ParseQuery(%q) = %q, %q, want %q, %q", tt.input, match, short, tt.match, tt.short)
+		}
+	}
+}
+
+// testSearch opens a database in a temp dir and indexes one document
+// block per path with the given content. It skips the test when FTS5 is
+// not compiled in (build with -tags sqlite_fts5).
+func testSearch(t *testing.T, docs map[string]string) *SearchService {
+	t.Helper()
+	db, err := database.InitDatabase(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if !db.HasFTS() {
+		t.Skip("FTS5 not available; run with -tags sqlite_fts5")
+	}
+	tx, err := db.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().Format(time.RFC3339)
+	for p, content := range docs {
+		box := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)[0]
+		id := "id" + strings.NewReplacer("/", "-", ".", "-").Replace(p)
+		_, err := tx.Exec(`INSERT INTO blocks (id, parent_id, root_id, type, content, markdown, path, box, created, updated)
+			VALUES (?, '', ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, id, database.NodeDocument, content, content, p, box, now, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return NewSearchService(db, nil)
+}
+
+func searchPaths(t *testing.T, s *SearchService, opts SearchOptions) []string {
+	t.Helper()
+	result, err := s.Search(opts)
+	if err != nil {
+		t.Fatalf("Search(%+v): %v", opts, err)
+	}
+	var paths []string
+	for _, block := range result.Blocks {
+		paths = append(paths, block.Path)
+	}
+	return paths
+}
+
+func TestSearch(t *testing.T) {
+	s := testSearch(t, map[string]string{
+		"/nb1/cjk.md":      "这是中文搜索测试，没有空格",
+		"/nb1/sub/café.md": "Un café au lait, s'il vous plaît",
+		"/nb2/en.md":       "Hello world, hello again",
+		"/nb2/percent.md":  "100% done",
+	})
+	tests := []struct {
+		name string
+		opts SearchOptions
+		want []string
+	}{
+		{"cjk inside a run", SearchOptions{Query: "搜索测试"}, []string{"/nb1/cjk.md"}},
+		{"short cjk word", SearchOptions{Query: "中文"}, []string{"/nb1/cjk.md"}},
+		{"short and long terms", SearchOptions{Query: "中文 没有空格"}, []string{"/nb1/cjk.md"}},
+		{"no match", SearchOptions{Query: "中文 hello"}, nil},
+		{"diacritics", SearchOptions{Query: "cafe"}, []string{"/nb1/sub/café.md"}},
+		{"case", SearchOptions{Query: "HELLO"}, []string{"/nb2/en.md"}},
+		{"phrase", SearchOptions{Query: `"world, hello"`}, []string{"/nb2/en.md"}},
+		{"prefix", SearchOptions{Query: "wor*"}, []string{"/nb2/en.md"}},
+		{"like wildcards are literal", SearchOptions{Query: "%"}, []string{"/nb2/percent.md"}},
+		{"underscore is literal", SearchOptions{Query: "_"}, nil},
+		{"path", SearchOptions{Query: "cafe", Path: "/nb1/sub"}, []string{"/nb1/sub/café.md"}},
+		{"path excludes", SearchOptions{Query: "cafe", Path: "/nb2"}, nil},
+		{"path is not a prefix match", SearchOptions{Query: "cafe", Path: "/nb1/su"}, nil},
+		{"notebook", SearchOptions{Query: "hello", Notebook: "nb1"}, nil},
+		{"allow", SearchOptions{Query: "o", Allow: func(p string) bool { return p == "/nb2/percent.md" }}, []string{"/nb2/percent.md"}},
+		{"tag without index", SearchOptions{Query: "hello", Tag: "x"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := searchPaths(t, s, tt.opts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := s.Search(SearchOptions{Query: `"" *`}); err == nil {
+		t.Error("empty query: expected an error")
+	}
+}
+
+func TestSearchSnippet(t *testing.T) {
+	s := testSearch(t, map[string]string{"/nb/a.md": "这是中文搜索测试"})
+	result, err := s.Search(SearchOptions{Query: "搜索测试"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Blocks) != 1 || !strings.Contains(result.Blocks[0].Content, "<mark>搜索测试</mark>") {
+		t.Fatalf("blocks = %+v", result.Blocks)
+	}
+}
+
+func TestSearchPaging(t *testing.T) {
+	docs := map[string]string{}
+	for i := range 250 {
+		docs[fmt.Sprintf("/nb/%03d.md", i)] = "common text"
+	}
+	s := testSearch(t, docs)
+
+	result, err := s.Search(SearchOptions{Query: "common", PageSize: 100000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Blocks) != maxSearchPageSize || result.PageCount != 2 || result.MatchedBlockCount != 250 {
+		t.Errorf("capped page: %d blocks, %d pages, %d matched", len(result.Blocks), result.PageCount, result.MatchedBlockCount)
+	}
+
+	result, err = s.Search(SearchOptions{Query: "common", Page: 8, PageSize: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Blocks) != 250-7*defaultSearchPageSize || result.PageCount != 8 {
+		t.Errorf("last default page: %d blocks, %d pages", len(result.Blocks), result.PageCount)
+	}
+}
+
+// TestSearchManyPaths filters on more files than SQLite accepts bound
+// parameters in one statement (32766).
+func TestSearchManyPaths(t *testing.T) {
+	if testing.Short() {
+		t.Skip("indexes 40000 blocks")
+	}
+	const n = 40000
+	docs := make(map[string]string, n)
+	for i := range n {
+		docs[fmt.Sprintf("/nb/%05d.md", i)] = "common text"
+	}
+	s := testSearch(t, docs)
+
+	resolver, err := safepath.New(t.TempDir(), safepath.SymlinkInside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.tags = tags.NewIndexer(s.db, resolver, nil)
+	tx, err := s.db.BeginTx()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p := range docs {
+		if _, err := tx.Exec("INSERT INTO tag_files (path, mtime, size, hash) VALUES (?, '', 0, '')", p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Exec("INSERT INTO file_tags (path, tag, count) VALUES (?, 'project/a', 1)", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Search(SearchOptions{
+		Query: "common",
+		Tag:   "project",
+		Allow: func(p string) bool { return p != "/nb/00000.md" },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MatchedBlockCount != n-1 || len(result.Blocks) != defaultSearchPageSize {
+		t.Errorf("matched %d blocks, got %d on the page", result.MatchedBlockCount, len(result.Blocks))
+	}
+
+	// The temp tables are emptied between searches
+	result, err = s.Search(SearchOptions{Query: "common", Tag: "project", Allow: func(p string) bool { return p == "/nb/00000.md" }})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.MatchedBlockCount != 1 {
+		t.Errorf("second search matched %d blocks, want 1", result.MatchedBlockCount)
+	}
+}
@@ -0,0 +1,76 @@
+package tags
+
+import (
+    "flag"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// TestExtractTagsGolden extracts the tags of each testdata/extract/*.md
+// file and compares them, one "tag count" line each, with the .golden file
+// next to it. Run with -update to rewrite the golden files.
+func TestExtractTagsGolden(t *testing.T) {
+    files, err := filepath.Glob(filepath.Join("testdata", "extract", "*.md"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(files) == 0 {
+        t.Fatal("no test files")
+    }
+    for _, file := range files {
+        name := strings.TrimSuffix(filepath.Base(file), ".md")
+        t.Run(name, func(t *testing.T) {
+            content, err := os.ReadFile(file)
+            if err != nil {
+                t.Fatal(err)
+            }
+            got := formatTags(extractTags(string(content)))
+            golden := strings.TrimSuffix(file, ".md") + ".golden"
+            if *update {
+                if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+                    t.Fatal(err)
+                }
+                return
+            }
+            want, err := os.ReadFile(golden)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got != string(want) {
+                t.Errorf("tags of %s:\n%s\nwant:\n%s", file, got, want)
+            }
+        })
+    }
+}
+
+// TestRenameSkipsCode checks that renaming a tag leaves code alone.
+func TestRenameSkipsCode(t *testing.T) {
+    content := "#todo in text\n\n```\n#todo in code\n```\n\n`#todo` and #todo/later\n"
+    want := "#task in text\n\n```\n#todo in code\n```\n\n`#todo` and #task/later\n"
+    got, edits := renameIn(content, "todo", "task")
+    if got != want {
+        t.Errorf("renamed to %q, want %q", got, want)
+    }
+    if len(edits) != 2 {
+        t.Errorf("got %d edits, want 2", len(edits))
+    }
+}
+
+func formatTags(tags map[string]int) string {
+    names := make([]string, 0, len(tags))
+    for name := range tags {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var b strings.Builder
+    for _, name := range names {
+        fmt.Fprintf(&b, "%s %d\n", name, tags[name])
+    }
+    return b.String()
+}
@@ -1,26 +1,46 @@
 package tags
 
 import (
-    "bufio"
+    "crypto/sha256"
+    "database/sql"
+    "encoding/hex"
+    "fmt"
     "os"
+    "path"
     "path/filepath"
     "regexp"
     "sort"
     "strings"
     "sync"
+    "time"
+    "unicode"
+
+    "obsidianfs/internal/database"
+    "obsidianfs/internal/frontmatter"
+    "obsidianfs/internal/ignore"
+    "obsidianfs/internal/safepath"
+
+    "gopkg.in/yaml.v3"
 )
 
-// Indexer builds and maintains a tag index from markdown files under a root directory.
-// It supports:
-//  - ReindexAll: full scan
+// indexVersion changes whenever tag extraction does, so files indexed by an
+// older version are reindexed at startup.
+const indexVersion = 3
+
+// reindexBatch is the number of files ReindexAll writes per transaction.
+const reindexBatch = 500
+
+// Indexer maintains a tag index of the markdown files under a root
+// directory in the tag_files and file_tags tables. It supports:
+//  - ReindexAll: scan at startup, reindexing only files that changed
 //  - OnFsEvent: incremental updates on create/modify/delete/rename
 //  - Query tags list and files by tag
 type Indexer struct {
+    db           *database.DB
     root         string
-    mu           sync.RWMutex
-    tagToFiles   map[string]map[string]int   // tag -> file path -> count
-    fileToTags   map[string]map[string]int   // file path -> tag -> count
-    tagRegex     *regexp.Regexp
+    mu           sync.Mutex // serializes writes
+    resolver     *safepath.Resolver
+    ignore       *ignore.Matcher
 }
 
 type TagCount struct {
@@ -33,50 +53,156 @@ type TagFileRef struct {
     Count int    `json:"count"`
 }
 
-func NewIndexer(root string) *Indexer {
-    // Match inline tags. Support both '#' and '＃' and Unicode letters/numbers, underscores, hyphen, slash
-    // Examples: #tag, #中文, #tag/sub, #long-tag_1
-    tagRegex := regexp.MustCompile(`(?m)(?:^|[\s])[#＃]([\p{L}\p{N}_\-/]+)`) // capture group 1 is the tag
+// tagRegex matches inline tags. Support both '#' and '＃' and Unicode letters/numbers, underscores, hyphen, slash
+// Examples: #tag, #中文, #tag/sub, #long-tag_1
+var tagRegex = regexp.MustCompile(`(?m)(?:^|[\s])[#＃]([\p{L}\p{N}_\-/]+)`) // capture group 1 is the tag
+
+func NewIndexer(db *database.DB, resolver *safepath.Resolver, ignore *ignore.Matcher) *Indexer {
     return &Indexer{
-        root:       root,
-        tagToFiles: make(map[string]map[string]int),
-        fileToTags: make(map[string]map[string]int),
-        tagRegex:   tagRegex,
+        db:         db,
+        root:       resolver.Root(),
+        resolver:   resolver,
+        ignore:     ignore,
     }
 }
 
-// ReindexAll scans the entire root and rebuilds the index.
+// fileState is what the index knows about a file's content.
+type fileState struct {
+    mtime   string
+    size    int64
+    hash    string
+    version int
+}
+
+func modTime(info os.FileInfo) string {
+    return info.ModTime().UTC().Format(time.RFC3339Nano)
+}
+
+func contentHash(b []byte) string {
+    sum := sha256.Sum256(b)
+    return hex.EncodeToString(sum[:])
+}
+
+// ReindexAll scans the entire root. Files whose modification time, size
+// and index version are unchanged are skipped, and so are files whose
+// content hash is unchanged; files that disappeared or are now ignored are
+// dropped.
 func (x *Indexer) ReindexAll() error {
     x.mu.Lock()
-    x.tagToFiles = make(map[string]map[string]int)
-    x.fileToTags = make(map[string]map[string]int)
-    x.mu.Unlock()
+    defer x.mu.Unlock()
+
+    known := make(map[string]fileState)
+    rows, err := x.db.Query("SELECT path, mtime, size, hash, version FROM tag_files")
+    if err != nil {
+        return err
+    }
+    for rows.Next() {
+        var p string
+        var st fileState
+        if err := rows.Scan(&p, &st.mtime, &st.size, &st.hash, &st.version); err == nil {
+            known[p] = st
+        }
+    }
+    rows.Close()
 
-    // Walk through root and index markdown files
-    err := filepath.WalkDir(x.root, func(p string, d os.DirEntry, err error) error {
+    tx, err := x.db.BeginTx()
+    if err != nil {
+        return err
+    }
+    defer func() { tx.Rollback() }()
+    pending := 0
+    seen := make(map[string]bool)
+    err = filepath.WalkDir(x.root, func(p string, d os.DirEntry, err error) error {
+        if err != nil { return nil }
+        if p != x.root && x.ignore.MatchAbs(p, d.IsDir()) {
+            if d.IsDir() { return filepath.SkipDir }
+            return nil
+        }
+        if d.IsDir() || !isMarkdown(p) { return nil }
+        rel := toRelPath(x.root, p)
+        seen[rel] = true
+        info, err := d.Info()
+        if err != nil { return nil }
+        st, ok := known[rel]
+        if ok && st.version == indexVersion && st.mtime == modTime(info) && st.size == info.Size() {
+            return nil
+        }
+        if err := x.resolver.Check(p); err != nil {
+            seen[rel] = false
+            return nil
+        }
+        b, err := os.ReadFile(p)
         if err != nil { return nil }
-        if d.IsDir() { return nil }
-        if !isMarkdown(p) { return nil }
-        return x.indexFile(p)
+        hash := contentHash(b)
+        if ok && st.version == indexVersion && st.hash == hash {
+            _, err = tx.Exec("UPDATE tag_files SET mtime = ?, size = ? WHERE path = ?", modTime(info), info.Size(), rel)
+        } else {
+            err = x.store(tx, rel, info, hash, extractTags(string(b)))
+        }
+        if err != nil {
+            return fmt.Errorf("index %s: %w", rel, err)
+        }
+        if pending++; pending >= reindexBatch {
+            if err := tx.Commit(); err != nil { return err }
+            if tx, err = x.db.BeginTx(); err != nil { return err }
+            pending = 0
+        }
+        return nil
     })
-    return err
+    if err != nil {
+        return err
+    }
+    for p := range known {
+        if !seen[p] {
+            if _, err := tx.Exec("DELETE FROM tag_files WHERE path = ?", p); err != nil {
+                return err
+            }
+        }
+    }
+    return tx.Commit()
+}
+
+// store replaces the tags of a file.
+func (x *Indexer) store(tx *sql.Tx, rel string, info os.FileInfo, hash string, tags map[string]int) error {
+    _, err := tx.Exec(`INSERT INTO tag_files (path, mtime, size, hash, version) VALUES (?, ?, ?, ?, ?)
+        ON CONFLICT(path) DO UPDATE SET mtime = excluded.mtime, size = excluded.size, hash = excluded.hash, version = excluded.version`,
+        rel, modTime(info), info.Size(), hash, indexVersion)
+    if err != nil { return err }
+    if _, err := tx.Exec("DELETE FROM file_tags WHERE path = ?", rel); err != nil { return err }
+    for tag, count := range tags {
+        if _, err := tx.Exec("INSERT INTO file_tags (path, tag, count) VALUES (?, ?, ?)", rel, tag, count); err != nil {
+            return err
+        }
+    }
+    return nil
 }
 
 // OnFsEvent handles fs events to keep the index up-to-date.
-// action one of: created | modified | deleted | renamed. For renamed, relPath is the destination.
+// action one of: created | modified | deleted | renamed. For renamed, absPath is the old path;
+// the new path arrives as a separate created event. Directory events apply to every file below.
 func (x *Indexer) OnFsEvent(action string, absPath string) {
-    // Only care markdown files
-    if !isMarkdown(absPath) {
-        return
-    }
     switch action {
     case "created", "modified":
-        _ = x.indexFile(absPath)
-    case "deleted":
-        x.removeFile(absPath)
-    case "renamed":
+        if info, err := os.Stat(absPath); err == nil && info.IsDir() {
+            _ = filepath.WalkDir(absPath, func(p string, d os.DirEntry, err error) error {
+                if err != nil { return nil }
+                if x.ignore.MatchAbs(p, d.IsDir()) {
+                    if d.IsDir() { return filepath.SkipDir }
+                    return nil
+                }
+                if !d.IsDir() && isMarkdown(p) { _ = x.indexFile(p) }
+                return nil
+            })
+            return
+        }
+        if isMarkdown(absPath) && !x.ignore.MatchAbs(absPath, false) { _ = x.indexFile(absPath) }
+    case "deleted", "renamed":
         // Most watchers emit rename with old path. Treat as deletion; a subsequent create will index new path.
-        x.removeFile(absPath)
+        if isMarkdown(absPath) {
+            x.removeFile(absPath)
+            return
+        }
+        x.removePrefix(absPath)
     }
 }
 
@@ -87,120 +213,159 @@ func isMarkdown(path string) bool {
 
 // indexFile parses a single markdown file and updates the index.
 func (x *Indexer) indexFile(absPath string) error {
-    // Read file
+    // Never read through a symlink that leaves the vault
+    if err := x.resolver.Check(absPath); err != nil {
+        x.removeFile(absPath)
+        return nil
+    }
+    info, err := os.Stat(absPath)
+    if err != nil { return err }
     b, err := os.ReadFile(absPath)
     if err != nil { return err }
-    content := string(b)
-    tags := x.extractTags(content)
+    tags := extractTags(string(b))
 
-    // Update maps
     x.mu.Lock()
     defer x.mu.Unlock()
-
-    // Clear previous
-    if prev, ok := x.fileToTags[absPath]; ok {
-        for t := range prev {
-            if tf, ok := x.tagToFiles[t]; ok {
-                delete(tf, absPath)
-                if len(tf) == 0 { delete(x.tagToFiles, t) }
-            }
-        }
-        delete(x.fileToTags, absPath)
-    }
-
-    if len(tags) == 0 {
-        return nil
-    }
-
-    // Insert new
-    fileMap := make(map[string]int)
-    for tag, count := range tags {
-        if _, ok := x.tagToFiles[tag]; !ok {
-            x.tagToFiles[tag] = make(map[string]int)
-        }
-        x.tagToFiles[tag][absPath] = count
-        fileMap[tag] = count
+    tx, err := x.db.BeginTx()
+    if err != nil { return err }
+    defer tx.Rollback()
+    if err := x.store(tx, toRelPath(x.root, absPath), info, contentHash(b), tags); err != nil {
+        return err
     }
-    x.fileToTags[absPath] = fileMap
-    return nil
+    return tx.Commit()
 }
 
 func (x *Indexer) removeFile(absPath string) {
     x.mu.Lock()
     defer x.mu.Unlock()
-    if prev, ok := x.fileToTags[absPath]; ok {
-        for t := range prev {
-            if tf, ok := x.tagToFiles[t]; ok {
-                delete(tf, absPath)
-                if len(tf) == 0 { delete(x.tagToFiles, t) }
-            }
-        }
-        delete(x.fileToTags, absPath)
-    }
+    _, _ = x.db.Exec("DELETE FROM tag_files WHERE path = ?", toRelPath(x.root, absPath))
+}
+
+// removePrefix drops every file below a removed directory.
+func (x *Indexer) removePrefix(absDir string) {
+    lo, hi := prefixRange(toRelPath(x.root, absDir))
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    _, _ = x.db.Exec("DELETE FROM tag_files WHERE path > ? AND path < ?", lo, hi)
+}
+
+// prefixRange returns the bounds of the paths below the folder rel, or of
+// the tags nested below a tag, for "path > lo AND path < hi".
+func prefixRange(rel string) (lo, hi string) {
+    rel = strings.TrimSuffix(rel, "/")
+    return rel + "/", rel + "0" // '0' follows '/'
 }
 
 // extractTags gets a map of tag -> count from content using frontmatter and inline tag syntax.
-func (x *Indexer) extractTags(content string) map[string]int {
+func extractTags(content string) map[string]int {
     result := map[string]int{}
+    for _, t := range frontmatterTags(content) {
+        if t := normalizeTag(t.value); t != "" { result[t]++ }
+    }
+    for _, sp := range inlineTagSpans(content) {
+        if t := normalizeTag(content[sp.start:sp.end]); t != "" { result[t]++ }
+    }
+    return result
+}
 
-    // Frontmatter between leading --- and next ---
-    fmEnd := -1
-    if strings.HasPrefix(content, "---\n") {
-        // Find the end of frontmatter
-        scanner := bufio.NewScanner(strings.NewReader(content))
-        scanner.Split(bufio.ScanLines)
-        lineNo := 0
-        for scanner.Scan() {
-            line := scanner.Text()
-            if lineNo > 0 && strings.TrimSpace(line) == "---" {
-                fmEnd = lineNo
-                break
-            }
-            lineNo++
-        }
-        if fmEnd >= 0 {
-            frontmatter := strings.Split(content, "\n")[:fmEnd]
-            // Parse tags: [a, b] or multi-line - a
-            for i := 0; i < len(frontmatter); i++ {
-                line := strings.TrimSpace(frontmatter[i])
-                if strings.HasPrefix(strings.ToLower(line), "tags:") {
-                    v := strings.TrimSpace(line[len("tags:"):])
-                    if strings.HasPrefix(v, "[") && strings.Contains(v, "]") {
-                        inside := strings.Trim(strings.TrimPrefix(v, "["), "]")
-                        items := strings.Split(inside, ",")
-                        for _, it := range items {
-                            t := normalizeTag(it)
-                            if t != "" { result[t]++ }
-                        }
-                    } else if v == "" || v == "|" { // handle yaml multiline or folded
-                        // scan following indented lines starting with '-' until non-indented line
-                        j := i + 1
-                        for j < len(frontmatter) {
-                            l := strings.TrimSpace(frontmatter[j])
-                            if strings.HasPrefix(l, "-") {
-                                t := normalizeTag(strings.TrimSpace(strings.TrimPrefix(l, "-")))
-                                if t != "" { result[t]++ }
-                                j++
-                                continue
-                            }
-                            break
-                        }
-                        i = j - 1
-                    }
-                }
-            }
+// tagSpan is where a tag is written in a file: the tag text without the
+// leading '#' or quotes.
+type tagSpan struct {
+    start, end int
+}
+
+// tagSpans finds where the tags of the frontmatter and the inline tags are
+// written. Frontmatter tags that are not written as they read, such as
+// quoted strings with escapes, are left out.
+func tagSpans(content string) []tagSpan {
+    var spans []tagSpan
+    for _, t := range frontmatterTags(content) {
+        if t.located { spans = append(spans, t.span) }
+    }
+    return append(spans, inlineTagSpans(content)...)
+}
+
+// inlineTagSpans finds the inline tags in the text of content, leaving out
+// code, comments, links and tags made of digits only such as #123.
+func inlineTagSpans(content string) []tagSpan {
+    var spans []tagSpan
+    for _, m := range tagRegex.FindAllStringSubmatchIndex(textOnly(content), -1) {
+        if len(m) < 4 { continue }
+        if strings.Trim(content[m[2]:m[3]], "0123456789/") == "" { continue }
+        spans = append(spans, tagSpan{m[2], m[3]})
+    }
+    return spans
+}
+
+// fmTag is a tag of the frontmatter and, if located, where it is written.
+type fmTag struct {
+    value   string
+    span    tagSpan
+    located bool
+}
+
+// frontmatterTags returns the tags of the tags: (or tag:) property, given
+// as a list or as a string of tags separated by commas or spaces.
+func frontmatterTags(content string) []fmTag {
+    fm := frontmatter.Parse(content)
+    if fm == nil { return nil }
+    var out []fmTag
+    for _, key := range []string{"tags", "tag"} {
+        n := fm.Get(key)
+        if n == nil { continue }
+        items := []*yaml.Node{n}
+        if n.Kind == yaml.SequenceNode { items = n.Content }
+        for _, item := range items {
+            if item.Kind != yaml.ScalarNode || item.ShortTag() == "!!null" { continue }
+            out = append(out, scalarTags(content, fm, item)...)
         }
     }
+    return out
+}
 
-    // Inline tags
-    for _, m := range x.tagRegex.FindAllStringSubmatch(content, -1) {
-        if len(m) >= 2 {
-            t := normalizeTag(m[1])
-            if t != "" { result[t]++ }
+// scalarTags splits a frontmatter string into tags, locating them in
+// content when the string is written as it reads.
+func scalarTags(content string, fm *frontmatter.Frontmatter, n *yaml.Node) []fmTag {
+    start := fm.Offset(n)
+    if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 { start++ }
+    located := start >= 0 && strings.HasPrefix(content[start:], n.Value)
+    var out []fmTag
+    rest := n.Value
+    for off := 0; ; {
+        i := strings.IndexFunc(rest, func(r rune) bool { return !isTagSeparator(r) })
+        if i < 0 { break }
+        rest, off = rest[i:], off+i
+        j := strings.IndexFunc(rest, isTagSeparator)
+        if j < 0 { j = len(rest) }
+        t := fmTag{value: rest[:j]}
+        if located {
+            t.span, t.located = trimTag(content, start+off, start+off+j)
         }
+        out = append(out, t)
+        rest, off = rest[j:], off+j
     }
+    return out
+}
 
-    return result
+func isTagSeparator(r rune) bool {
+    return r == ',' || unicode.IsSpace(r)
+}
+
+// trimTag narrows content[start:stop] to the tag, dropping spaces, quotes
+// and a leading '#'.
+func trimTag(content string, start, stop int) (tagSpan, bool) {
+    s := content[start:stop]
+    t := strings.TrimSpace(s)
+    start += strings.Index(s, t)
+    s = t
+    t = strings.TrimLeft(s, "\"'")
+    start += len(s) - len(t)
+    t = strings.TrimRight(t, "\"'")
+    s = t
+    t = strings.TrimLeft(s, "#＃")
+    start += len(s) - len(t)
+    if t == "" { return tagSpan{}, false }
+    return tagSpan{start, start + len(t)}, true
 }
 
 func normalizeTag(s string) string {
@@ -215,12 +380,24 @@ func normalizeTag(s string) string {
 
 // ListTags returns sorted tags by total count (sum across files).
 func (x *Indexer) ListTags() []TagCount {
-    x.mu.RLock()
-    defer x.mu.RUnlock()
-    out := make([]TagCount, 0, len(x.tagToFiles))
-    for tag, files := range x.tagToFiles {
-        total := 0
-        for _, c := range files { total += c }
+    return x.ListTagsWhere(nil)
+}
+
+// ListTagsWhere is ListTags counting only the files keep accepts; a nil
+// keep accepts all.
+func (x *Indexer) ListTagsWhere(keep func(relPath string) bool) []TagCount {
+    totals := map[string]int{}
+    rows, err := x.db.Query("SELECT path, tag, count FROM file_tags")
+    if err != nil { return []TagCount{} }
+    for rows.Next() {
+        var p, tag string
+        var c int
+        if rows.Scan(&p, &tag, &c) != nil { continue }
+        if keep == nil || keep(p) { totals[tag] += c }
+    }
+    rows.Close()
+    out := make([]TagCount, 0, len(totals))
+    for tag, total := range totals {
         out = append(out, TagCount{Name: tag, Count: total})
     }
     sort.Slice(out, func(i, j int) bool {
@@ -232,46 +409,83 @@ func (x *Indexer) ListTags() []TagCount {
     return out
 }
 
-// FilesForTag returns a list of files referencing the given tag, sorted by count desc.
-func (x *Indexer) FilesForTag(tag string) []TagFileRef {
-    x.mu.RLock()
-    defer x.mu.RUnlock()
-    files, ok := x.tagToFiles[tag]
-    if !ok { return []TagFileRef{} }
-    out := make([]TagFileRef, 0, len(files))
-    for p, c := range files {
-        out = append(out, TagFileRef{Path: toRelPath(x.root, p), Count: c})
+// FilesForTag returns a list of files referencing the given tag, sorted by
+// count desc. With includeChildren, uses of nested tags (tag/...) count
+// as uses of tag.
+func (x *Indexer) FilesForTag(tag string, includeChildren bool) []TagFileRef {
+    out := []TagFileRef{}
+    query, args := "SELECT path, count FROM file_tags WHERE tag = ? ORDER BY count DESC, path", []any{tag}
+    if includeChildren {
+        lo, hi := prefixRange(tag)
+        query = `SELECT path, SUM(count) AS total FROM file_tags WHERE tag = ? OR (tag > ? AND tag < ?)
+            GROUP BY path ORDER BY total DESC, path`
+        args = append(args, lo, hi)
+    }
+    rows, err := x.db.Query(query, args...)
+    if err != nil { return out }
+    defer rows.Close()
+    for rows.Next() {
+        var ref TagFileRef
+        if rows.Scan(&ref.Path, &ref.Count) == nil { out = append(out, ref) }
     }
-    sort.Slice(out, func(i, j int) bool {
-        if out[i].Count == out[j].Count {
-            return out[i].Path < out[j].Path
-        }
-        return out[i].Count > out[j].Count
-    })
     return out
 }
 
 // TagsForFile returns list of tags used in a file.
 func (x *Indexer) TagsForFile(relOrAbsPath string) []string {
-    // Normalize to absolute path
+    // Normalize to a vault path
     abs := relOrAbsPath
-    if !filepath.IsAbs(abs) {
-        abs = filepath.Join(x.root, strings.TrimPrefix(relOrAbsPath, "/"))
+    if !strings.HasPrefix(abs, x.root+string(filepath.Separator)) {
+        var err error
+        if abs, err = x.resolver.Resolve(relOrAbsPath); err != nil { return []string{} }
+    }
+    out := []string{}
+    rows, err := x.db.Query("SELECT tag FROM file_tags WHERE path = ? ORDER BY tag", toRelPath(x.root, abs))
+    if err != nil { return out }
+    defer rows.Close()
+    for rows.Next() {
+        var tag string
+        if rows.Scan(&tag) == nil { out = append(out, tag) }
     }
-    x.mu.RLock()
-    defer x.mu.RUnlock()
-    m := x.fileToTags[abs]
-    if m == nil { return []string{} }
-    out := make([]string, 0, len(m))
-    for tag := range m { out = append(out, tag) }
-    sort.Strings(out)
     return out
 }
 
+// TagCounts returns the number of distinct tags used in a file, or in all
+// files below a folder that keep accepts (nil accepts all), for relPath and
+// every file and folder below it, keyed by vault path. It reads the index
+// once however deep the tree is.
+func (x *Indexer) TagCounts(relPath string, keep func(relPath string) bool) map[string]int {
+    counts := map[string]int{}
+    abs, err := x.resolver.Resolve(relPath)
+    if err != nil { return counts }
+    rel := toRelPath(x.root, abs)
+    lo, hi := prefixRange(rel)
+    if abs == x.root {
+        rel, lo, hi = "/", "/", "0"
+    }
+    rows, err := x.db.Query("SELECT path, tag FROM file_tags WHERE path = ? OR (path > ? AND path < ?)", rel, lo, hi)
+    if err != nil { return counts }
+    defer rows.Close()
+    seen := map[string]map[string]struct{}{}
+    for rows.Next() {
+        var p, tag string
+        if rows.Scan(&p, &tag) != nil { continue }
+        if keep != nil && !keep(p) { continue }
+        // The tag counts for the file and each folder up to relPath
+        for dir := p; ; dir = path.Dir(dir) {
+            if seen[dir] == nil { seen[dir] = map[string]struct{}{} }
+            seen[dir][tag] = struct{}{}
+            if dir == rel || dir == "/" { break }
+        }
+    }
+    for p, set := range seen {
+        counts[p] = len(set)
+    }
+    return counts
+}
+
 func toRelPath(root string, abs string) string {
     rel, err := filepath.Rel(root, abs)
     if err != nil { return abs }
     return "/" + filepath.ToSlash(rel)
 }
-
-
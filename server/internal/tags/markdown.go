@@ -0,0 +1,202 @@
+package tags
+
+import (
+    "regexp"
+    "strings"
+
+    "obsidianfs/internal/frontmatter"
+)
+
+var (
+    fenceRe    = regexp.MustCompile("^[ \t]*(`{3,}|~{3,})(.*)$")
+    listItemRe = regexp.MustCompile(`^[ \t]*([-*+]|\d{1,9}[.)])([ \t]|$)`)
+    refDefRe   = regexp.MustCompile(`^ {0,3}\[[^\]]+\]:`)
+    quoteRe    = regexp.MustCompile(`^( {0,3}> ?)+`)
+)
+
+// textOnly returns content with everything that is not markdown text
+// replaced by NUL bytes, keeping line breaks and byte offsets: the
+// frontmatter, fenced and indented code, inline code, HTML comments, link
+// destinations and wikilink targets. A '#' right after a replaced part
+// follows no space, so it cannot start a tag.
+func textOnly(content string) string {
+    b := []byte(content)
+    mask := func(from, to int) {
+        for i := from; i < to; i++ {
+            if b[i] != '\n' {
+                b[i] = 0
+            }
+        }
+    }
+    start := frontmatter.Length(content)
+    mask(0, start)
+
+    // Code blocks and link reference definitions, line by line
+    var fence string
+    prevBlank, inCode, inList := true, false, false
+    for off := start; off < len(content); {
+        line := content[off:]
+        if k := strings.IndexByte(line, '\n'); k >= 0 {
+            line = line[:k]
+        }
+        end := off + len(line)
+        body := strings.TrimRight(line[len(quoteRe.FindString(line)):], "\r")
+        blank := strings.TrimSpace(body) == ""
+        switch {
+        case fence != "":
+            mask(off, end)
+            if t := strings.TrimSpace(body); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+                fence = ""
+            }
+        case isFence(body):
+            fence = fenceRe.FindStringSubmatch(body)[1]
+            inCode = false
+            mask(off, end)
+        case blank:
+        case indentOf(body) >= 4 && !inList && (inCode || prevBlank):
+            // Indented code cannot interrupt a paragraph, and in lists the
+            // indent is the item's
+            inCode = true
+            mask(off, end)
+        default:
+            inCode = false
+            if listItemRe.MatchString(body) {
+                inList = true
+            } else if prevBlank && indentOf(body) == 0 {
+                inList = false
+            }
+            if refDefRe.MatchString(body) {
+                colon := off + len(line) - len(body) + strings.Index(body, "]:") + 2
+                mask(colon, end)
+            }
+        }
+        prevBlank = blank
+        off = end + 1
+    }
+
+    maskInline(b, mask)
+    return string(b)
+}
+
+// maskInline masks the code spans, HTML comments, link destinations and
+// wikilinks of b, which has its code blocks masked already.
+func maskInline(b []byte, mask func(from, to int)) {
+    s := string(b)
+    for i := 0; i < len(s); {
+        switch {
+        case s[i] == '\\':
+            i += 2 // an escaped character starts nothing
+        case s[i] == '`':
+            n := runLength(s, i, '`')
+            if close := closingBackticks(s, i+n, n); close >= 0 {
+                mask(i, close+n)
+                i = close + n
+            } else {
+                i += n // literal backticks
+            }
+        case strings.HasPrefix(s[i:], "<!--"):
+            if k := strings.Index(s[i+4:], "-->"); k >= 0 {
+                mask(i, i+4+k+3)
+                i += 4 + k + 3
+            } else {
+                i += 4
+            }
+        case strings.HasPrefix(s[i:], "]("):
+            if close := closingParen(s, i+2); close >= 0 {
+                mask(i+2, close)
+                i = close + 1
+            } else {
+                i += 2
+            }
+        case strings.HasPrefix(s[i:], "[["):
+            if k := strings.Index(s[i+2:], "]]"); k >= 0 && !strings.Contains(s[i+2:i+2+k], "\n") {
+                mask(i+2, i+2+k)
+                i += 2 + k + 2
+            } else {
+                i += 2
+            }
+        default:
+            i++
+        }
+    }
+}
+
+func isFence(line string) bool {
+    m := fenceRe.FindStringSubmatch(line)
+    // The info string of a backtick fence has no backticks; otherwise the
+    // line starts with inline code
+    return m != nil && !(m[1][0] == '`' && strings.Contains(m[2], "`"))
+}
+
+func indentOf(line string) int {
+    n := 0
+    for _, r := range line {
+        switch r {
+        case ' ':
+            n++
+        case '\t':
+            n += 4 - n%4
+        default:
+            return n
+        }
+    }
+    return n
+}
+
+func runLength(s string, i int, c byte) int {
+    n := 0
+    for i+n < len(s) && s[i+n] == c {
+        n++
+    }
+    return n
+}
+
+// closingBackticks finds the run of exactly n backticks closing a code span
+// opened before i, within the paragraph.
+func closingBackticks(s string, i, n int) int {
+    for i < len(s) {
+        switch {
+        case s[i] == '`':
+            k := runLength(s, i, '`')
+            if k == n {
+                return i
+            }
+            i += k
+        case s[i] == '\n' && strings.TrimSpace(lineAt(s, i+1)) == "":
+            return -1
+        default:
+            i++
+        }
+    }
+    return -1
+}
+
+// closingParen finds the ')' ending a link destination and title that
+// start at i, on the same line.
+func closingParen(s string, i int) int {
+    depth := 0
+    for ; i < len(s) && s[i] != '\n'; i++ {
+        switch s[i] {
+        case '\\':
+            i++
+        case '(':
+            depth++
+        case ')':
+            if depth == 0 {
+                return i
+            }
+            depth--
+        }
+    }
+    return -1
+}
+
+func lineAt(s string, i int) string {
+    if i >= len(s) {
+        return ""
+    }
+    if k := strings.IndexByte(s[i:], '\n'); k >= 0 {
+        return s[i : i+k]
+    }
+    return s[i:]
+}
@@ -0,0 +1,107 @@
+package tags
+
+import (
+    "errors"
+    "regexp"
+    "sort"
+    "strings"
+)
+
+// validTag matches what inline tag syntax can express.
+var validTag = regexp.MustCompile(`^[\p{L}\p{N}_\-]+(/[\p{L}\p{N}_\-]+)*$`)
+
+// RenameEdit is one tag rewritten in a file.
+type RenameEdit struct {
+    Line int    `json:"line"` // 1-based
+    From string `json:"from"`
+    To   string `json:"to"`
+}
+
+// RenamePlan lists the files a tag rename touches and the edits in each.
+// Renaming into an existing tag merges the two.
+type RenamePlan struct {
+    From  string                  `json:"from"`
+    To    string                  `json:"to"`
+    Files map[string][]RenameEdit `json:"files"`
+}
+
+// PlanRename works out how renaming the tag from to to, including the tags
+// nested below from (from/x becomes to/x), rewrites inline tags and
+// frontmatter tags: entries. read returns the content of a vault file.
+func (x *Indexer) PlanRename(from, to string, read func(rel string) (string, error)) (*RenamePlan, error) {
+    from, to = normalizeTag(from), normalizeTag(to)
+    if !validTag.MatchString(from) || !validTag.MatchString(to) {
+        return nil, errors.New("invalid tag name")
+    }
+    if from == to {
+        return nil, errors.New("tags are the same")
+    }
+    plan := &RenamePlan{From: from, To: to, Files: make(map[string][]RenameEdit)}
+    for _, ref := range x.FilesForTag(from, true) {
+        content, err := read(ref.Path)
+        if err != nil {
+            return nil, err
+        }
+        if _, edits := renameIn(content, from, to); len(edits) > 0 {
+            plan.Files[ref.Path] = edits
+        }
+    }
+    return plan, nil
+}
+
+// renameIn rewrites the uses of from and its nested tags in content.
+func renameIn(content, from, to string) (string, []RenameEdit) {
+    spans := tagSpans(content)
+    sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+    var out strings.Builder
+    var edits []RenameEdit
+    last := 0
+    for _, sp := range spans {
+        if sp.start < last {
+            continue // a frontmatter entry also matched as an inline tag
+        }
+        old := content[sp.start:sp.end]
+        t := normalizeTag(old)
+        if t != from && !strings.HasPrefix(t, from+"/") {
+            continue
+        }
+        renamed := to + strings.TrimPrefix(t, from)
+        out.WriteString(content[last:sp.start])
+        out.WriteString(renamed)
+        last = sp.end
+        edits = append(edits, RenameEdit{Line: strings.Count(content[:sp.start], "\n") + 1, From: t, To: renamed})
+    }
+    if edits == nil {
+        return content, nil
+    }
+    out.WriteString(content[last:])
+    return out.String(), edits
+}
+
+// Apply rewrites the planned files through read and write, renaming the
+// tags found in their current content, and returns the files it changed.
+// Files are done in path order; it stops at the first error.
+func (p *RenamePlan) Apply(read func(rel string) (string, error), write func(rel, content string) error) ([]string, error) {
+    paths := make([]string, 0, len(p.Files))
+    for rel := range p.Files {
+        paths = append(paths, rel)
+    }
+    sort.Strings(paths)
+
+    rewritten := []string{}
+    for _, rel := range paths {
+        content, err := read(rel)
+        if err != nil {
+            return rewritten, err
+        }
+        updated, edits := renameIn(content, p.From, p.To)
+        if len(edits) == 0 {
+            continue
+        }
+        if err := write(rel, updated); err != nil {
+            return rewritten, err
+        }
+        rewritten = append(rewritten, rel)
+    }
+    return rewritten, nil
+}
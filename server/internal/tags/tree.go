@@ -0,0 +1,55 @@
+package tags
+
+import (
+    "sort"
+    "strings"
+)
+
+// TagNode is a tag in the tag hierarchy. Count is the number of uses of
+// the tag itself and Total adds the uses of every nested tag below it, so
+// #project counts #project/alpha in its Total.
+type TagNode struct {
+    Name     string     `json:"name"` // last segment, "alpha" for project/alpha
+    Tag      string     `json:"tag"`  // full tag
+    Count    int        `json:"count"`
+    Total    int        `json:"total"`
+    Children []*TagNode `json:"children,omitempty"`
+}
+
+// TagTree returns the top-level tags with their nested tags, counting only
+// the files keep accepts (nil accepts all). Parents that are never used on
+// their own appear with a Count of 0. Siblings are sorted by name.
+func (x *Indexer) TagTree(keep func(relPath string) bool) []*TagNode {
+    root := &TagNode{}
+    nodes := map[string]*TagNode{"": root}
+    var node func(tag string) *TagNode
+    node = func(tag string) *TagNode {
+        if n, ok := nodes[tag]; ok { return n }
+        parent, name := "", tag
+        if i := strings.LastIndex(tag, "/"); i >= 0 {
+            parent, name = tag[:i], tag[i+1:]
+        }
+        n := &TagNode{Name: name, Tag: tag}
+        p := node(parent)
+        p.Children = append(p.Children, n)
+        nodes[tag] = n
+        return n
+    }
+    for _, tc := range x.ListTagsWhere(keep) {
+        node(strings.Trim(tc.Name, "/")).Count += tc.Count
+    }
+    var total func(n *TagNode) int
+    total = func(n *TagNode) int {
+        n.Total = n.Count
+        sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].Name < n.Children[j].Name })
+        for _, c := range n.Children {
+            n.Total += total(c)
+        }
+        return n.Total
+    }
+    total(root)
+    if root.Children == nil {
+        return []*TagNode{}
+    }
+    return root.Children
+}
@@ -9,7 +9,7 @@ import (
 	"github.com/google/uuid"
 )
 
-// GenerateID 生成20位随机ID（类似SiYuan的ID格式）
+// GenerateID 生成22位随机ID（类似SiYuan的ID格式）
 func GenerateID() string {
 	// 使用时间戳前缀 + 随机字符串
 	timestamp := time.Now().Format("20060102150405")
@@ -46,7 +46,7 @@ func GenerateShortID() string {
 
 // ValidateID 验证ID格式是否正确
 func ValidateID(id string) bool {
-	if len(id) != 21 { // 格式: 20060102150405-abcdefg
+	if len(id) != 22 { // 格式: 20060102150405-abcdefg
 		return false
 	}
 
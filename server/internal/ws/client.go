@@ -0,0 +1,102 @@
+package ws
+
+import (
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+const (
+    // sendQueueSize is the number of messages queued per client before it
+    // counts as a slow consumer.
+    sendQueueSize = 256
+    // writeWait is the time allowed to write one message.
+    writeWait = 10 * time.Second
+    // pongWait is the time allowed between pongs from the client.
+    pongWait = 60 * time.Second
+    // pingPeriod must be shorter than pongWait.
+    pingPeriod = pongWait * 9 / 10
+    // maxMessageSize limits messages read from the client; writeFile
+    // commands carry whole notes.
+    maxMessageSize = 16 << 20
+)
+
+// Client is one WebSocket connection. Messages for it are queued in send
+// and written by its own goroutine.
+type Client struct {
+    id      string
+    hub     *Hub
+    conn    *websocket.Conn
+    send    chan []byte
+    allow   Filter
+    session any
+    subs    subscriptions
+    pending chan struct{} // one slot per running command
+
+    // since is the last event a reconnecting (resume) client saw; ready
+    // is closed once the hub queued what it missed.
+    since  uint64
+    resume bool
+    ready  chan struct{}
+    // slow is set by the hub before it closes send to evict the client.
+    slow bool
+}
+
+// ID identifies the connection, e.g. to other collaborators.
+func (c *Client) ID() string { return c.id }
+
+// Session returns the value passed to ServeWS for the connection.
+func (c *Client) Session() any { return c.session }
+
+// readPump runs the commands the client sends, keeps the read deadline
+// moving on pongs and unregisters the client when the connection fails.
+func (c *Client) readPump() {
+    defer func() {
+        c.hub.unregister <- c
+        c.conn.Close()
+    }()
+    c.conn.SetReadLimit(maxMessageSize)
+    c.conn.SetReadDeadline(time.Now().Add(pongWait))
+    c.conn.SetPongHandler(func(string) error {
+        return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+    })
+    for {
+        kind, msg, err := c.conn.ReadMessage()
+        if err != nil {
+            return
+        }
+        if kind == websocket.TextMessage {
+            c.dispatch(msg)
+        }
+    }
+}
+
+// writePump writes queued messages and pings. It closes the connection when
+// the queue is closed or a write fails.
+func (c *Client) writePump() {
+    ticker := time.NewTicker(pingPeriod)
+    defer func() {
+        ticker.Stop()
+        c.conn.Close()
+    }()
+    for {
+        select {
+        case msg, ok := <-c.send:
+            c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+            if !ok {
+                if c.slow {
+                    c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+                }
+                return
+            }
+            if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+                return
+            }
+        case <-ticker.C:
+            c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+            if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+                return
+            }
+        }
+    }
+}
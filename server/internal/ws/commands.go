@@ -0,0 +1,334 @@
+package ws
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "sync"
+    "sync/atomic"
+)
+
+// Message is a command sent by a client, in the shape of
+// database.WSMessage. The reply carries the same Callback.
+type Message struct {
+    Cmd      string          `json:"cmd"`
+    Data     json.RawMessage `json:"data,omitempty"`
+    Callback string          `json:"callback,omitempty"`
+}
+
+// Reply answers a Message. Type is always "reply" so clients can tell
+// replies from events.
+type Reply struct {
+    Type     string `json:"type"`
+    Cmd      string `json:"cmd"`
+    Callback string `json:"callback,omitempty"`
+    Data     any    `json:"data,omitempty"`
+    Error    string `json:"error,omitempty"`
+}
+
+// Request is a command as a Handler sees it. Session is the value passed
+// to ServeWS for the connection, such as the signed in user.
+type Request struct {
+    Cmd     string
+    Data    json.RawMessage
+    Session any
+    Client  *Client
+
+    callback string
+    replied  bool
+}
+
+// Reply answers the command right away instead of when the handler
+// returns, for handlers whose reply must be ordered with messages they
+// Send; the handler's own result is then discarded.
+func (r *Request) Reply(data any) {
+    r.replied = true
+    r.Client.hub.reply(r.Client, newReply(r.Cmd, r.callback, data, nil))
+}
+
+// Bind decodes the command data into v.
+func (r *Request) Bind(v any) error {
+    if len(r.Data) == 0 {
+        return errors.New("missing data")
+    }
+    return json.Unmarshal(r.Data, v)
+}
+
+// Handler runs a command. A ReplyError lets it send data along with the
+// error.
+type Handler func(req *Request) (any, error)
+
+// ReplyError is an error whose reply still carries Data, such as the
+// current content of a file on a conflicting write.
+type ReplyError struct {
+    Err  error
+    Data any
+}
+
+func (e *ReplyError) Error() string { return e.Err.Error() }
+func (e *ReplyError) Unwrap() error { return e.Err }
+
+// maxPendingCommands is the number of commands a client may have running
+// at once; further commands wait.
+const maxPendingCommands = 8
+
+// Handle registers the handler of a command. Handlers should be registered
+// before clients connect.
+func (h *Hub) Handle(cmd string, fn Handler) {
+    h.handlersMu.Lock()
+    defer h.handlersMu.Unlock()
+    h.handlers[cmd] = fn
+}
+
+func (h *Hub) handler(cmd string) Handler {
+    h.handlersMu.RLock()
+    defer h.handlersMu.RUnlock()
+    return h.handlers[cmd]
+}
+
+// SetTopicLookups sets how tag and notebook subscriptions are matched:
+// tagsOf returns the tags of a vault file and notebookPath the folder of a
+// notebook ID. Either may be nil, which rejects subscriptions of that kind.
+func (h *Hub) SetTopicLookups(tagsOf func(path string) []string, notebookPath func(id string) (string, error)) {
+    h.tagsOf = tagsOf
+    h.notebookPath = notebookPath
+}
+
+// Topics selects the events a client receives: events about paths below
+// one of Paths, inside one of Notebooks, or about files carrying one of
+// Tags (or a nested tag below it). A client without topics receives every
+// event.
+type Topics struct {
+    Paths     []string `json:"paths,omitempty"`
+    Tags      []string `json:"tags,omitempty"`
+    Notebooks []string `json:"notebooks,omitempty"`
+}
+
+// subscriptions are the topics of one client.
+type subscriptions struct {
+    mu        sync.Mutex
+    paths     map[string]bool
+    tags      map[string]bool
+    notebooks map[string]string // notebook ID -> folder path
+    tagged    bool              // counted in tagged clients
+    closed    bool              // the client is gone
+}
+
+// count keeps tagged, the number of clients with tag subscriptions, up to
+// date after a change. Callers hold s.mu.
+func (s *subscriptions) count(tagged *atomic.Int64) {
+    want := len(s.tags) > 0 && !s.closed
+    if want != s.tagged {
+        s.tagged = want
+        if want {
+            tagged.Add(1)
+        } else {
+            tagged.Add(-1)
+        }
+    }
+}
+
+// close stops counting the client among the tagged clients.
+func (s *subscriptions) close(tagged *atomic.Int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.closed = true
+    s.count(tagged)
+}
+
+func normalizeTopicPath(p string) string {
+    return "/" + strings.Trim(strings.ReplaceAll(p, `\`, "/"), "/")
+}
+
+func normalizeTopicTag(t string) string {
+    return strings.Trim(strings.TrimLeft(strings.TrimSpace(t), "#＃"), "/")
+}
+
+func underPath(p, prefix string) bool {
+    return prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// add subscribes to t, resolving notebook IDs with notebookPath.
+func (s *subscriptions) add(t Topics, notebookPath func(string) (string, error), tagged *atomic.Int64) error {
+    folders := make(map[string]string, len(t.Notebooks))
+    for _, id := range t.Notebooks {
+        if id == "" {
+            return errors.New("empty notebook ID")
+        }
+        if notebookPath == nil {
+            return errors.New("notebook subscriptions are not supported")
+        }
+        p, err := notebookPath(id)
+        if err != nil {
+            return fmt.Errorf("notebook %s: %w", id, err)
+        }
+        folders[id] = normalizeTopicPath(p)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.paths == nil {
+        s.paths, s.tags, s.notebooks = map[string]bool{}, map[string]bool{}, map[string]string{}
+    }
+    for _, p := range t.Paths {
+        s.paths[normalizeTopicPath(p)] = true
+    }
+    for _, tag := range t.Tags {
+        if tag = normalizeTopicTag(tag); tag != "" {
+            s.tags[tag] = true
+        }
+    }
+    for id, p := range folders {
+        s.notebooks[id] = p
+    }
+    s.count(tagged)
+    return nil
+}
+
+// remove unsubscribes from t; all drops every topic.
+func (s *subscriptions) remove(t Topics, all bool, tagged *atomic.Int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    defer s.count(tagged)
+    if all {
+        s.paths, s.tags, s.notebooks = nil, nil, nil
+        return
+    }
+    for _, p := range t.Paths {
+        delete(s.paths, normalizeTopicPath(p))
+    }
+    for _, tag := range t.Tags {
+        delete(s.tags, normalizeTopicTag(tag))
+    }
+    for _, id := range t.Notebooks {
+        delete(s.notebooks, id)
+    }
+}
+
+// topics lists the current subscriptions.
+func (s *subscriptions) topics() Topics {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    t := Topics{Paths: []string{}, Tags: []string{}, Notebooks: []string{}}
+    for p := range s.paths {
+        t.Paths = append(t.Paths, p)
+    }
+    for tag := range s.tags {
+        t.Tags = append(t.Tags, tag)
+    }
+    for id := range s.notebooks {
+        t.Notebooks = append(t.Notebooks, id)
+    }
+    return t
+}
+
+// match reports whether the client wants evt. tagsOf is only called for
+// tag subscriptions; tags are looked up when the event is broadcast, so a
+// deleted file no longer matches its tags.
+func (s *subscriptions) match(evt Event, tagsOf func(string) []string) bool {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.paths) == 0 && len(s.tags) == 0 && len(s.notebooks) == 0 {
+        return true
+    }
+    for _, p := range []string{evt.Path, evt.From, evt.To} {
+        if p == "" {
+            continue
+        }
+        p = normalizeTopicPath(p)
+        for prefix := range s.paths {
+            if underPath(p, prefix) {
+                return true
+            }
+        }
+        for _, prefix := range s.notebooks {
+            if underPath(p, prefix) {
+                return true
+            }
+        }
+        if len(s.tags) > 0 && tagsOf != nil {
+            for _, tag := range tagsOf(p) {
+                for want := range s.tags {
+                    if tag == want || strings.HasPrefix(tag, want+"/") {
+                        return true
+                    }
+                }
+            }
+        }
+    }
+    return false
+}
+
+// dispatch runs a message from the client. Subscriptions change in order;
+// other commands run concurrently and are answered through the hub.
+func (c *Client) dispatch(raw []byte) {
+    var msg Message
+    if err := json.Unmarshal(raw, &msg); err != nil {
+        c.hub.reply(c, Reply{Type: "reply", Error: "invalid message: " + err.Error()})
+        return
+    }
+    req := &Request{Cmd: msg.Cmd, Data: msg.Data, Session: c.session, Client: c, callback: msg.Callback}
+    switch msg.Cmd {
+    case "subscribe", "unsubscribe":
+        c.hub.reply(c, c.runSubscription(req, msg.Callback))
+        return
+    }
+    fn := c.hub.handler(msg.Cmd)
+    if fn == nil {
+        c.hub.reply(c, Reply{Type: "reply", Cmd: msg.Cmd, Callback: msg.Callback, Error: "unknown command"})
+        return
+    }
+    c.pending <- struct{}{}
+    go func() {
+        defer func() {
+            if r := recover(); r != nil {
+                log.Printf("ws command %s panicked: %v", msg.Cmd, r)
+                c.hub.reply(c, Reply{Type: "reply", Cmd: msg.Cmd, Callback: msg.Callback, Error: "internal error"})
+            }
+            <-c.pending
+        }()
+        data, err := fn(req)
+        if !req.replied || err != nil {
+            c.hub.reply(c, newReply(msg.Cmd, msg.Callback, data, err))
+        }
+    }()
+}
+
+// runSubscription runs subscribe {paths, tags, notebooks} or unsubscribe
+// {paths, tags, notebooks} | {all: true}. Both answer with the topics now
+// subscribed.
+func (c *Client) runSubscription(req *Request, callback string) Reply {
+    var body struct {
+        Topics
+        All bool `json:"all"`
+    }
+    if len(req.Data) > 0 {
+        if err := json.Unmarshal(req.Data, &body); err != nil {
+            return newReply(req.Cmd, callback, nil, err)
+        }
+    }
+    if req.Cmd == "unsubscribe" {
+        c.subs.remove(body.Topics, body.All, &c.hub.tagged)
+        return newReply(req.Cmd, callback, c.subs.topics(), nil)
+    }
+    if len(body.Tags) > 0 && c.hub.tagsOf == nil {
+        return newReply(req.Cmd, callback, nil, errors.New("tag subscriptions are not supported"))
+    }
+    if err := c.subs.add(body.Topics, c.hub.notebookPath, &c.hub.tagged); err != nil {
+        return newReply(req.Cmd, callback, nil, err)
+    }
+    return newReply(req.Cmd, callback, c.subs.topics(), nil)
+}
+
+func newReply(cmd, callback string, data any, err error) Reply {
+    r := Reply{Type: "reply", Cmd: cmd, Callback: callback, Data: data}
+    if err != nil {
+        r.Error = err.Error()
+        var re *ReplyError
+        if errors.As(err, &re) {
+            r.Data = re.Data
+        }
+    }
+    return r
+}
@@ -4,85 +4,339 @@ import (
     "encoding/json"
     "log"
     "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "obsidianfs/internal/utils"
 
     "github.com/gorilla/websocket"
 )
 
+// Event is a change broadcast to the clients. The hub numbers events in
+// the order it sends them; a client sees gaps where events were filtered
+// out for it.
 type Event struct {
-    Type   string `json:"type"`
-    Action string `json:"action"`
-    Path   string `json:"path"`
-    From   string `json:"from,omitempty"`
-    To     string `json:"to,omitempty"`
+    Seq    uint64    `json:"seq"`
+    Time   time.Time `json:"time"`
+    Type   string    `json:"type"`
+    Action string    `json:"action"`
+    Path   string    `json:"path"`
+    From   string    `json:"from,omitempty"`
+    To     string    `json:"to,omitempty"`
 }
 
+// Filter reports whether a client may see events about a vault path. A
+// nil Filter lets every event through.
+type Filter func(path string) bool
+
+const (
+    // broadcastQueueSize is the number of events waiting for the hub loop.
+    broadcastQueueSize = 1024
+    // broadcastTimeout is how long Broadcast waits for a full queue before
+    // dropping the event.
+    broadcastTimeout = time.Second
+)
+
+// Stats are counters of the hub since it started.
+type Stats struct {
+    Clients         int64  `json:"clients"`
+    Seq             uint64 `json:"seq"`             // sequence number of the last event
+    Broadcasts      uint64 `json:"broadcasts"`      // events accepted by Broadcast
+    DroppedEvents   uint64 `json:"droppedEvents"`   // events Broadcast dropped because the hub queue was full
+    DroppedMessages uint64 `json:"droppedMessages"` // messages not queued because a client queue was full
+    EvictedClients  uint64 `json:"evictedClients"`  // clients disconnected for not keeping up
+}
+
+// Hub fans events out to the connected clients. The hub loop only queues
+// messages; every client has its own writer goroutine, so a slow client
+// cannot hold up the others. A client whose queue fills up is evicted.
+// Clients may subscribe to topics and send commands, see Handle.
 type Hub struct {
-    clients    map[*websocket.Conn]bool
-    broadcast  chan Event
-    register   chan *websocket.Conn
-    unregister chan *websocket.Conn
+    clients    map[*Client]bool
+    broadcast  chan queued
+    register   chan *Client
+    unregister chan *Client
+    replies    chan reply
+
+    handlersMu   sync.RWMutex
+    handlers     map[string]Handler
+    onDisconnect []func(*Client)
+    tagsOf       func(path string) []string
+    notebookPath func(id string) (string, error)
+    tagged       atomic.Int64 // clients with tag subscriptions
+
+    seq     atomic.Uint64
+    history *ring
+    journal *journal
+
+    numClients      atomic.Int64
+    broadcasts      atomic.Uint64
+    droppedEvents   atomic.Uint64
+    droppedMessages atomic.Uint64
+    evicted         atomic.Uint64
 }
 
 func NewHub() *Hub {
     return &Hub{
-        clients:    make(map[*websocket.Conn]bool),
-        broadcast:  make(chan Event, 128),
-        register:   make(chan *websocket.Conn),
-        unregister: make(chan *websocket.Conn),
+        clients:    make(map[*Client]bool),
+        broadcast:  make(chan queued, broadcastQueueSize),
+        register:   make(chan *Client),
+        unregister: make(chan *Client),
+        replies:    make(chan reply),
+        handlers:   make(map[string]Handler),
+        history:    newRing(DefaultHistorySize),
     }
 }
 
+// queued is an event waiting for the hub loop, with the tags of its paths
+// looked up by Broadcast so the loop never waits on the tag index.
+type queued struct {
+    evt  Event
+    tags map[string][]string
+}
+
+// reply is a message for one client.
+type reply struct {
+    client *Client
+    msg    []byte
+}
+
 func (h *Hub) Run() {
     for {
         select {
         case c := <-h.register:
+            backlog := h.backlog(c)
+            c.send = make(chan []byte, sendQueueSize+len(backlog))
+            for _, msg := range backlog {
+                c.send <- msg
+            }
             h.clients[c] = true
+            h.numClients.Store(int64(len(h.clients)))
+            close(c.ready)
         case c := <-h.unregister:
-            if _, ok := h.clients[c]; ok {
-                delete(h.clients, c)
-                c.Close()
+            h.remove(c)
+        case r := <-h.replies:
+            if h.clients[r.client] {
+                h.queue(r.client, r.msg)
+            }
+        case q := <-h.broadcast:
+            evt := q.evt
+            evt.Seq = h.seq.Add(1)
+            evt.Time = time.Now().UTC()
+            h.history.push(evt)
+            if h.journal != nil {
+                h.journal.append(evt, h.history.all)
             }
-        case evt := <-h.broadcast:
             payload, _ := json.Marshal(evt)
+            tagsOf := func(p string) []string { return q.tags[p] }
             for c := range h.clients {
-                if err := c.WriteMessage(websocket.TextMessage, payload); err != nil {
-                    log.Printf("ws write error: %v", err)
-                    c.Close()
-                    delete(h.clients, c)
+                e, msg := evt, payload
+                if c.allow != nil {
+                    visible, ok := filterEvent(evt, c.allow)
+                    if !ok {
+                        continue
+                    }
+                    if visible != evt {
+                        e = visible
+                        msg, _ = json.Marshal(visible)
+                    }
                 }
+                if !c.subs.match(e, tagsOf) {
+                    continue
+                }
+                h.queue(c, msg)
             }
         }
     }
 }
 
+// queue hands msg to the writer of c, evicting c if its queue is full.
+func (h *Hub) queue(c *Client, msg []byte) {
+    select {
+    case c.send <- msg:
+    default:
+        h.droppedMessages.Add(1)
+        h.evicted.Add(1)
+        log.Printf("ws client %s too slow, disconnecting", c.conn.RemoteAddr())
+        c.slow = true
+        h.remove(c)
+    }
+}
+
+// eventTags returns the tags of the paths of evt, keyed by topic path, or
+// nil when no client subscribes to tags.
+func (h *Hub) eventTags(evt Event) map[string][]string {
+    if h.tagsOf == nil || h.tagged.Load() == 0 {
+        return nil
+    }
+    tags := map[string][]string{}
+    for _, p := range []string{evt.Path, evt.From, evt.To} {
+        if p == "" {
+            continue
+        }
+        p = normalizeTopicPath(p)
+        if _, ok := tags[p]; !ok {
+            tags[p] = h.tagsOf(p)
+        }
+    }
+    return tags
+}
+
+// reply sends r to c through the hub loop, which drops it if c is gone.
+func (h *Hub) reply(c *Client, r Reply) {
+    msg, err := json.Marshal(r)
+    if err != nil {
+        msg, _ = json.Marshal(Reply{Type: "reply", Cmd: r.Cmd, Callback: r.Callback, Error: err.Error()})
+    }
+    h.replies <- reply{client: c, msg: msg}
+}
+
+// Send queues v, encoded as JSON, for c alone. Messages sent to a client
+// arrive in the order of the Send calls; they are dropped once c is gone.
+func (h *Hub) Send(c *Client, v any) {
+    msg, err := json.Marshal(v)
+    if err != nil {
+        log.Printf("ws send: %v", err)
+        return
+    }
+    h.replies <- reply{client: c, msg: msg}
+}
+
+// OnDisconnect registers fn to run, in its own goroutine, when a client
+// goes away. It should be called before clients connect.
+func (h *Hub) OnDisconnect(fn func(c *Client)) {
+    h.handlersMu.Lock()
+    defer h.handlersMu.Unlock()
+    h.onDisconnect = append(h.onDisconnect, fn)
+}
+
+// remove forgets c and closes its queue, which makes its writer close the
+// connection.
+func (h *Hub) remove(c *Client) {
+    if _, ok := h.clients[c]; ok {
+        delete(h.clients, c)
+        close(c.send)
+        c.subs.close(&h.tagged)
+        h.numClients.Store(int64(len(h.clients)))
+        h.handlersMu.RLock()
+        for _, fn := range h.onDisconnect {
+            go fn(c)
+        }
+        h.handlersMu.RUnlock()
+    }
+}
+
+// filterEvent returns evt as a client limited by allow sees it. A rename
+// between a visible and a hidden path looks like a delete or a create.
+func filterEvent(evt Event, allow Filter) (Event, bool) {
+    if evt.Action != "renamed" || evt.From == "" {
+        return evt, allow(evt.Path)
+    }
+    from, to := allow(evt.From), allow(evt.To)
+    switch {
+    case from && to:
+        return evt, true
+    case from:
+        return Event{Seq: evt.Seq, Time: evt.Time, Type: evt.Type, Action: "deleted", Path: evt.From}, true
+    case to:
+        return Event{Seq: evt.Seq, Time: evt.Time, Type: evt.Type, Action: "created", Path: evt.To}, true
+    }
+    return evt, false
+}
+
+// Broadcast queues evt for all clients. If the hub queue stays full for
+// broadcastTimeout the event is dropped and counted in Stats. Tags for
+// tag subscriptions are looked up here, in the caller's goroutine.
 func (h *Hub) Broadcast(evt Event) {
+    q := queued{evt: evt, tags: h.eventTags(evt)}
     select {
-    case h.broadcast <- evt:
+    case h.broadcast <- q:
+        h.broadcasts.Add(1)
+        return
     default:
+    }
+    timer := time.NewTimer(broadcastTimeout)
+    defer timer.Stop()
+    select {
+    case h.broadcast <- q:
+        h.broadcasts.Add(1)
+    case <-timer.C:
+        h.droppedEvents.Add(1)
         log.Printf("ws broadcast dropped: %+v", evt)
     }
 }
 
+// Stats returns the hub counters.
+func (h *Hub) Stats() Stats {
+    return Stats{
+        Clients:         h.numClients.Load(),
+        Seq:             h.seq.Load(),
+        Broadcasts:      h.broadcasts.Load(),
+        DroppedEvents:   h.droppedEvents.Load(),
+        DroppedMessages: h.droppedMessages.Load(),
+        EvictedClients:  h.evicted.Load(),
+    }
+}
+
 var upgrader = websocket.Upgrader{
     ReadBufferSize:  1024,
     WriteBufferSize: 1024,
-    CheckOrigin: func(r *http.Request) bool { return true },
+    CheckOrigin:     checkOrigin,
+}
+
+var allowedOrigins = map[string]bool{}
+
+// SetAllowedOrigins sets the origins, besides the server's own, that may
+// open a WebSocket. "*" allows any origin.
+func SetAllowedOrigins(origins []string) {
+    m := make(map[string]bool, len(origins))
+    for _, o := range origins {
+        m[strings.TrimRight(o, "/")] = true
+    }
+    allowedOrigins = m
+}
+
+func checkOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" || allowedOrigins["*"] || allowedOrigins[origin] {
+        return true
+    }
+    u, err := url.Parse(origin)
+    return err == nil && strings.EqualFold(u.Host, r.Host)
 }
 
-func ServeWS(h *Hub, w http.ResponseWriter, r *http.Request) {
+// ServeWS upgrades the request and streams the events allow accepts to the
+// client. session is handed to the command handlers of the connection.
+// The client first gets {"type":"hello","seq":N}; a client reconnecting
+// with ?since=N then gets the events it missed, or {"type":"resync"} if
+// they are no longer kept.
+func ServeWS(h *Hub, w http.ResponseWriter, r *http.Request, allow Filter, session any) {
+    since, resume, err := parseSince(r.URL.Query().Get("since"))
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
     conn, err := upgrader.Upgrade(w, r, nil)
     if err != nil {
         log.Printf("ws upgrade: %v", err)
         return
     }
-    h.register <- conn
-    go func() {
-        defer func() { h.unregister <- conn }()
-        for {
-            if _, _, err := conn.ReadMessage(); err != nil {
-                return
-            }
-        }
-    }()
+    c := &Client{
+        id:      utils.GenerateShortID(),
+        hub:     h,
+        conn:    conn,
+        allow:   allow,
+        session: session,
+        pending: make(chan struct{}, maxPendingCommands),
+        since:   since,
+        resume:  resume,
+        ready:   make(chan struct{}),
+    }
+    h.register <- c
+    <-c.ready
+    go c.writePump()
+    go c.readPump()
 }
-
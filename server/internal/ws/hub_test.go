@@ -0,0 +1,91 @@
+package ws
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// dial connects a client to h and reads its hello message.
+func dial(t *testing.T, h *Hub) *websocket.Conn {
+    t.Helper()
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ServeWS(h, w, r, nil, nil)
+    }))
+    t.Cleanup(srv.Close)
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+    if msg := readMessage(t, conn); msg["type"] != "hello" {
+        t.Fatalf("first message %v", msg)
+    }
+    return conn
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) map[string]any {
+    t.Helper()
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    var msg map[string]any
+    if err := conn.ReadJSON(&msg); err != nil {
+        t.Fatal(err)
+    }
+    return msg
+}
+
+func TestTagSubscription(t *testing.T) {
+    h := NewHub()
+    var lookups atomic.Int64
+    h.SetTopicLookups(func(p string) []string {
+        lookups.Add(1)
+        if p == "/tagged.md" {
+            return []string{"project/a"}
+        }
+        return nil
+    }, nil)
+    go h.Run()
+    conn := dial(t, h)
+
+    // Without tag subscriptions nothing is looked up
+    h.Broadcast(Event{Type: "fs", Action: "modified", Path: "/tagged.md"})
+    if msg := readMessage(t, conn); msg["path"] != "/tagged.md" {
+        t.Fatalf("unsubscribed client got %v", msg)
+    }
+    if n := lookups.Load(); n != 0 {
+        t.Errorf("%d tag lookups without tag subscriptions", n)
+    }
+
+    sub, _ := json.Marshal(Message{Cmd: "subscribe", Data: json.RawMessage(`{"tags":["project"]}`), Callback: "1"})
+    if err := conn.WriteMessage(websocket.TextMessage, sub); err != nil {
+        t.Fatal(err)
+    }
+    if msg := readMessage(t, conn); msg["type"] != "reply" || msg["error"] != nil {
+        t.Fatalf("subscribe reply %v", msg)
+    }
+
+    // Broadcast looks the tags up before it returns, not in the hub loop
+    h.Broadcast(Event{Type: "fs", Action: "modified", Path: "/other.md"})
+    h.Broadcast(Event{Type: "fs", Action: "renamed", Path: "/tagged.md", From: "/old.md", To: "/tagged.md"})
+    if n := lookups.Load(); n != 3 {
+        t.Errorf("%d tag lookups, want 3", n)
+    }
+    if msg := readMessage(t, conn); msg["path"] != "/tagged.md" || msg["from"] != "/old.md" {
+        t.Fatalf("subscribed client got %v", msg)
+    }
+
+    unsub, _ := json.Marshal(Message{Cmd: "unsubscribe", Data: json.RawMessage(`{"all":true}`), Callback: "2"})
+    if err := conn.WriteMessage(websocket.TextMessage, unsub); err != nil {
+        t.Fatal(err)
+    }
+    readMessage(t, conn)
+    if n := h.tagged.Load(); n != 0 {
+        t.Errorf("%d tagged clients after unsubscribe", n)
+    }
+}
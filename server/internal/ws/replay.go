@@ -0,0 +1,216 @@
+package ws
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "log"
+    "os"
+    "path/filepath"
+    "strconv"
+)
+
+// DefaultHistorySize is the number of events kept for replay when
+// KeepHistory is not called.
+const DefaultHistorySize = 1000
+
+// ring keeps the last events broadcast, oldest first.
+type ring struct {
+    events []Event
+    start  int // index of the oldest event
+    n      int
+}
+
+func newRing(size int) *ring {
+    if size < 1 {
+        size = 1
+    }
+    return &ring{events: make([]Event, size)}
+}
+
+func (r *ring) push(evt Event) {
+    if r.n < len(r.events) {
+        r.events[(r.start+r.n)%len(r.events)] = evt
+        r.n++
+        return
+    }
+    r.events[r.start] = evt
+    r.start = (r.start + 1) % len(r.events)
+}
+
+// since returns the events after seq. ok is false when some of them are no
+// longer kept.
+func (r *ring) since(seq uint64) (out []Event, ok bool) {
+    for i := 0; i < r.n; i++ {
+        evt := r.events[(r.start+i)%len(r.events)]
+        if evt.Seq <= seq {
+            continue
+        }
+        if len(out) == 0 && evt.Seq != seq+1 {
+            return nil, false
+        }
+        out = append(out, evt)
+    }
+    return out, true
+}
+
+func (r *ring) all() []Event {
+    out := make([]Event, 0, r.n)
+    for i := 0; i < r.n; i++ {
+        out = append(out, r.events[(r.start+i)%len(r.events)])
+    }
+    return out
+}
+
+// journal appends events to a file, one JSON object per line, so replay
+// survives restarts. The file is rewritten with only the kept events once
+// it holds twice as many lines.
+type journal struct {
+    path  string
+    f     *os.File
+    lines int
+    limit int
+}
+
+// KeepHistory sets how many events are kept for clients reconnecting with
+// ?since=N. With a path the events are also kept in that file and loaded
+// from it, so sequence numbers continue across restarts. It must be called
+// before Run.
+func (h *Hub) KeepHistory(size int, path string) error {
+    h.history = newRing(size)
+    if path == "" {
+        return nil
+    }
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    if err := h.loadJournal(path); err != nil {
+        return err
+    }
+    h.journal = &journal{path: path, limit: 2 * len(h.history.events)}
+    return h.journal.rewrite(h.history.all())
+}
+
+// loadJournal fills the history from the file at path, if there is one.
+func (h *Hub) loadJournal(path string) error {
+    f, err := os.Open(path)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    sc := bufio.NewScanner(f)
+    sc.Buffer(make([]byte, 64<<10), 1<<20)
+    for sc.Scan() {
+        var evt Event
+        if err := json.Unmarshal(sc.Bytes(), &evt); err != nil || evt.Seq <= h.seq.Load() {
+            continue // a torn last line or a duplicate
+        }
+        h.history.push(evt)
+        h.seq.Store(evt.Seq)
+    }
+    return sc.Err()
+}
+
+// rewrite replaces the file with events and reopens it for appending.
+func (j *journal) rewrite(events []Event) error {
+    if j.f != nil {
+        j.f.Close()
+        j.f = nil
+    }
+    tmp := j.path + ".tmp"
+    f, err := os.Create(tmp)
+    if err != nil {
+        return err
+    }
+    w := bufio.NewWriter(f)
+    enc := json.NewEncoder(w)
+    for _, evt := range events {
+        if err := enc.Encode(evt); err != nil {
+            f.Close()
+            return err
+        }
+    }
+    if err := w.Flush(); err != nil {
+        f.Close()
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, j.path); err != nil {
+        return err
+    }
+    if j.f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+        return err
+    }
+    j.lines = len(events)
+    return nil
+}
+
+// append writes evt to the file, compacting it to kept when it grew too
+// long.
+func (j *journal) append(evt Event, kept func() []Event) {
+    if j.f == nil {
+        return
+    }
+    line, _ := json.Marshal(evt)
+    if _, err := j.f.Write(append(line, '\n')); err != nil {
+        log.Printf("ws journal write: %v", err)
+        return
+    }
+    if j.lines++; j.lines >= j.limit {
+        if err := j.rewrite(kept()); err != nil {
+            log.Printf("ws journal compaction: %v", err)
+        }
+    }
+}
+
+// backlog returns the first messages for c: hello, then for a resuming
+// client the events it missed as its allow filter sees them, or resync if
+// those are no longer kept. It runs in the hub loop.
+func (h *Hub) backlog(c *Client) [][]byte {
+    seq := h.seq.Load()
+    out := [][]byte{controlMessage("hello", seq)}
+    if !c.resume || c.since == seq {
+        return out
+    }
+    events, ok := h.history.since(c.since)
+    if !ok || c.since > seq || len(events) == 0 {
+        return append(out, controlMessage("resync", seq))
+    }
+    for _, evt := range events {
+        if c.allow != nil {
+            visible, ok := filterEvent(evt, c.allow)
+            if !ok {
+                continue
+            }
+            evt = visible
+        }
+        msg, _ := json.Marshal(evt)
+        out = append(out, msg)
+    }
+    return out
+}
+
+// controlMessage is a message about the stream itself: "hello" on connect
+// and "resync" when missed events cannot be replayed. seq is the sequence
+// number of the last event so far.
+func controlMessage(kind string, seq uint64) []byte {
+    msg, _ := json.Marshal(map[string]any{"type": kind, "seq": seq})
+    return msg
+}
+
+// parseSince reads the ?since= value of a reconnecting client.
+func parseSince(s string) (uint64, bool, error) {
+    if s == "" {
+        return 0, false, nil
+    }
+    n, err := strconv.ParseUint(s, 10, 64)
+    if err != nil {
+        return 0, false, fmt.Errorf("invalid since %q", s)
+    }
+    return n, true, nil
+}
@@ -0,0 +1,167 @@
+package ws
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+)
+
+func seqs(events []Event) []uint64 {
+    var out []uint64
+    for _, evt := range events {
+        out = append(out, evt.Seq)
+    }
+    return out
+}
+
+func TestRing(t *testing.T) {
+    r := newRing(3)
+    if events, ok := r.since(0); !ok || len(events) != 0 {
+        t.Errorf("empty ring: %v, %v", events, ok)
+    }
+    for i := uint64(1); i <= 5; i++ {
+        r.push(Event{Seq: i})
+    }
+    if got := seqs(r.all()); !reflect.DeepEqual(got, []uint64{3, 4, 5}) {
+        t.Errorf("after wraparound %v, want [3 4 5]", got)
+    }
+
+    tests := []struct {
+        since uint64
+        want  []uint64
+        ok    bool
+    }{
+        {5, nil, true},
+        {4, []uint64{5}, true},
+        {2, []uint64{3, 4, 5}, true},
+        {1, nil, false}, // event 2 was overwritten
+        {0, nil, false},
+        {9, nil, true},
+    }
+    for _, tt := range tests {
+        events, ok := r.since(tt.since)
+        if got := seqs(events); ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("since(%d) = %v, %v, want %v, %v", tt.since, got, ok, tt.want, tt.ok)
+        }
+    }
+
+    if r := newRing(0); len(r.events) != 1 {
+        t.Errorf("newRing(0) keeps %d events", len(r.events))
+    }
+}
+
+func TestBacklog(t *testing.T) {
+    h := NewHub()
+    if err := h.KeepHistory(3, ""); err != nil {
+        t.Fatal(err)
+    }
+    for i := uint64(1); i <= 5; i++ {
+        h.history.push(Event{Seq: i, Type: "fs", Path: fmt.Sprintf("/%d.md", i)})
+    }
+    h.seq.Store(5)
+
+    tests := []struct {
+        name   string
+        client *Client
+        want   []string
+    }{
+        {"new client", &Client{}, []string{"hello 5"}},
+        {"up to date", &Client{resume: true, since: 5}, []string{"hello 5"}},
+        {"missed events", &Client{resume: true, since: 2}, []string{"hello 5", "fs 3", "fs 4", "fs 5"}},
+        {"events no longer kept", &Client{resume: true, since: 1}, []string{"hello 5", "resync 5"}},
+        {"since ahead of seq", &Client{resume: true, since: 9}, []string{"hello 5", "resync 5"}},
+        {
+            "allow filter",
+            &Client{resume: true, since: 2, allow: func(p string) bool { return p != "/4.md" }},
+            []string{"hello 5", "fs 3", "fs 5"},
+        },
+    }
+    for _, tt := range tests {
+        var got []string
+        for _, msg := range h.backlog(tt.client) {
+            var m struct {
+                Type string `json:"type"`
+                Seq  uint64 `json:"seq"`
+            }
+            if err := json.Unmarshal(msg, &m); err != nil {
+                t.Fatal(err)
+            }
+            got = append(got, fmt.Sprintf("%s %d", m.Type, m.Seq))
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: backlog %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
+
+// journalLines counts the events in the journal file at path.
+func journalLines(t *testing.T, path string) int {
+    t.Helper()
+    b, err := os.ReadFile(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return bytes.Count(b, []byte("\n"))
+}
+
+func TestJournal(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "events", "ws-events.jsonl")
+    h := NewHub()
+    if err := h.KeepHistory(3, path); err != nil {
+        t.Fatal(err)
+    }
+    go h.Run()
+    conn := dial(t, h)
+    for i := 1; i <= 7; i++ {
+        h.Broadcast(Event{Type: "fs", Action: "modified", Path: fmt.Sprintf("/%d.md", i)})
+    }
+    // The journal is written before the event is sent
+    for i := 1; i <= 7; i++ {
+        readMessage(t, conn)
+    }
+    // Compacted to the 3 kept events at 6 lines, then one more appended
+    if n := journalLines(t, path); n != 4 {
+        t.Errorf("journal holds %d events, want 4", n)
+    }
+
+    // A duplicate and a torn last line are skipped on reload
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := f.WriteString(`{"seq":6,"type":"fs"}` + "\n" + `{"seq":8,"ty`); err != nil {
+        t.Fatal(err)
+    }
+    f.Close()
+
+    restarted := NewHub()
+    if err := restarted.KeepHistory(3, path); err != nil {
+        t.Fatal(err)
+    }
+    if seq := restarted.seq.Load(); seq != 7 {
+        t.Errorf("sequence continues at %d, want 7", seq)
+    }
+    kept := restarted.history.all()
+    if got := seqs(kept); !reflect.DeepEqual(got, []uint64{5, 6, 7}) {
+        t.Errorf("reloaded %v, want [5 6 7]", got)
+    }
+    if kept[2].Path != "/7.md" {
+        t.Errorf("reloaded event %+v", kept[2])
+    }
+    if n := journalLines(t, path); n != 3 {
+        t.Errorf("journal holds %d events after reload, want 3", n)
+    }
+
+    // A missing journal starts empty
+    fresh := NewHub()
+    if err := fresh.KeepHistory(3, filepath.Join(t.TempDir(), "none.jsonl")); err != nil {
+        t.Fatal(err)
+    }
+    if fresh.seq.Load() != 0 || len(fresh.history.all()) != 0 {
+        t.Errorf("fresh journal loaded %v", fresh.history.all())
+    }
+}